@@ -0,0 +1,451 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mountkin/trash/conf"
+)
+
+// defaultSource is the source (one of the conf.Source* constants) of the
+// imports which have none, from the config.
+var defaultSource string
+
+// archiveTemplates are the URL templates of the archives of hosts, from the
+// config. They win over the ones of knownArchives.
+var archiveTemplates map[string]string
+
+// knownArchives are the URL templates of the archives of the hosts trash
+// knows. In templates, {repo} is the https:// URL of the repo, {host}, {path}
+// and {name} its host, path and last path element, and {rev} the tag, branch
+// or commit.
+var knownArchives = map[string]string{
+	"github.com":    "{repo}/archive/{rev}.tar.gz",
+	"gitlab.com":    "{repo}/-/archive/{rev}/{name}-{rev}.tar.gz",
+	"bitbucket.org": "{repo}/get/{rev}.tar.gz",
+}
+
+// archiveVCS downloads archives (tarballs) of single commits from the host
+// of a repo instead of cloning it. The commit of an archive comes from its
+// pax header, which `git archive` (and so every git host) writes.
+//
+// Its metadata dir holds the repo URL and, by commit, the extracted trees of
+// the commits downloaded so far and their dates.
+type archiveVCS struct{}
+
+const archiveMetaDir = ".trash-archive"
+
+var (
+	commitID     = regexp.MustCompile(`^[0-9a-f]{40}$`)
+	commitPrefix = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+)
+
+// archiveURL makes the URL of the archive of repo at rev from the template of
+// its host.
+func archiveURL(repo, rev string) (string, error) {
+	host, p := repoHostPath(repo)
+	if host == "" || p == "" {
+		return "", fmt.Errorf("cannot tell the host of '%s'", repo)
+	}
+	t, ok := archiveTemplates[host]
+	if !ok {
+		if t, ok = knownArchives[host]; !ok {
+			return "", fmt.Errorf("no archive URL template for '%s': add one to the archives of the config", host)
+		}
+	}
+	return strings.NewReplacer(
+		"{repo}", "https://"+host+"/"+p,
+		"{host}", host,
+		"{path}", p,
+		"{name}", path.Base(p),
+		"{rev}", url.PathEscape(rev),
+	).Replace(t), nil
+}
+
+// repoHostPath splits a repo URL (a URL, scp-like git@host:path or an
+// import path) into its host and path, without .git.
+func repoHostPath(repo string) (string, string) {
+	var host, p string
+	if u, err := url.Parse(repo); err == nil && u.Host != "" {
+		host, p = u.Host, u.Path
+	} else if k := strings.Index(repo, ":"); k >= 0 && !strings.Contains(repo[:k], "/") {
+		host, p = repo[:k], repo[k+1:]
+	} else if k := strings.Index(repo, "/"); k >= 0 {
+		host, p = repo[:k], repo[k:]
+	}
+	if k := strings.LastIndex(host, "@"); k >= 0 {
+		host = host[k+1:]
+	}
+	if k := strings.LastIndex(host, ":"); k >= 0 {
+		host = host[:k]
+	}
+	return host, strings.TrimSuffix(strings.Trim(p, "/"), ".git")
+}
+
+// archiveRepo is the repo downloaded to a dir of the cache.
+type archiveRepo struct {
+	root, meta string
+	repo       string
+}
+
+func openArchiveRepo(dir string) (*archiveRepo, error) {
+	for d := filepath.Clean(dir); ; d = filepath.Dir(d) {
+		meta := filepath.Join(d, archiveMetaDir)
+		if isDir(meta) {
+			repo, err := ioutil.ReadFile(filepath.Join(meta, "repo"))
+			if err != nil {
+				return nil, err
+			}
+			return &archiveRepo{root: d, meta: meta, repo: string(repo)}, nil
+		}
+		if d == filepath.Dir(d) {
+			return nil, fmt.Errorf("'%s' is not in a repo downloaded as archives", dir)
+		}
+	}
+}
+
+func (a *archiveRepo) tree(commit string) string {
+	return filepath.Join(a.meta, commit)
+}
+
+// find returns the commit of the tree downloaded for rev, a commit or a
+// prefix of one.
+func (a *archiveRepo) find(rev string) (string, bool) {
+	if !commitPrefix.MatchString(rev) {
+		return "", false
+	}
+	files, err := ioutil.ReadDir(a.meta)
+	if err != nil {
+		return "", false
+	}
+	for _, f := range files {
+		if f.IsDir() && commitID.MatchString(f.Name()) && strings.HasPrefix(f.Name(), rev) {
+			return f.Name(), true
+		}
+	}
+	return "", false
+}
+
+// download downloads and extracts the archive of rev, and returns its
+// commit.
+func (a *archiveRepo) download(ctx context.Context, log *logrus.Entry, rev string) (string, error) {
+	u, err := archiveURL(a.repo, rev)
+	if err != nil {
+		return "", err
+	}
+	if offline {
+		return "", offlineError("'%s' of '%s'", rev, a.repo)
+	}
+	log.Infof("Downloading '%s'", u)
+	var tmp, commit string
+	var date time.Time
+	err = retry(ctx, log, "download '"+u+"'", func(ctx context.Context) error {
+		resp, err := httpGet(ctx, proxyClient, u)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if tmp, err = ioutil.TempDir(a.meta, "download-"); err != nil {
+			return permanent(err)
+		}
+		if commit, date, err = extractTar(resp.Body, tmp); err != nil {
+			os.RemoveAll(tmp)
+			return fmt.Errorf("could not extract '%s': %s", u, err)
+		}
+		return nil
+	})
+	if err == errNotFound {
+		return "", fmt.Errorf("GET %s: not found", u)
+	} else if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	if commit == "" {
+		if !commitID.MatchString(rev) {
+			return "", fmt.Errorf("the archive '%s' does not tell its commit", u)
+		}
+		commit = rev
+	}
+	if commitID.MatchString(rev) && commit != rev {
+		return "", fmt.Errorf("the archive '%s' is of commit %s", u, commit)
+	}
+	if err := writeFileAtomic(a.tree(commit)+".date", []byte(date.UTC().Format(time.RFC3339))); err != nil {
+		return "", err
+	}
+	if isDir(a.tree(commit)) {
+		return commit, nil
+	}
+	return commit, os.Rename(tmp, a.tree(commit))
+}
+
+// extractTar extracts the tar (gzipped or not) of a single dir read from r
+// into dir, and returns the commit in its pax header, if any, and the date
+// of its files.
+func extractTar(r io.Reader, dir string) (string, time.Time, error) {
+	var commit string
+	var date time.Time
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return "", date, err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return commit, date, nil
+		}
+		if err != nil {
+			return "", date, err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			commit = hdr.PAXRecords["comment"]
+			continue
+		}
+		if date.IsZero() {
+			date = hdr.ModTime
+		}
+		// everything is in a single dir named after the repo and the commit
+		name := path.Clean(hdr.Name)
+		k := strings.Index(name, "/")
+		if k < 0 {
+			continue
+		}
+		target, err := tarTarget(dir, name[k+1:], hdr)
+		if err != nil {
+			return "", date, err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg, tar.TypeRegA:
+			err = writeTarFile(tr, target, os.FileMode(hdr.Mode).Perm())
+		case tar.TypeSymlink:
+			if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+				err = os.Symlink(hdr.Linkname, target)
+			}
+		}
+		if err != nil {
+			return "", date, err
+		}
+	}
+}
+
+// tarTarget returns the path in dir of the tar entry hdr, named name there
+// (slash-separated). Tarballs are not trusted: it refuses names and symlinks
+// leading out of dir, and names under a symlink, which an earlier entry could
+// have pointed anywhere. A symlink already at the path is removed, so that it
+// is replaced rather than followed.
+func tarTarget(dir, name string, hdr *tar.Header) (string, error) {
+	if name == ".." || strings.HasPrefix(name, "../") || path.IsAbs(name) {
+		return "", fmt.Errorf("unexpected file '%s'", hdr.Name)
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		link := path.Join(path.Dir(name), hdr.Linkname)
+		if path.IsAbs(hdr.Linkname) || link == ".." || strings.HasPrefix(link, "../") {
+			return "", fmt.Errorf("unexpected link '%s' to '%s'", hdr.Name, hdr.Linkname)
+		}
+	}
+	target := dir
+	parts := strings.Split(name, "/")
+	for k, part := range parts {
+		target = filepath.Join(target, part)
+		fi, err := os.Lstat(target)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if k < len(parts)-1 {
+			return "", fmt.Errorf("unexpected file '%s', under a symlink", hdr.Name)
+		}
+		if err := os.Remove(target); err != nil {
+			return "", err
+		}
+	}
+	return target, nil
+}
+
+func writeTarFile(r io.Reader, target string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if mode == 0 {
+		mode = 0644
+	}
+	fp, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fp, r); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+// checkout replaces the files of a.root with the tree of commit.
+func (a *archiveRepo) checkout(commit string) error {
+	files, err := ioutil.ReadDir(a.root)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.Name() != archiveMetaDir {
+			if err := os.RemoveAll(filepath.Join(a.root, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	tree := a.tree(commit)
+	err = filepath.Walk(tree, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || p == tree {
+			return err
+		}
+		rel, err := filepath.Rel(tree, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(a.root, rel)
+		switch {
+		case fi.IsDir():
+			return os.MkdirAll(target, 0755)
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		}
+		fp, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		return writeTarFile(fp, target, fi.Mode().Perm())
+	})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(a.meta, "current"), []byte(commit), 0644)
+}
+
+func (archiveVCS) Name() string    { return conf.SourceArchive }
+func (archiveVCS) MetaDir() string { return archiveMetaDir }
+
+// Clone sets up dir for the archives of url, or keeps the repo it has when
+// url is empty.
+func (archiveVCS) Clone(ctx context.Context, log *logrus.Entry, dir, repo, url string) error {
+	meta := filepath.Join(dir, archiveMetaDir)
+	if url == "" && isDir(meta) {
+		return nil
+	}
+	if url == "" {
+		return fmt.Errorf("no repo to download '%s' from", dir)
+	}
+	if err := os.MkdirAll(meta, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(meta, "repo"), []byte(url), 0644)
+}
+
+// Fetch does nothing: archives are downloaded on checkout.
+func (archiveVCS) Fetch(ctx context.Context, log *logrus.Entry, dir, url string) error {
+	return nil
+}
+
+// IsBranch is false: branches are downloaded again on every checkout anyway.
+func (archiveVCS) IsBranch(dir, url, rev string) (bool, error) {
+	return false, nil
+}
+
+// Checkout downloads rev, unless it is a commit downloaded already.
+func (archiveVCS) Checkout(ctx context.Context, log *logrus.Entry, dir, url, rev string) error {
+	a, err := openArchiveRepo(dir)
+	if err != nil {
+		return err
+	}
+	commit, ok := a.find(rev)
+	if !ok {
+		if commit, err = a.download(ctx, log, rev); err != nil {
+			return err
+		}
+		if commit != rev {
+			log.Debugf("'%s' of '%s' is commit '%s'", rev, a.repo, commit)
+		}
+	}
+	return a.checkout(commit)
+}
+
+func (archiveVCS) Current(dir string) (string, string, error) {
+	a, err := openArchiveRepo(dir)
+	if err != nil {
+		return "", "", err
+	}
+	commit, err := ioutil.ReadFile(filepath.Join(a.meta, "current"))
+	if err != nil {
+		return "", "", fmt.Errorf("no commit of '%s' checked out", a.repo)
+	}
+	date, err := ioutil.ReadFile(a.tree(string(commit)) + ".date")
+	if err != nil {
+		return "", "", err
+	}
+	return string(commit), string(date), nil
+}
+
+// Describe is the commit: without the history, there is no telling which
+// tag it comes after.
+func (v archiveVCS) Describe(dir string) (string, error) {
+	commit, _, err := v.Current(dir)
+	return commit, err
+}
+
+func (archiveVCS) Tags(ctx context.Context, log *logrus.Entry, dir string) ([]string, error) {
+	return nil, fmt.Errorf("the tags of repos downloaded as archives are unknown: use a tag, a branch or a commit")
+}
+
+func (archiveVCS) TagCommit(dir, tag string) (string, bool) {
+	return "", false
+}
+
+func (archiveVCS) HasCommit(dir, commit string) bool {
+	a, err := openArchiveRepo(dir)
+	if err != nil {
+		return false
+	}
+	_, ok := a.find(commit)
+	return ok
+}
+
+func (archiveVCS) Root(dir string) (string, error) {
+	a, err := openArchiveRepo(dir)
+	if err != nil {
+		return "", err
+	}
+	return a.root, nil
+}
+
+func (archiveVCS) RemoteURL(dir, url string) string {
+	a, err := openArchiveRepo(dir)
+	if err != nil {
+		return ""
+	}
+	return a.repo
+}
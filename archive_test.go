@@ -0,0 +1,177 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mountkin/trash/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchiveURL(t *testing.T) {
+	assert := require.New(t)
+	defer func() { archiveTemplates = nil }()
+	testData := []struct {
+		repo, url string
+	}{
+		{"https://github.com/urfave/cli.git", "https://github.com/urfave/cli/archive/v1.2.0.tar.gz"},
+		{"git@gitlab.com:group/sub/repo.git", "https://gitlab.com/group/sub/repo/-/archive/v1.2.0/repo-v1.2.0.tar.gz"},
+		{"ssh://git@bitbucket.org/ww/goautoneg", "https://bitbucket.org/ww/goautoneg/get/v1.2.0.tar.gz"},
+		{"github.com/urfave/cli", "https://github.com/urfave/cli/archive/v1.2.0.tar.gz"},
+	}
+	for _, d := range testData {
+		u, err := archiveURL(d.repo, "v1.2.0")
+		assert.NoError(err, d.repo)
+		assert.Equal(d.url, u, d.repo)
+	}
+
+	_, err := archiveURL("https://git.example.com/team/repo", "v1.2.0")
+	assert.Error(err)
+	archiveTemplates = map[string]string{"git.example.com": "https://{host}/api/v4/projects/{path}/repository/archive.tar.gz?sha={rev}"}
+	u, err := archiveURL("https://git.example.com/team/repo", "release/1.2")
+	assert.NoError(err)
+	assert.Equal("https://git.example.com/api/v4/projects/team/repo/repository/archive.tar.gz?sha=release%2F1.2", u)
+}
+
+func TestArchiveImport(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "trash-archive")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	defer func() { archiveTemplates = nil }()
+
+	repo := filepath.Join(dir, "repo")
+	assert.NoError(os.MkdirAll(repo, 0755))
+	run := func(args ...string) {
+		_, err := combinedOutput(git(repo, append([]string{"-c", "user.name=t", "-c", "user.email=t@example.com"}, args...)...))
+		assert.NoError(err, "%v", args)
+	}
+	commit := func(msg string) {
+		assert.NoError(ioutil.WriteFile(filepath.Join(repo, "sub", "sub.go"), []byte("package sub // "+msg+"\n"), 0644))
+		run("add", "-A")
+		run("commit", "-q", "-m", msg)
+	}
+	assert.NoError(os.MkdirAll(filepath.Join(repo, "sub"), 0755))
+	run("init", "-q")
+	commit("one")
+	run("tag", "v1.0.0")
+	commit("two")
+	one, err := outputString(git(repo, "rev-parse", "v1.0.0^{commit}"))
+	assert.NoError(err)
+
+	// the server serves archives the way git hosts do: made by `git archive`
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		rev := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/team/repo/"), ".tar.gz")
+		b, err := output(git(repo, "archive", "--format=tar.gz", "--prefix=repo-"+rev+"/", rev))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(b)
+	}))
+	defer srv.Close()
+	archiveTemplates = map[string]string{"git.example.com": srv.URL + "/{path}/{rev}.tar.gz"}
+
+	trashDir := filepath.Join(dir, "cache")
+	i := conf.Import{Package: "example.com/repo", Version: "v1.0.0", Repo: "https://git.example.com/team/repo", Source: conf.SourceArchive}
+	assert.NoError(checkoutImport(ctx, stdLog, trashDir, i))
+	assert.EqualValues(1, hits)
+	assert.False(isDir(filepath.Join(trashDir, "src", "example.com", "repo", ".git")))
+	content := func() string {
+		b, err := ioutil.ReadFile(filepath.Join(trashDir, "src", "example.com", "repo", "sub", "sub.go"))
+		assert.NoError(err)
+		return string(b)
+	}
+	assert.Equal("package sub // one\n", content())
+
+	li, err := lockImport(trashDir, i)
+	assert.NoError(err)
+	assert.Equal(one, li.Commit)
+	assert.Equal(i.Repo, li.Repo)
+	assert.NotEmpty(li.Date)
+
+	i.Version = "master"
+	assert.NoError(checkoutImport(ctx, stdLog, trashDir, i))
+	assert.Equal("package sub // two\n", content())
+	assert.EqualValues(2, hits)
+
+	// commits downloaded already are checked out from the cache
+	assert.NoError(checkoutLocked(ctx, stdLog, trashDir, i, li))
+	assert.Equal("package sub // one\n", content())
+	i.Version = one[:7]
+	assert.NoError(checkoutImport(ctx, stdLog, trashDir, i))
+	assert.Equal("package sub // one\n", content())
+	assert.EqualValues(2, hits)
+
+	i.Version = "^1.0"
+	assert.Error(checkoutImport(ctx, stdLog, trashDir, i))
+	i.Version = "v2.0.0"
+	assert.Error(checkoutImport(ctx, stdLog, trashDir, i))
+}
+
+// tarball returns a tar of files (by name, a body, or "-> target" for a
+// symlink), in that order.
+func tarball(t *testing.T, files ...string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for k := 0; k < len(files); k += 2 {
+		hdr := &tar.Header{Name: files[k], Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(files[k+1]))}
+		if strings.HasPrefix(files[k+1], "-> ") {
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, strings.TrimPrefix(files[k+1], "-> "), 0
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(files[k+1]))
+		if hdr.Typeflag == tar.TypeSymlink {
+			err = nil
+		}
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func TestExtractTarSymlinks(t *testing.T) {
+	assert := require.New(t)
+	dir, err := ioutil.TempDir("", "trash-tar")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	outside := filepath.Join(dir, "outside")
+	assert.NoError(os.MkdirAll(outside, 0755))
+
+	extract := func(files ...string) error {
+		tree, err := ioutil.TempDir(dir, "tree")
+		assert.NoError(err)
+		_, _, err = extractTar(bytes.NewReader(tarball(t, files...)), tree)
+		return err
+	}
+	// links inside the tree are fine, and a file replaces a link of its name
+	assert.NoError(extract(
+		"repo/sub/f.go", "package sub\n",
+		"repo/g.go", "-> sub/f.go",
+		"repo/sub/h.go", "-> ../g.go",
+		"repo/g.go", "package g\n",
+	))
+	// links out of the tree, and files under links, are not
+	assert.Error(extract("repo/evil", "-> "+outside))
+	assert.Error(extract("repo/sub/evil", "-> ../../../outside"))
+	assert.Error(extract(
+		"repo/evil", "-> sub",
+		"repo/sub/f.go", "package sub\n",
+		"repo/evil/authorized_keys", "pwned",
+	))
+	files, err := ioutil.ReadDir(outside)
+	assert.NoError(err)
+	assert.Empty(files)
+}
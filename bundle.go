@@ -0,0 +1,392 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mountkin/trash/conf"
+	"github.com/urfave/cli"
+)
+
+// A bundle is a tar file with the repos of the cache a project needs, for
+// machines without network access: bundleIndexName, a git bundle per git
+// repo under bundlesDir, and the files of the repos of other VCSs (modules
+// of proxies, archives...) under bundleFilesDir.
+const (
+	bundleIndexName = "trash-bundle.json"
+	bundlesDir      = "bundles"
+	bundleFilesDir  = "files"
+)
+
+// bundleIndex lists the repos of a bundle.
+type bundleIndex struct {
+	Repos []bundledRepo `json:"repos"`
+}
+
+// bundledRepo is a repo of a bundle, with the commits the project needs.
+type bundledRepo struct {
+	Path    string            `json:"path"` // relative to <cache>/src
+	VCS     string            `json:"vcs"`
+	Remotes map[string]string `json:"remotes,omitempty"` // git remotes, by name
+	Commits []string          `json:"commits"`
+}
+
+// bundleRefs holds the refs of the commits of a git bundle that no tag of the
+// lock points to, in the bundle and in the repos it is unbundled to.
+const bundleRefs = "refs/trash/"
+
+// isBundle tells whether repo is a git bundle file, rather than a URL.
+func isBundle(repo string) bool {
+	return strings.HasSuffix(repo, ".bundle")
+}
+
+// repoURL returns the URL to fetch repo (conf.Import.Repo) from: repo
+// itself, but for bundle files given relative to the project dir.
+func repoURL(repo string) string {
+	if isBundle(repo) && !filepath.IsAbs(repo) {
+		if abs, err := filepath.Abs(repo); err == nil {
+			return abs
+		}
+	}
+	return repo
+}
+
+func bundleCommand(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("expected the tar file to write")
+	}
+	out, err := filepath.Abs(c.Args().First())
+	if err != nil {
+		return err
+	}
+	_, confFile, trashDir, trashConf, err := setup(c)
+	if err != nil {
+		return err
+	}
+	lock, err := conf.ParseLock(conf.LockFile(confFile))
+	if err != nil {
+		return err
+	}
+	return writeBundle(trashDir, trashConf, lock, out)
+}
+
+// writeBundle writes the repos of the imports of lock to the bundle out,
+// from trashDir: git repos with the history of the commits locked (and their
+// tags) and nothing else, other repos whole. Every import of trashConf has
+// to be locked.
+func writeBundle(trashDir string, trashConf *conf.Conf, lock *conf.Lock, out string) error {
+	for _, i := range trashConf.Imports {
+		if _, ok := lock.Get(i.Package); !ok {
+			return fmt.Errorf("'%s' is not in %s: run trash first", i.Package, conf.LockFileName)
+		}
+	}
+	tmpDir, err := ioutil.TempDir("", "trash-bundle")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	src := filepath.Join(trashDir, "src")
+	var index bundleIndex
+	byRoot := map[string]int{}
+	refs := map[string][]string{} // by root: the refs to bundle
+	for _, li := range lock.Imports {
+		i, ok := trashConf.Get(li.Package)
+		if !ok {
+			i = conf.Import{Package: li.Package, Version: li.Version}
+		}
+		v, root, err := repoOf(trashDir, i)
+		if err != nil {
+			return &importError{i, err}
+		}
+		if !ok && v.RemoteURL(root, li.Repo) != "" {
+			// locked, but not in the config: fetched from a repo of its own
+			i.Repo = li.Repo
+		}
+		if !v.HasCommit(root, li.Commit) {
+			return &importError{i, fmt.Errorf("locked commit '%s' is not in the cache", li.Commit)}
+		}
+		k, ok := byRoot[root]
+		if !ok {
+			rel, _ := filepath.Rel(src, root)
+			k, byRoot[root] = len(index.Repos), len(index.Repos)
+			index.Repos = append(index.Repos, bundledRepo{Path: filepath.ToSlash(rel), VCS: v.Name()})
+		}
+		r := &index.Repos[k]
+		if !contains(r.Commits, li.Commit) {
+			r.Commits = append(r.Commits, li.Commit)
+		}
+		if v.Name() != (gitVCS{}).Name() {
+			continue
+		}
+		if r.Remotes == nil {
+			r.Remotes = map[string]string{}
+		}
+		r.Remotes[remoteName(i.Repo)] = v.RemoteURL(root, i.Repo)
+		ref := bundleRefs + li.Commit
+		if commit, ok := v.TagCommit(root, li.Version); ok && commit == li.Commit {
+			ref = "refs/tags/" + li.Version
+		}
+		if !contains(refs[root], ref) {
+			refs[root] = append(refs[root], ref)
+		}
+	}
+
+	for root, k := range byRoot {
+		r := index.Repos[k]
+		if r.VCS != (gitVCS{}).Name() {
+			continue
+		}
+		err := withRepoLock(trashDir, r.Path, func() error {
+			return gitBundle(root, filepath.Join(tmpDir, filepath.FromSlash(r.Path)+".bundle"), refs[root])
+		})
+		if err != nil {
+			return fmt.Errorf("could not bundle '%s': %s", r.Path, err)
+		}
+	}
+
+	fp, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	tw := tar.NewWriter(fp)
+	b, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: bundleIndexName, Mode: 0644, Size: int64(len(b)), ModTime: time.Now(), Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(b); err != nil {
+		return err
+	}
+	for _, r := range index.Repos {
+		var err error
+		if r.VCS == (gitVCS{}).Name() {
+			logrus.Infof("Bundling '%s' (%d commit(s))", r.Path, len(r.Commits))
+			err = addTarFile(tw, filepath.Join(tmpDir, filepath.FromSlash(r.Path)+".bundle"), bundlesDir+"/"+r.Path+".bundle")
+		} else {
+			logrus.Infof("Bundling '%s' (%s)", r.Path, r.VCS)
+			err = withRepoLock(trashDir, r.Path, func() error {
+				return addTarDir(tw, filepath.Join(src, filepath.FromSlash(r.Path)), bundleFilesDir+"/"+r.Path)
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return fp.Close()
+}
+
+// gitBundle writes a git bundle of refs of the repo in dir to file. Refs
+// under bundleRefs are made for the occasion.
+func gitBundle(dir, file string, refs []string) error {
+	for _, ref := range refs {
+		if strings.HasPrefix(ref, bundleRefs) {
+			if _, err := combinedOutput(git(dir, "update-ref", ref, strings.TrimPrefix(ref, bundleRefs))); err != nil {
+				return err
+			}
+			defer runCommand(git(dir, "update-ref", "-d", ref))
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	_, err := combinedOutput(git(dir, append([]string{"bundle", "create", "-q", file}, refs...)...))
+	return err
+}
+
+// addTarFile adds the file at p to tw, as name.
+func addTarFile(tw *tar.Writer, p, name string) error {
+	fp, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	fi, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, fp)
+	return err
+}
+
+// addTarDir adds the files under dir to tw, under prefix.
+func addTarDir(tw *tar.Writer, dir, prefix string) error {
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		name := path.Join(prefix, filepath.ToSlash(rel))
+		switch {
+		case fi.Mode().IsRegular():
+			return addTarFile(tw, p, name)
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return tw.WriteHeader(&tar.Header{Name: name, Linkname: link, Typeflag: tar.TypeSymlink, Mode: 0777})
+		}
+		return nil
+	})
+}
+
+func unbundleCommand(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("expected the tar file to read")
+	}
+	trashDir, err := cacheDir(c)
+	if err != nil {
+		return err
+	}
+	return readBundle(trashDir, c.Args().First())
+}
+
+// readBundle adds the repos of the bundle in to trashDir: the commits and
+// remotes of git repos (initialized if need be), and the files of the others.
+func readBundle(trashDir, in string) error {
+	fp, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	tmpDir, err := ioutil.TempDir("", "trash-unbundle")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	src := filepath.Join(trashDir, "src")
+	var index *bundleIndex
+	tr := tar.NewReader(fp)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(hdr.Name)
+		if name == ".." || strings.HasPrefix(name, "../") || path.IsAbs(name) {
+			return fmt.Errorf("unexpected file '%s' in '%s'", hdr.Name, in)
+		}
+		switch {
+		case name == bundleIndexName:
+			index = &bundleIndex{}
+			if err := json.NewDecoder(tr).Decode(index); err != nil {
+				return fmt.Errorf("could not read the index of '%s': %s", in, err)
+			}
+		case index == nil:
+			return fmt.Errorf("'%s' is not a trash bundle: it does not start with %s", in, bundleIndexName)
+		case strings.HasPrefix(name, bundlesDir+"/"):
+			p := strings.TrimSuffix(strings.TrimPrefix(name, bundlesDir+"/"), ".bundle")
+			r, ok := index.repo(p)
+			if !ok {
+				return fmt.Errorf("'%s' of '%s' is not in its index", name, in)
+			}
+			file := filepath.Join(tmpDir, "repo.bundle")
+			if err := writeTarFile(tr, file, 0644); err != nil {
+				return err
+			}
+			err := withRepoLock(trashDir, r.Path, func() error {
+				return gitUnbundle(filepath.Join(src, filepath.FromSlash(r.Path)), file, r)
+			})
+			if err != nil {
+				return fmt.Errorf("could not unbundle '%s': %s", r.Path, err)
+			}
+			logrus.Infof("Unbundled '%s' (%d commit(s))", r.Path, len(r.Commits))
+		case strings.HasPrefix(name, bundleFilesDir+"/"):
+			target, err := tarTarget(src, strings.TrimPrefix(name, bundleFilesDir+"/"), hdr)
+			if err != nil {
+				return fmt.Errorf("%s in '%s'", err, in)
+			}
+			switch hdr.Typeflag {
+			case tar.TypeReg, tar.TypeRegA:
+				err = writeTarFile(tr, target, os.FileMode(hdr.Mode).Perm())
+			case tar.TypeSymlink:
+				if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+					err = os.Symlink(hdr.Linkname, target)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if index == nil {
+		return fmt.Errorf("'%s' is not a trash bundle: it has no %s", in, bundleIndexName)
+	}
+	for _, r := range index.Repos {
+		if r.VCS != (gitVCS{}).Name() {
+			logrus.Infof("Unbundled '%s' (%s)", r.Path, r.VCS)
+		}
+	}
+	return nil
+}
+
+func (b *bundleIndex) repo(p string) (bundledRepo, bool) {
+	for _, r := range b.Repos {
+		if r.Path == p {
+			return r, true
+		}
+	}
+	return bundledRepo{}, false
+}
+
+// gitUnbundle fetches the refs of the git bundle file into the repo in dir,
+// which it makes if need be, and adds the remotes of r it lacks.
+func gitUnbundle(dir, file string, r bundledRepo) error {
+	if !isGitRoot(dir) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if _, err := combinedOutput(git(dir, "init", "-q")); err != nil {
+			return err
+		}
+	}
+	remotes, err := outputLines(git(dir, "remote"))
+	if err != nil {
+		return err
+	}
+	for name, url := range r.Remotes {
+		if !contains(remotes, name) {
+			if _, err := combinedOutput(git(dir, "remote", "add", name, url)); err != nil {
+				return err
+			}
+		}
+	}
+	fetch := git(dir, "fetch", "-q", file, "+refs/tags/*:refs/tags/*", "+"+bundleRefs+"*:"+bundleRefs+"*")
+	if _, err := combinedOutput(allowProtocols(fetch, "file")); err != nil {
+		return err
+	}
+	for _, commit := range r.Commits {
+		if !(gitVCS{}).HasCommit(dir, commit) {
+			return fmt.Errorf("commit '%s' is missing from the bundle", commit)
+		}
+	}
+	return nil
+}
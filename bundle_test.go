@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mountkin/trash/conf"
+	"github.com/stretchr/testify/require"
+)
+
+// makeUpstream makes a git repo in dir with the commits one (tagged v1.0.0),
+// two and three, and returns them.
+func makeUpstream(t *testing.T, dir string) []string {
+	assert := require.New(t)
+	assert.NoError(os.MkdirAll(dir, 0755))
+	run := func(args ...string) {
+		_, err := combinedOutput(git(dir, append([]string{"-c", "user.name=t", "-c", "user.email=t@example.com"}, args...)...))
+		assert.NoError(err, "%v", args)
+	}
+	run("init", "-q")
+	var commits []string
+	for _, msg := range []string{"one", "two", "three"} {
+		assert.NoError(ioutil.WriteFile(filepath.Join(dir, "f.go"), []byte("package f // "+msg+"\n"), 0644))
+		run("add", "-A")
+		run("commit", "-q", "-m", msg)
+		head, _, err := gitVCS{}.Current(dir)
+		assert.NoError(err)
+		commits = append(commits, head)
+		if msg == "one" {
+			run("tag", "v1.0.0")
+		}
+	}
+	return commits
+}
+
+func TestBundle(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "trash-bundle")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	defer func() { offline = false }()
+
+	foo, bar := filepath.Join(dir, "foo"), filepath.Join(dir, "bar")
+	fooCommits, barCommits := makeUpstream(t, foo), makeUpstream(t, bar)
+	trashConf := &conf.Conf{Imports: []conf.Import{
+		{Package: "example.com/foo", Version: "v1.0.0", Repo: foo},
+		{Package: "example.com/bar", Version: barCommits[1][:7], Repo: bar},
+	}}
+	trashDir := filepath.Join(dir, "cache")
+	lock := &conf.Lock{}
+	for _, i := range trashConf.Imports {
+		assert.NoError(checkoutImport(ctx, stdLog, trashDir, i))
+		li, err := lockImport(trashDir, i)
+		assert.NoError(err)
+		lock.Set(li)
+	}
+
+	out := filepath.Join(dir, "out.tar")
+	assert.Error(writeBundle(trashDir, &conf.Conf{Imports: append(trashConf.Imports, conf.Import{Package: "example.com/baz"})}, lock, out))
+	assert.NoError(writeBundle(trashDir, trashConf, lock, out))
+	fooDir := filepath.Join(trashDir, "src", "example.com", "foo")
+	refs, err := outputLines(git(fooDir, "for-each-ref", bundleRefs))
+	assert.NoError(err)
+	assert.Empty(refs)
+
+	// a cache seeded with the bundle has what the lock needs, and only that
+	assert.NoError(os.Rename(foo, foo+".gone"))
+	assert.NoError(os.Rename(bar, bar+".gone"))
+	otherDir := filepath.Join(dir, "other")
+	assert.NoError(readBundle(otherDir, out))
+	offline = true
+	for _, i := range trashConf.Imports {
+		li, _ := lock.Get(i.Package)
+		assert.NoError(prepareCache(ctx, stdLog, otherDir, i))
+		assert.NoError(checkoutLocked(ctx, stdLog, otherDir, i, li))
+	}
+	fooDir = filepath.Join(otherDir, "src", "example.com", "foo")
+	barDir := filepath.Join(otherDir, "src", "example.com", "bar")
+	commit, ok := gitVCS{}.TagCommit(fooDir, "v1.0.0")
+	assert.True(ok)
+	assert.Equal(fooCommits[0], commit)
+	assert.False(gitVCS{}.HasCommit(fooDir, fooCommits[1]))
+	assert.True(gitVCS{}.HasCommit(barDir, barCommits[0]))
+	assert.False(gitVCS{}.HasCommit(barDir, barCommits[2]))
+
+	// unbundling again changes nothing
+	assert.NoError(readBundle(otherDir, out))
+	assert.Error(readBundle(otherDir, filepath.Join(fooDir, "f.go")))
+
+	// files are not written out of the cache, be it through a symlink
+	evil := filepath.Join(dir, "evil.tar")
+	outside := filepath.Join(dir, "outside")
+	assert.NoError(os.MkdirAll(outside, 0755))
+	assert.NoError(ioutil.WriteFile(evil, tarball(t,
+		bundleIndexName, "{}",
+		bundleFilesDir+"/example.com/evil", "-> "+outside,
+		bundleFilesDir+"/example.com/evil/authorized_keys", "pwned",
+	), 0644))
+	assert.Error(readBundle(otherDir, evil))
+	assert.NoError(ioutil.WriteFile(evil, tarball(t,
+		bundleIndexName, "{}",
+		bundleFilesDir+"/example.com/evil", "-> ../../outside",
+	), 0644))
+	assert.Error(readBundle(otherDir, evil))
+	files, err := ioutil.ReadDir(outside)
+	assert.NoError(err)
+	assert.Empty(files)
+}
+
+func TestBundleRepo(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "trash-bundle")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	defer func() { offline = false }()
+
+	upstream := filepath.Join(dir, "upstream")
+	commits := makeUpstream(t, upstream)
+	proj := filepath.Join(dir, "proj")
+	assert.NoError(os.MkdirAll(filepath.Join(proj, "deps"), 0755))
+	_, err = combinedOutput(git(upstream, "bundle", "create", "-q", filepath.Join(proj, "deps", "f.bundle"), "--all"))
+	assert.NoError(err)
+
+	wd, err := os.Getwd()
+	assert.NoError(err)
+	assert.NoError(os.Chdir(proj))
+	defer os.Chdir(wd)
+
+	// bundles are local: --offline does not keep them from being fetched
+	offline = true
+	trashDir := filepath.Join(dir, "cache")
+	i := conf.Import{Package: "example.com/f", Version: "v1.0.0", Repo: "deps/f.bundle"}
+	assert.NoError(checkoutImport(ctx, stdLog, trashDir, i))
+	li, err := lockImport(trashDir, i)
+	assert.NoError(err)
+	assert.Equal(commits[0], li.Commit)
+	assert.Equal("deps/f.bundle", li.Repo)
+	assert.True(li.Matches(i))
+	i.Version = "master"
+	assert.NoError(checkoutImport(ctx, stdLog, trashDir, i))
+	li, err = lockImport(trashDir, i)
+	assert.NoError(err)
+	assert.Equal(commits[2], li.Commit)
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mountkin/trash/conf"
+	"github.com/urfave/cli"
+)
+
+// usedDir is where the cache keeps when each of its repos was last copied
+// to a vendor dir: the mtime of <usedDir>/<repo>.used.
+const usedDir = "used"
+
+// cachedRepo is a repo of the cache.
+type cachedRepo struct {
+	path string // relative to <cache>/src, e.g. github.com/foo/bar
+	dir  string
+	vcs  VCS
+}
+
+// markUsed records that the repo in repoDir has just been used.
+func markUsed(trashDir, repoDir string) {
+	rel, err := filepath.Rel(filepath.Join(trashDir, "src"), repoDir)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return
+	}
+	stamp := filepath.Join(trashDir, usedDir, rel+".used")
+	if err := os.MkdirAll(filepath.Dir(stamp), 0755); err == nil {
+		ioutil.WriteFile(stamp, nil, 0644)
+	}
+}
+
+// lastUse returns when r was last used, or, if that was never recorded,
+// when its metadata was last changed.
+func (r cachedRepo) lastUse(trashDir string) time.Time {
+	if fi, err := os.Stat(filepath.Join(trashDir, usedDir, filepath.FromSlash(r.path)+".used")); err == nil {
+		return fi.ModTime()
+	}
+	if fi, err := os.Stat(filepath.Join(r.dir, r.vcs.MetaDir())); err == nil {
+		return fi.ModTime()
+	}
+	return time.Time{}
+}
+
+// scanCache returns the repos of the cache, and the stray dirs and files of
+// its src dir: the ones no repo is in, e.g. left over by interrupted clones.
+func scanCache(trashDir string) ([]cachedRepo, []string, error) {
+	src := filepath.Join(trashDir, "src")
+	var repos []cachedRepo
+	var stray []string
+	var scan func(dir string) (bool, error)
+	scan = func(dir string) (bool, error) {
+		for _, v := range vcsList {
+			if dir != src && isDir(filepath.Join(dir, v.MetaDir())) {
+				rel, _ := filepath.Rel(src, dir)
+				repos = append(repos, cachedRepo{path: filepath.ToSlash(rel), dir: dir, vcs: v})
+				return true, nil
+			}
+		}
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return false, err
+		}
+		found := false
+		var empty []string
+		for _, fi := range fis {
+			p := filepath.Join(dir, fi.Name())
+			if !fi.IsDir() {
+				empty = append(empty, p)
+				continue
+			}
+			has, err := scan(p)
+			if err != nil {
+				return false, err
+			}
+			if has {
+				found = true
+			} else {
+				empty = append(empty, p)
+			}
+		}
+		if found || dir == src {
+			stray = append(stray, empty...)
+		}
+		return found, nil
+	}
+	if !isDir(src) {
+		return nil, nil, nil
+	}
+	if _, err := scan(src); err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(stray)
+	return repos, stray, nil
+}
+
+// cacheDir returns the cache dir of the command.
+func cacheDir(c *cli.Context) (string, error) {
+	lockTimeout = c.GlobalDuration("lock-timeout")
+	commandTimeout = c.GlobalDuration("command-timeout")
+	return filepath.Abs(c.GlobalString("cache"))
+}
+
+// cacheLsCommand lists the repos of the cache, with their size and when they
+// were last used.
+func cacheLsCommand(c *cli.Context) error {
+	trashDir, err := cacheDir(c)
+	if err != nil {
+		return err
+	}
+	repos, stray, err := scanCache(trashDir)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, r := range repos {
+		size := dirSize(r.dir)
+		total += size
+		used := "unknown"
+		if t := r.lastUse(trashDir); !t.IsZero() {
+			used = t.Local().Format(time.RFC3339)
+		}
+		fmt.Printf("%s\t%s\t%d\t%s\n", r.path, r.vcs.Name(), size, used)
+	}
+	for _, p := range stray {
+		size := dirSize(p)
+		total += size
+		rel, _ := filepath.Rel(filepath.Join(trashDir, "src"), p)
+		fmt.Printf("%s\t(not a repo)\t%d\t\n", filepath.ToSlash(rel), size)
+	}
+	fmt.Printf("%d repo(s), %d bytes\n", len(repos), total)
+	return nil
+}
+
+// referencedRepos returns the repos of the cache the imports of confFiles
+// (and of their locks) are in, with the names of the remotes they are
+// fetched from. confFiles may be project dirs, whose config is found the
+// usual way.
+func referencedRepos(trashDir string, confFiles []string) (map[string]map[string]bool, error) {
+	src := filepath.Join(trashDir, "src")
+	r := map[string]map[string]bool{}
+	add := func(pkg, repo string) {
+		_, root, ok := detectVCS(filepath.Join(src, pkg), src)
+		if !ok {
+			return
+		}
+		rel, _ := filepath.Rel(src, root)
+		rel = filepath.ToSlash(rel)
+		if r[rel] == nil {
+			r[rel] = map[string]bool{}
+		}
+		r[rel][remoteName(repo)] = true
+	}
+	for _, f := range confFiles {
+		if isDir(f) {
+			name := conf.Find(f)
+			if name == "" {
+				return nil, fmt.Errorf("no config in '%s'", f)
+			}
+			f = filepath.Join(f, name)
+		}
+		trashConf, err := conf.Parse(f)
+		if err != nil {
+			return nil, fmt.Errorf("could not read '%s': %s", f, err)
+		}
+		lock, err := conf.ParseLock(conf.LockFile(f))
+		if err != nil {
+			return nil, fmt.Errorf("could not read the lock of '%s': %s", f, err)
+		}
+		for _, i := range trashConf.Imports {
+			add(i.Package, i.Repo)
+		}
+		for _, li := range lock.Imports {
+			add(li.Package, li.Repo)
+		}
+	}
+	return r, nil
+}
+
+// orphanedRemotes describes the remotes of the git repo r that are not named
+// after their URL, and, if used is not nil, the ones no import fetches from.
+func orphanedRemotes(r cachedRepo, used map[string]bool) ([]string, error) {
+	remotes, err := outputLines(git(r.dir, "remote"))
+	if err != nil {
+		return nil, err
+	}
+	var orphaned []string
+	for _, remote := range remotes {
+		url, _ := outputString(git(r.dir, "config", "--get", "remote."+remote+".url"))
+		switch {
+		case remote != "origin" && remote != remoteName(url) && !isBundle(url):
+			orphaned = append(orphaned, fmt.Sprintf("remote '%s' (%s) is not named after its URL", remote, url))
+		case used != nil && !used[remote]:
+			orphaned = append(orphaned, fmt.Sprintf("remote '%s' (%s) is not used by any of the configs", remote, url))
+		}
+	}
+	return orphaned, nil
+}
+
+// cacheVerifyCommand checks the git repos of the cache with `git fsck` and
+// reports their orphaned remotes and the stray dirs of the cache.
+func cacheVerifyCommand(c *cli.Context) error {
+	trashDir, err := cacheDir(c)
+	if err != nil {
+		return err
+	}
+	repos, stray, err := scanCache(trashDir)
+	if err != nil {
+		return err
+	}
+	referenced, err := referencedRepos(trashDir, c.Args())
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	for _, p := range stray {
+		problems = append(problems, fmt.Sprintf("'%s' is not in any repo", p))
+	}
+	for _, r := range repos {
+		if r.vcs.Name() != (gitVCS{}).Name() {
+			logrus.Debugf("Not checking '%s': not a git repo", r.path)
+			continue
+		}
+		err := withRepoLock(trashDir, r.path, func() error {
+			logrus.Infof("Checking '%s'", r.path)
+			if _, err := combinedOutput(git(r.dir, "fsck", "--no-progress", "--no-dangling")); err != nil {
+				problems = append(problems, err.Error())
+			}
+			orphaned, err := orphanedRemotes(r, referenced[r.path])
+			for _, o := range orphaned {
+				problems = append(problems, fmt.Sprintf("'%s': %s", r.path, o))
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(problems) == 0 {
+		logrus.Infof("'%s' is fine: %d repo(s) checked", trashDir, len(repos))
+		return nil
+	}
+	for _, p := range problems {
+		logrus.Error(p)
+	}
+	return cli.NewExitError(fmt.Sprintf("'%s': %d problem(s) found", trashDir, len(problems)), 1)
+}
+
+// cachePruneCommand removes the stray dirs of the cache, and the repos the
+// configs given do not reference or that were not used for --days, keeping
+// the ones that fit either, if both are given. With configs, it also removes
+// the remotes of the repos kept that none of them fetch from.
+func cachePruneCommand(c *cli.Context) error {
+	trashDir, err := cacheDir(c)
+	if err != nil {
+		return err
+	}
+	dryRun := c.GlobalBool("dry-run")
+	days := c.Int("days")
+	confFiles := c.Args()
+	if len(confFiles) == 0 && days <= 0 {
+		return fmt.Errorf("nothing to prune by: give the configs (or project dirs) whose repos to keep, or --days")
+	}
+	repos, stray, err := scanCache(trashDir)
+	if err != nil {
+		return err
+	}
+	referenced, err := referencedRepos(trashDir, confFiles)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+
+	verb := "Removing"
+	if dryRun {
+		verb = "Would remove"
+	}
+	var freed int64
+	for _, p := range stray {
+		size := dirSize(p)
+		logrus.Infof("%s '%s' (not in any repo, %d bytes)", verb, p, size)
+		freed += size
+		if !dryRun {
+			if err := os.RemoveAll(p); err != nil {
+				return err
+			}
+		}
+	}
+	for _, r := range repos {
+		err := withRepoLock(trashDir, r.path, func() error {
+			used := r.lastUse(trashDir)
+			if referenced[r.path] != nil || days > 0 && used.After(cutoff) {
+				if referenced[r.path] == nil || r.vcs.Name() != (gitVCS{}).Name() {
+					return nil
+				}
+				return pruneRemotes(r, referenced[r.path], verb, dryRun)
+			}
+			size := dirSize(r.dir)
+			logrus.Infof("%s '%s' (last used %s, %d bytes)", verb, r.path, used.Local().Format(time.RFC3339), size)
+			freed += size
+			if dryRun {
+				return nil
+			}
+			os.Remove(filepath.Join(trashDir, usedDir, filepath.FromSlash(r.path)+".used"))
+			return os.RemoveAll(r.dir)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if !dryRun {
+		removeEmptySubdirs(filepath.Join(trashDir, "src"))
+		removeEmptySubdirs(filepath.Join(trashDir, usedDir))
+	}
+	logrus.Infof("%d bytes freed", freed)
+	return nil
+}
+
+// pruneRemotes removes the remotes of the git repo r no import fetches from.
+func pruneRemotes(r cachedRepo, used map[string]bool, verb string, dryRun bool) error {
+	remotes, err := outputLines(git(r.dir, "remote"))
+	if err != nil {
+		return err
+	}
+	for _, remote := range remotes {
+		if remote == "origin" || used[remote] {
+			continue
+		}
+		url, _ := outputString(git(r.dir, "config", "--get", "remote."+remote+".url"))
+		logrus.Infof("%s remote '%s' (%s) of '%s'", verb, remote, url, r.path)
+		if dryRun {
+			continue
+		}
+		if _, err := combinedOutput(git(r.dir, "remote", "remove", remote)); err != nil {
+			return fmt.Errorf("could not remove remote '%s' of '%s': %s", remote, r.path, err)
+		}
+	}
+	return nil
+}
+
+// removeEmptySubdirs removes the empty dirs under dir (but not dir).
+func removeEmptySubdirs(dir string) {
+	fis, _ := ioutil.ReadDir(dir)
+	for _, fi := range fis {
+		if p := filepath.Join(dir, fi.Name()); fi.IsDir() {
+			removeEmptySubdirs(p)
+			os.Remove(p) // fails unless empty
+		}
+	}
+}
+
+// cacheGCCommand repacks the git repos of the cache.
+func cacheGCCommand(c *cli.Context) error {
+	trashDir, err := cacheDir(c)
+	if err != nil {
+		return err
+	}
+	repos, _, err := scanCache(trashDir)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	var before, after int64
+	for _, r := range repos {
+		if r.vcs.Name() != (gitVCS{}).Name() {
+			continue
+		}
+		err := withRepoLock(trashDir, r.path, func() error {
+			meta := filepath.Join(r.dir, r.vcs.MetaDir())
+			size := dirSize(meta)
+			logrus.Infof("Repacking '%s'", r.path)
+			if _, err := combinedOutput(git(r.dir, "gc", "--quiet", "--prune=now")); err != nil {
+				return err
+			}
+			before, after = before+size, after+dirSize(meta)
+			return nil
+		})
+		if err != nil {
+			logrus.Error(err)
+			failed++
+		}
+	}
+	logrus.Infof("%d bytes of git metadata, %d before", after, before)
+	if failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d repo(s) could not be repacked", failed), 1)
+	}
+	return nil
+}
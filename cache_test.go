@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScanCache(t *testing.T) {
+	assert := require.New(t)
+	trashDir, err := ioutil.TempDir("", "trash-cache")
+	assert.NoError(err)
+	defer os.RemoveAll(trashDir)
+	src := filepath.Join(trashDir, "src")
+
+	for _, d := range []string{"example.com/foo/.git", "example.com/foo/sub", "example.com/broken/sub", "other.org/bar/.trash-archive", "empty.org"} {
+		assert.NoError(os.MkdirAll(filepath.Join(src, d), 0755))
+	}
+	assert.NoError(ioutil.WriteFile(filepath.Join(src, "example.com", "foo", "sub", "sub.go"), []byte("package sub\n"), 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(src, "example.com", "stray.go"), []byte("package stray\n"), 0644))
+
+	repos, stray, err := scanCache(trashDir)
+	assert.NoError(err)
+	var paths []string
+	for _, r := range repos {
+		paths = append(paths, r.path+" "+r.vcs.Name())
+	}
+	assert.Equal([]string{"example.com/foo git", "other.org/bar archive"}, paths)
+	assert.Equal([]string{
+		filepath.Join(src, "empty.org"),
+		filepath.Join(src, "example.com", "broken"),
+		filepath.Join(src, "example.com", "stray.go"),
+	}, stray)
+
+	// last use is recorded on use, and falls back to the mtime of the metadata
+	old := time.Now().Add(-48 * time.Hour)
+	assert.NoError(os.Chtimes(filepath.Join(src, "example.com", "foo", ".git"), old, old))
+	assert.WithinDuration(old, repos[0].lastUse(trashDir), time.Second)
+	markUsed(trashDir, filepath.Join(src, "example.com", "foo"))
+	assert.WithinDuration(time.Now(), repos[0].lastUse(trashDir), time.Minute)
+}
+
+func TestReferencedRepos(t *testing.T) {
+	assert := require.New(t)
+	dir, err := ioutil.TempDir("", "trash-cache")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	trashDir := filepath.Join(dir, "cache")
+	repoDir := filepath.Join(trashDir, "src", "example.com", "foo")
+	assert.NoError(os.MkdirAll(repoDir, 0755))
+	_, err = combinedOutput(git(repoDir, "init", "-q"))
+	assert.NoError(err)
+	for _, url := range []string{"https://example.com/foo", "https://mirror.example.com/foo", "https://old.example.com/foo"} {
+		_, err = combinedOutput(git(repoDir, "remote", "add", remoteName(url), url))
+		assert.NoError(err)
+	}
+	_, err = combinedOutput(git(repoDir, "remote", "add", "renamed", "https://other.example.com/foo"))
+	assert.NoError(err)
+
+	proj := filepath.Join(dir, "proj")
+	assert.NoError(os.MkdirAll(proj, 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(proj, "vendor.conf"), []byte(
+		"example.com/foo/sub v1.0.0 https://example.com/foo\nexample.com/bar v1.0.0\n"), 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "other.conf"), []byte(
+		"example.com/foo v1.0.0 https://mirror.example.com/foo\n"), 0644))
+
+	referenced, err := referencedRepos(trashDir, []string{proj, filepath.Join(dir, "other.conf")})
+	assert.NoError(err)
+	assert.Equal(map[string]map[string]bool{
+		"example.com/foo": {remoteName("https://example.com/foo"): true, remoteName("https://mirror.example.com/foo"): true},
+	}, referenced)
+
+	r := cachedRepo{path: "example.com/foo", dir: repoDir, vcs: gitVCS{}}
+	orphaned, err := orphanedRemotes(r, nil)
+	assert.NoError(err)
+	assert.Equal([]string{"remote 'renamed' (https://other.example.com/foo) is not named after its URL"}, orphaned)
+	orphaned, err = orphanedRemotes(r, referenced[r.path])
+	assert.NoError(err)
+	assert.Equal([]string{
+		"remote '" + remoteName("https://old.example.com/foo") + "' (https://old.example.com/foo) is not used by any of the configs",
+		"remote 'renamed' (https://other.example.com/foo) is not named after its URL",
+	}, orphaned)
+
+	assert.NoError(pruneRemotes(r, referenced[r.path], "Removing", false))
+	remotes, err := outputLines(git(repoDir, "remote"))
+	assert.NoError(err)
+	assert.Len(remotes, 2)
+
+	_, err = referencedRepos(trashDir, []string{dir})
+	assert.Error(err)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mountkin/trash/conf"
+	"github.com/urfave/cli"
+)
+
+// project is the state shared by the commands editing a project: where it
+// is, its config and lock, and the global flags they all honor.
+type project struct {
+	dir       string
+	targetDir string
+	confFile  string
+	trashDir  string
+	keep      bool
+	trashConf *conf.Conf
+	lock      *conf.Lock
+}
+
+func loadProject(c *cli.Context) (*project, error) {
+	dir, confFile, trashDir, trashConf, err := setup(c)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := conf.ParseLock(conf.LockFile(confFile))
+	if err != nil {
+		return nil, err
+	}
+	return &project{
+		dir:       dir,
+		targetDir: c.GlobalString("target"),
+		confFile:  confFile,
+		trashDir:  trashDir,
+		keep:      c.GlobalBool("keep"),
+		trashConf: trashConf,
+		lock:      lock,
+	}, nil
+}
+
+func (p *project) vendorDir() string {
+	return path.Join(p.dir, p.targetDir)
+}
+
+// vendorImport checks out i and replaces its copy in the vendor dir, leaving
+// the other vendored packages alone.
+func (p *project) vendorImport(ctx context.Context, i conf.Import) error {
+	os.MkdirAll(p.trashDir, 0755)
+
+	li, err := resolveImport(ctx, stdLog, p.trashDir, i, p.lock)
+	if err != nil {
+		return err
+	}
+	p.lock.Set(li)
+	if err := widenSparseCheckouts(p.trashDir, p.dir, p.targetDir, p.trashConf); err != nil {
+		return err
+	}
+
+	tx, err := beginVendor(p.vendorDir())
+	if err != nil {
+		return err
+	}
+	defer tx.rollback()
+	if err := tx.copyCurrent(); err != nil {
+		return err
+	}
+	vendorDir := tx.newDir
+	os.RemoveAll(path.Join(vendorDir, i.Package))
+	err = atCommit(ctx, stdLog, p.trashDir, i, li.Commit, func() error {
+		if err := cpy(vendorDir, p.trashDir, i); err != nil {
+			return err
+		}
+		if i.Staging {
+			_, err := copyStaging(p.trashDir, vendorDir, i)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !p.keep {
+		if err := stripVCSDirs(path.Join(vendorDir, i.Package)); err != nil {
+			return err
+		}
+	}
+	if !p.keep {
+		if err := cleanup(p.dir, p.targetDir, vendorDir, p.trashConf, nil); err != nil {
+			return err
+		}
+	}
+	return tx.commit()
+}
+
+// latestVersion checks out the master branch of i and describes it.
+func (p *project) latestVersion(ctx context.Context, i conf.Import) (string, error) {
+	os.MkdirAll(p.trashDir, 0755)
+
+	i.Version = "master"
+	if err := checkoutImport(ctx, stdLog, p.trashDir, i); err != nil {
+		return "", err
+	}
+	return getLatestVersion(filepath.Join(p.trashDir, "src"), i.Package)
+}
+
+// save writes the config, the lock and the manifest, and records the run of
+// command in the history.
+func (p *project) save(command string) error {
+	if err := p.trashConf.Dump(p.confFile); err != nil {
+		return err
+	}
+	if err := p.lock.Dump(conf.LockFile(p.confFile)); err != nil {
+		return err
+	}
+	m, err := p.saveManifest()
+	if err != nil {
+		return err
+	}
+	return recordRun(p.dir, command, p.confFile, p.lock, m)
+}
+
+func (p *project) saveManifest() (manifest, error) {
+	manifestPath := manifestFile(p.confFile)
+	var roots []string
+	if old, err := readManifest(manifestPath); err == nil {
+		roots = old.roots() // keeps the roots copied from staging dirs
+	}
+	for _, i := range p.trashConf.Imports {
+		roots = append(roots, i.Package)
+	}
+	m, err := hashVendor(p.vendorDir(), roots)
+	if err != nil {
+		return nil, err
+	}
+	m.addSigners(p.lock)
+	return m, m.dump(manifestPath)
+}
+
+func parsePackageArg(arg string) (pkg, version string) {
+	if at := strings.LastIndex(arg, "@"); at >= 0 {
+		return strings.Trim(arg[:at], "/"), arg[at+1:]
+	}
+	return strings.Trim(arg, "/"), ""
+}
+
+// addCommand adds a package to the config (or changes its version) and
+// vendors it.
+func addCommand(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.NewExitError("Usage: trash add <package>[@<version>] [--repo <url>]", 1)
+	}
+	p, err := loadProject(c)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	pkg, version := parsePackageArg(c.Args().First())
+	i, ok := p.trashConf.Get(pkg)
+	if !ok {
+		i = conf.Import{Package: pkg}
+	}
+	if c.IsSet("repo") {
+		i.Repo = c.String("repo")
+	}
+	if version == "" {
+		if version, err = p.latestVersion(ctx, i); err != nil {
+			return err
+		}
+	}
+	i.Version = version
+
+	logrus.Infof("Adding '%s' at '%s'", i.Package, i.Version)
+	p.trashConf.Set(i)
+	if err := p.vendorImport(ctx, i); err != nil {
+		return err
+	}
+	return p.save("add")
+}
+
+// removeCommand drops packages from the config, the lock and the vendor dir.
+func removeCommand(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return cli.NewExitError("Usage: trash remove <package>...", 1)
+	}
+	p, err := loadProject(c)
+	if err != nil {
+		return err
+	}
+	tx, err := beginVendor(p.vendorDir())
+	if err != nil {
+		return err
+	}
+	defer tx.rollback()
+	if err := tx.copyCurrent(); err != nil {
+		return err
+	}
+	for _, arg := range c.Args() {
+		pkg, _ := parsePackageArg(arg)
+		if !p.trashConf.Remove(pkg) {
+			return fmt.Errorf("package '%s' is not in %s", pkg, p.confFile)
+		}
+		logrus.Infof("Removing '%s'", pkg)
+		p.lock.Remove(pkg)
+		if err := os.RemoveAll(path.Join(tx.newDir, pkg)); err != nil {
+			return err
+		}
+	}
+	if err := removeEmptyDirs(tx.newDir, nil); err != nil {
+		return err
+	}
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	return p.save("remove")
+}
+
+// updateCommand bumps the named packages, following their update strategies,
+// and vendors them. Without arguments it works like --update: every
+// import is bumped and missing ones are added, in the config and the lock.
+func updateCommand(c *cli.Context) error {
+	p, err := loadProject(c)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if c.NArg() == 0 {
+		return updateTrash(ctx, p.trashDir, p.dir, p.targetDir, p.confFile, p.trashConf)
+	}
+
+	for _, arg := range c.Args() {
+		pkg, _ := parsePackageArg(arg)
+		i, ok := p.trashConf.Get(pkg)
+		if !ok {
+			return fmt.Errorf("package '%s' is not in %s, use `trash add` to add it", pkg, p.confFile)
+		}
+		os.MkdirAll(p.trashDir, 0755)
+		version, err := nextVersion(ctx, p.trashDir, p.trashConf, i)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("Updating '%s': '%s' -> '%s'", i.Package, i.Version, version)
+		i.Version = version
+		p.trashConf.Set(i)
+		p.lock.Remove(i.Package) // constraints are resolved again
+		if err := p.vendorImport(ctx, i); err != nil {
+			return err
+		}
+	}
+	return p.save("update")
+}
+
+// pruneCommand only runs the cleanup on the existing vendor dir.
+func pruneCommand(c *cli.Context) error {
+	p, err := loadProject(c)
+	if err != nil {
+		return err
+	}
+	tx, err := beginVendor(p.vendorDir())
+	if err != nil {
+		return err
+	}
+	defer tx.rollback()
+	if err := tx.copyCurrent(); err != nil {
+		return err
+	}
+	if err := cleanup(p.dir, p.targetDir, tx.newDir, p.trashConf, nil); err != nil {
+		return err
+	}
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	m, err := p.saveManifest()
+	if err != nil {
+		return err
+	}
+	return recordRun(p.dir, "prune", p.confFile, p.lock, m)
+}
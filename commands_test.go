@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mountkin/trash/conf"
+	"github.com/stretchr/testify/require"
+)
+
+// makeProject makes a project in dir/proj importing example.com/foo and
+// example.com/bar, and their upstream repos (see makeUpstream) in dir/foo and
+// dir/bar. Only foo, at v1.0.0, is in its vendor.conf. It returns the project
+// dir and the commits of foo and bar.
+func makeProject(t *testing.T, dir string) (string, []string, []string) {
+	assert := require.New(t)
+	foo, bar := filepath.Join(dir, "foo"), filepath.Join(dir, "bar")
+	fooCommits, barCommits := makeUpstream(t, foo), makeUpstream(t, bar)
+	proj := filepath.Join(dir, "proj")
+	assert.NoError(os.MkdirAll(proj, 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(proj, "main.go"), []byte(`package main
+
+import (
+	_ "example.com/bar"
+	_ "example.com/foo"
+)
+
+func main() {}
+`), 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(proj, "vendor.conf"), []byte("example.com/proj\n\nexample.com/foo v1.0.0 "+foo+"\n"), 0644))
+	return proj, fooCommits, barCommits
+}
+
+// runTrash runs trash with args in the project dir proj, with a cache next
+// to it.
+func runTrash(proj string, args ...string) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	defer os.Chdir(wd)
+	flags := []string{"trash", "--allow-file", "-C", proj, "--cache", filepath.Join(filepath.Dir(proj), "cache")}
+	return newApp().Run(append(flags, args...))
+}
+
+func TestCommands(t *testing.T) {
+	assert := require.New(t)
+	dir, err := ioutil.TempDir("", "trash-commands")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	proj, fooCommits, barCommits := makeProject(t, dir)
+	confFile := filepath.Join(proj, "vendor.conf")
+	vendored := func(pkg string) bool {
+		_, err := os.Stat(filepath.Join(proj, "vendor", pkg, "f.go"))
+		return err == nil
+	}
+	state := func() (*conf.Conf, *conf.Lock) {
+		trashConf, err := conf.Parse(confFile)
+		assert.NoError(err)
+		lock, err := conf.ParseLock(conf.LockFile(confFile))
+		assert.NoError(err)
+		return trashConf, lock
+	}
+
+	assert.NoError(runTrash(proj))
+	assert.True(vendored("example.com/foo"))
+	assert.False(vendored("example.com/bar"))
+
+	// the mode of the vendor dir is kept
+	vendorDir := filepath.Join(proj, "vendor")
+	assert.NoError(os.Chmod(vendorDir, 0700))
+	assert.NoError(runTrash(proj))
+	fi, err := os.Stat(vendorDir)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0700), fi.Mode().Perm())
+
+	assert.NoError(runTrash(proj, "add", "--repo", filepath.Join(dir, "bar"), "example.com/bar@v1.0.0"))
+	trashConf, lock := state()
+	i, ok := trashConf.Get("example.com/bar")
+	assert.True(ok)
+	assert.Equal("v1.0.0", i.Version)
+	assert.Equal(filepath.Join(dir, "bar"), i.Repo)
+	li, ok := lock.Get("example.com/bar")
+	assert.True(ok)
+	assert.Equal(barCommits[0], li.Commit)
+	li, ok = lock.Get("example.com/foo")
+	assert.True(ok)
+	assert.Equal(fooCommits[0], li.Commit)
+	assert.True(vendored("example.com/bar"))
+	assert.True(vendored("example.com/foo"))
+
+	// the packages nothing imports are pruned
+	unused := filepath.Join(proj, "vendor", "example.com", "foo", "unused")
+	assert.NoError(os.MkdirAll(unused, 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(unused, "u.go"), []byte("package unused\n"), 0644))
+	assert.NoError(runTrash(proj, "prune"))
+	assert.False(isDir(unused))
+	assert.True(vendored("example.com/foo"))
+
+	// an update is recorded, and rolled back to the config and lock before
+	read := func(path string) string {
+		b, err := ioutil.ReadFile(path)
+		assert.NoError(err)
+		return string(b)
+	}
+	confBefore, lockBefore := read(confFile), read(conf.LockFile(confFile))
+	assert.NoError(runTrash(proj, "update"))
+	trashConf, lock = state()
+	li, ok = lock.Get("example.com/foo")
+	assert.True(ok)
+	assert.Equal(fooCommits[2], li.Commit)
+	assert.NoError(runTrash(proj, "rollback"))
+	assert.Equal(confBefore, read(confFile))
+	assert.Equal(lockBefore, read(conf.LockFile(confFile)))
+
+	assert.NoError(runTrash(proj, "remove", "example.com/bar"))
+	trashConf, lock = state()
+	_, ok = trashConf.Get("example.com/bar")
+	assert.False(ok)
+	_, ok = lock.Get("example.com/bar")
+	assert.False(ok)
+	assert.False(vendored("example.com/bar"))
+	assert.False(isDir(filepath.Join(proj, "vendor", "example.com", "bar")))
+	assert.True(vendored("example.com/foo"))
+	assert.Error(runTrash(proj, "remove", "example.com/bar"))
+
+	// nothing is removed unless every package is in the config
+	assert.Error(runTrash(proj, "remove", "example.com/foo", "example.com/bar"))
+	assert.True(vendored("example.com/foo"))
+
+	entries, err := readHistory(proj)
+	assert.NoError(err)
+	var commands []string
+	for _, e := range entries {
+		commands = append(commands, e.Command)
+	}
+	assert.Equal([]string{"trash", "trash", "add", "prune", "update", "rollback", "remove"}, commands)
+}
@@ -1,22 +1,30 @@
 package conf
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 
 	"github.com/Sirupsen/logrus"
 	yaml "github.com/cloudfoundry-incubator/candiedyaml"
+	"github.com/mountkin/trash/semver"
 )
 
 type Conf struct {
-	Package     string   `yaml:"package,omitempty"`
-	Imports     []Import `yaml:"import,omitempty"`
-	Excludes    []string `yaml:"exclude,omitempty"`
-	IgnoredTags []string `yaml:"ignored_tags,omitempty"`
-	IgnoredPkgs []string `yaml:"ignored_pkgs,omitempty"`
-	NativeOnly  bool     `yaml:"native_only,omitempty"`
+	Package     string            `yaml:"package,omitempty"`
+	Imports     []Import          `yaml:"import,omitempty"`
+	Excludes    []string          `yaml:"exclude,omitempty"`
+	IgnoredTags []string          `yaml:"ignored_tags,omitempty"`
+	IgnoredPkgs []string          `yaml:"ignored_pkgs,omitempty"`
+	NativeOnly  bool              `yaml:"native_only,omitempty"`
+	Update      string            `yaml:"update,omitempty"`   // Update strategy of the imports which have none
+	Source      string            `yaml:"source,omitempty"`   // Source of the imports which have none
+	Archives    map[string]string `yaml:"archives,omitempty"` // URL templates of the archives of hosts, by host
+	Insecure    []string          `yaml:"insecure,omitempty"` // Hosts that may be asked over plain HTTP
+	Keyring     string            `yaml:"keyring,omitempty"`  // Dir of the keys signed imports may be signed with, relative to the config file
 	importMap   map[string]Import
 	confFile    string
 	yamlType    bool
@@ -26,14 +34,149 @@ type Import struct {
 	Package string `yaml:"package,omitempty"`
 	Version string `yaml:"version,omitempty"`
 	Repo    string `yaml:"repo,omitempty"`
+	VCS     string `yaml:"vcs,omitempty"`    // git, hg, svn or bzr; detected when empty
+	Source  string `yaml:"source,omitempty"` // one of the Source* constants; the global one when empty
 	Options
 }
 
 type Options struct {
-	Transitive bool `yaml:"transitive,omitempty"`
-	Staging    bool `yaml:"staging,omitempty"`
+	Transitive bool   `yaml:"transitive,omitempty"`
+	Staging    bool   `yaml:"staging,omitempty"`
+	Update     string `yaml:"update,omitempty"` // Update strategy, one of the Update* constants
+	Branch     string `yaml:"branch,omitempty"` // Branch tracked by the UpdateBranch strategy
+	Verify     string `yaml:"verify,omitempty"` // VerifySigned to accept signed versions only
 }
 
+// Update strategies: what `trash update` bumps an import to.
+const (
+	UpdateMaster = "master" // latest commit of master, described with `git describe --tags` (the default)
+	UpdateLatest = "latest" // latest semver tag
+	UpdateMinor  = "minor"  // latest semver tag of the current major version
+	UpdatePatch  = "patch"  // latest semver tag of the current minor version
+	UpdateBranch = "branch" // latest commit of Branch (master by default)
+)
+
+func validStrategy(s string) bool {
+	switch s {
+	case "", UpdateMaster, UpdateLatest, UpdateMinor, UpdatePatch, UpdateBranch:
+		return true
+	}
+	return false
+}
+
+// Sources: how the code of an import gets into the cache.
+const (
+	SourceClone   = "clone"   // a clone of its repo (or a download from the --proxy, if any)
+	SourceArchive = "archive" // archives of single commits, downloaded from its host
+)
+
+func validSource(s string) bool {
+	switch s {
+	case "", SourceClone, SourceArchive:
+		return true
+	}
+	return false
+}
+
+// SourceOf returns the source of i: its own, the global one, or else
+// SourceClone.
+func (t *Conf) SourceOf(i Import) string {
+	switch {
+	case i.Source != "":
+		return i.Source
+	case t.Source != "":
+		return t.Source
+	}
+	return SourceClone
+}
+
+// VerifySigned makes trash accept only the versions of an import that are
+// signed (the tag, or else the commit) by a key of the keyring of the config.
+const VerifySigned = "signed"
+
+// VCSs lists the version control systems an import can name in its vcs field.
+var VCSs = []string{"git", "hg", "svn", "bzr"}
+
+func validVCS(s string) bool {
+	if s == "" {
+		return true
+	}
+	for _, v := range VCSs {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Strategy returns the update strategy of i: its own, UpdateBranch if it
+// names a branch, the global one, or else UpdateMaster.
+func (t *Conf) Strategy(i Import) string {
+	switch {
+	case i.Update != "":
+		return i.Update
+	case i.Branch != "":
+		return UpdateBranch
+	case t.Update != "":
+		return t.Update
+	}
+	return UpdateMaster
+}
+
+func (t *Conf) validate() error {
+	if !validStrategy(t.Update) {
+		return fmt.Errorf("%s: invalid update strategy '%s'", t.confFile, t.Update)
+	}
+	if !validSource(t.Source) {
+		return fmt.Errorf("%s: invalid source '%s'", t.confFile, t.Source)
+	}
+	for _, i := range t.Imports {
+		if !validStrategy(i.Update) {
+			return fmt.Errorf("%s: invalid update strategy '%s' for package '%s'", t.confFile, i.Update, i.Package)
+		}
+		if !validVCS(i.VCS) {
+			return fmt.Errorf("%s: invalid vcs '%s' for package '%s'", t.confFile, i.VCS, i.Package)
+		}
+		if !validSource(i.Source) {
+			return fmt.Errorf("%s: invalid source '%s' for package '%s'", t.confFile, i.Source, i.Package)
+		}
+		switch {
+		case i.Verify != "" && i.Verify != VerifySigned:
+			return fmt.Errorf("%s: invalid verify '%s' for package '%s', expected '%s'", t.confFile, i.Verify, i.Package, VerifySigned)
+		case i.Verify == VerifySigned && t.Keyring == "":
+			return fmt.Errorf("%s: package '%s' is to be verified, but there is no keyring", t.confFile, i.Package)
+		}
+		if semver.IsConstraint(i.Version) {
+			if _, err := semver.ParseConstraint(i.Version); err != nil {
+				return fmt.Errorf("%s: package '%s': %s", t.confFile, i.Package, err)
+			}
+		}
+	}
+	return nil
+}
+
+// DefaultFiles lists the config files trash looks for, in order, when none
+// is given explicitly.
+var DefaultFiles = []string{"vendor.conf", "vendor.yaml", "glide.yaml", "glide.yml", "trash.yaml"}
+
+// Find returns the first of DefaultFiles present in dir, or "" if there is
+// none.
+func Find(dir string) string {
+	for _, f := range DefaultFiles {
+		if _, err := os.Stat(filepath.Join(dir, f)); err == nil {
+			return f
+		}
+	}
+	return ""
+}
+
+func isYAML(path string) bool {
+	ext := filepath.Ext(path)
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// Parse reads the config at path. Files with a .yaml or .yml extension are
+// decoded as YAML, anything else as vendor.conf.
 func Parse(path string) (*Conf, error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -41,14 +184,21 @@ func Parse(path string) (*Conf, error) {
 	}
 	defer file.Close()
 
-	trashConf := &Conf{confFile: path}
-	err = yaml.NewDecoder(file).Decode(trashConf)
-	if err != nil {
+	var trashConf *Conf
+	if isYAML(path) {
+		trashConf = &Conf{confFile: path}
+		if err := yaml.NewDecoder(file).Decode(trashConf); err != nil {
+			return nil, err
+		}
+		trashConf.yamlType = true
+	} else if trashConf, err = parseVendorConf(file, path); err != nil {
 		return nil, err
 	}
 
-	trashConf.yamlType = true
 	trashConf.Dedupe()
+	if err := trashConf.validate(); err != nil {
+		return nil, err
+	}
 	if len(trashConf.IgnoredTags) == 0 {
 		trashConf.IgnoredTags = []string{"ignore"}
 	} else {
@@ -96,6 +246,27 @@ func (t *Conf) Dedupe() {
 	t.Imports = imports
 }
 
+// Set adds i to the imports, replacing any import of the same package.
+func (t *Conf) Set(i Import) {
+	t.Remove(i.Package)
+	t.Imports = append(t.Imports, i)
+	t.Dedupe()
+}
+
+// Remove drops the import of pkg. It returns false if there is none.
+func (t *Conf) Remove(pkg string) bool {
+	imports := t.Imports[:0]
+	for _, i := range t.Imports {
+		if i.Package != pkg {
+			imports = append(imports, i)
+		}
+	}
+	removed := len(imports) != len(t.Imports)
+	t.Imports = imports
+	t.Dedupe()
+	return removed
+}
+
 func (t *Conf) Get(pkg string) (Import, bool) {
 	i, ok := t.importMap[pkg]
 	return i, ok
@@ -110,7 +281,12 @@ func (t *Conf) Dump(path string) error {
 	if err != nil {
 		return err
 	}
-	if err := yaml.NewEncoder(fp).Encode(t); err != nil {
+	if isYAML(path) {
+		err = yaml.NewEncoder(fp).Encode(t)
+	} else {
+		err = dumpVendorConf(fp, t)
+	}
+	if err != nil {
 		fp.Close()
 		return err
 	}
@@ -1,6 +1,11 @@
 package conf
 
 import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -11,35 +16,35 @@ func TestDuplicates(t *testing.T) {
 		duplicates int
 	}{
 		{[]Import{
-			{"package1", "version1", ""},
+			{Package: "package1", Version: "version1"},
 		}, 0},
 		{[]Import{
-			{"package1", "version1", ""},
-			{"package2", "version1", "repoA"},
+			{Package: "package1", Version: "version1"},
+			{Package: "package2", Version: "version1", Repo: "repoA"},
 		}, 0},
 		{[]Import{
-			{"package1", "version1", ""},
-			{"package2", "version1", "repoA"},
-			{"package1", "version1", ""},
+			{Package: "package1", Version: "version1"},
+			{Package: "package2", Version: "version1", Repo: "repoA"},
+			{Package: "package1", Version: "version1"},
 		}, 1},
 		{[]Import{
-			{"package1", "version1", ""},
-			{"package2", "version1", "repoA"},
-			{"package1", "version1", ""},
-			{"package1", "version1", ""},
+			{Package: "package1", Version: "version1"},
+			{Package: "package2", Version: "version1", Repo: "repoA"},
+			{Package: "package1", Version: "version1"},
+			{Package: "package1", Version: "version1"},
 		}, 2},
 		{[]Import{
-			{"package1", "version1", ""},
-			{"package2", "version1", "repoA"},
-			{"package1", "version1", ""},
-			{"package1", "version1", ""},
-			{"package2", "version2", "repoB"},
-			{"package3", "version1", "repoA"},
+			{Package: "package1", Version: "version1"},
+			{Package: "package2", Version: "version1", Repo: "repoA"},
+			{Package: "package1", Version: "version1"},
+			{Package: "package1", Version: "version1"},
+			{Package: "package2", Version: "version2", Repo: "repoB"},
+			{Package: "package3", Version: "version1", Repo: "repoA"},
 		}, 3},
 	}
 
 	for i, d := range testData {
-		trash := Conf{"", d.imports, nil, nil, "", false}
+		trash := Conf{Imports: d.imports}
 		trash.Dedupe()
 
 		if d.duplicates != len(d.imports)-len(trash.Imports) {
@@ -49,3 +54,303 @@ func TestDuplicates(t *testing.T) {
 	}
 
 }
+
+func TestParseVendorConf(t *testing.T) {
+	src := `# root package
+github.com/rancher/trash
+
+github.com/Sirupsen/logrus   v0.8.7  https://github.com/imikushin/logrus.git # fork
+github.com/codegangsta/cli   b5232bb
+`
+	trash, err := parseVendorConf(strings.NewReader(src), "vendor.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trash.Package != "github.com/rancher/trash" {
+		t.Errorf("unexpected root package '%s'", trash.Package)
+	}
+	expected := []Import{
+		{Package: "github.com/Sirupsen/logrus", Version: "v0.8.7", Repo: "https://github.com/imikushin/logrus.git"},
+		{Package: "github.com/codegangsta/cli", Version: "b5232bb"},
+	}
+	if len(trash.Imports) != len(expected) {
+		t.Fatalf("expected %d imports, got %d", len(expected), len(trash.Imports))
+	}
+	for i, e := range expected {
+		if trash.Imports[i] != e {
+			t.Errorf("import %d: expected %+v, got %+v", i, e, trash.Imports[i])
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := dumpVendorConf(&buf, trash); err != nil {
+		t.Fatal(err)
+	}
+	again, err := parseVendorConf(&buf, "vendor.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Package != trash.Package || len(again.Imports) != len(trash.Imports) {
+		t.Errorf("dump did not round-trip: %+v", again)
+	}
+}
+
+func TestParseVendorConfErrors(t *testing.T) {
+	testData := []struct {
+		src string
+		err string
+	}{
+		{"github.com/a/b v1 repo extra\n", "vendor.conf:1: too many fields"},
+		{"# comment\ngithub.com/a/b v1\ngithub.com/c/d\n", "vendor.conf:3: version not specified for package 'github.com/c/d'"},
+		{"github.com/my/root\n\ngithub.com/other/root\n", "vendor.conf:3: version not specified"},
+	}
+	for i, d := range testData {
+		_, err := parseVendorConf(strings.NewReader(d.src), "vendor.conf")
+		if err == nil || !strings.HasPrefix(err.Error(), d.err) {
+			t.Errorf("Case %d failed: expected error '%s', got '%v'", i, d.err, err)
+		}
+	}
+}
+
+func TestLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trash-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lockFile := LockFile(filepath.Join(dir, "vendor.conf"))
+	lock, err := ParseLock(lockFile)
+	if err != nil || len(lock.Imports) != 0 {
+		t.Fatalf("missing lock file should parse as empty: %v, %+v", err, lock)
+	}
+
+	lock.Set(LockedImport{Package: "github.com/b/b", Version: "v1.0.0", Commit: "bbb", Repo: "https://github.com/b/b"})
+	lock.Set(LockedImport{Package: "github.com/a/a", Version: "master", Commit: "aaa", Repo: "https://github.com/a/a"})
+	lock.Set(LockedImport{Package: "github.com/b/b", Version: "v1.0.1", Commit: "ccc", Repo: "https://github.com/b/b"})
+	if err := lock.Dump(lockFile); err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err = ParseLock(lockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lock.Imports) != 2 || lock.Imports[0].Package != "github.com/a/a" {
+		t.Fatalf("unexpected lock: %+v", lock)
+	}
+	li, ok := lock.Get("github.com/b/b")
+	if !ok || li.Commit != "ccc" {
+		t.Fatalf("unexpected entry: %+v", li)
+	}
+	if !li.Matches(Import{Package: "github.com/b/b", Version: "v1.0.1"}) {
+		t.Error("entry should match an import without repo")
+	}
+	if li.Matches(Import{Package: "github.com/b/b", Version: "v1.0.2"}) {
+		t.Error("entry should not match a changed version")
+	}
+	if li.Matches(Import{Package: "github.com/b/b", Version: "v1.0.1", Repo: "https://github.com/fork/b"}) {
+		t.Error("entry should not match a changed repo")
+	}
+}
+
+func TestSetRemove(t *testing.T) {
+	trash := Conf{Imports: []Import{
+		{Package: "package2", Version: "version1"},
+		{Package: "package1", Version: "version1"},
+	}}
+	trash.Dedupe()
+
+	trash.Set(Import{Package: "package1", Version: "version2", Repo: "repoA"})
+	trash.Set(Import{Package: "package0", Version: "version1"})
+	if len(trash.Imports) != 3 || trash.Imports[0].Package != "package0" {
+		t.Fatalf("unexpected imports after Set: %+v", trash.Imports)
+	}
+	if i, _ := trash.Get("package1"); i.Version != "version2" || i.Repo != "repoA" {
+		t.Errorf("Set did not replace the import: %+v", i)
+	}
+
+	if !trash.Remove("package2") {
+		t.Error("Remove should report an existing package as removed")
+	}
+	if trash.Remove("package2") {
+		t.Error("Remove should not report a missing package as removed")
+	}
+	if _, ok := trash.Get("package2"); ok || len(trash.Imports) != 2 {
+		t.Errorf("unexpected imports after Remove: %+v", trash.Imports)
+	}
+}
+
+func TestStrategy(t *testing.T) {
+	trash := Conf{Imports: []Import{
+		{Package: "package1", Version: "v1.0.0"},
+		{Package: "package2", Version: "v1.0.0", Options: Options{Update: UpdatePatch}},
+		{Package: "package3", Version: "abc1234", Options: Options{Branch: "release-1.0"}},
+		{Package: "package4", Version: "^1.2"},
+	}}
+	if s := trash.Strategy(trash.Imports[0]); s != UpdateMaster {
+		t.Errorf("expected default strategy, got '%s'", s)
+	}
+	trash.Update = UpdateLatest
+	expected := []string{UpdateLatest, UpdatePatch, UpdateBranch, UpdateLatest}
+	for k, i := range trash.Imports {
+		if s := trash.Strategy(i); s != expected[k] {
+			t.Errorf("import %d: expected strategy '%s', got '%s'", k, expected[k], s)
+		}
+	}
+	if err := trash.validate(); err != nil {
+		t.Error(err)
+	}
+
+	trash.Imports[0].Update = "sometimes"
+	if err := trash.validate(); err == nil {
+		t.Error("expected an error for an invalid strategy")
+	}
+	trash.Imports[0].Update = ""
+	trash.Imports[3].Version = "^1.x"
+	if err := trash.validate(); err == nil {
+		t.Error("expected an error for an invalid constraint")
+	}
+	trash.Imports[3].Version = "^1.2"
+	trash.Imports[1].VCS = "cvs"
+	if err := trash.validate(); err == nil {
+		t.Error("expected an error for an invalid vcs")
+	}
+	trash.Imports[1].VCS = "hg"
+	if err := trash.validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSource(t *testing.T) {
+	trash := Conf{Imports: []Import{
+		{Package: "package1", Version: "v1.0.0"},
+		{Package: "package2", Version: "v1.0.0", Source: SourceClone},
+	}}
+	if s := trash.SourceOf(trash.Imports[0]); s != SourceClone {
+		t.Errorf("expected default source, got '%s'", s)
+	}
+	trash.Source = SourceArchive
+	expected := []string{SourceArchive, SourceClone}
+	for k, i := range trash.Imports {
+		if s := trash.SourceOf(i); s != expected[k] {
+			t.Errorf("import %d: expected source '%s', got '%s'", k, expected[k], s)
+		}
+	}
+	if err := trash.validate(); err != nil {
+		t.Error(err)
+	}
+	trash.Imports[1].Source = "tarball"
+	if err := trash.validate(); err == nil {
+		t.Error("expected an error for an invalid source")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	trash := Conf{Imports: []Import{
+		{Package: "package1", Version: "v1.0.0", Options: Options{Verify: VerifySigned}},
+	}}
+	if err := trash.validate(); err == nil {
+		t.Error("expected an error for a signed import without a keyring")
+	}
+	trash.Keyring = "keys"
+	if err := trash.validate(); err != nil {
+		t.Error(err)
+	}
+	trash.Imports[0].Verify = "gpg"
+	if err := trash.validate(); err == nil {
+		t.Error("expected an error for an invalid verify")
+	}
+}
+
+func TestReadPins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trash-pins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"Gopkg.lock": `# This file is autogenerated, do not edit; changes may be undone by the next 'dep ensure'.
+
+[[projects]]
+  name = "github.com/pkg/errors"
+  packages = [
+    ".",
+    "sub"
+  ]
+  revision = "645ef00459ed84a119197bfb8d8205042c6df63d"
+  version = "v0.8.0"
+
+[[projects]]
+  name = "gopkg.in/yaml.v2"
+  packages = ["."]
+  source = "https://github.com/go-yaml/yaml.git"
+  version = "v2.2.1"
+
+[solve-meta]
+  inputs-digest = "abc"
+`,
+		"go.mod": `module example.com/dep
+
+require (
+	github.com/pkg/errors v0.9.1 // indirect
+	golang.org/x/sys v0.0.0-20190412213103-97732733099d
+	github.com/old/thing v2.0.0+incompatible
+)
+
+require github.com/single/line v1.1.0
+`,
+		"Godeps/Godeps.json": `{
+	"ImportPath": "example.com/dep",
+	"Deps": [
+		{"ImportPath": "github.com/godeps/lib/sub1", "Rev": "aaa"},
+		{"ImportPath": "github.com/godeps/lib/sub2", "Rev": "aaa"}
+	]
+}`,
+		"glide.lock":         "imports: [",
+		"vendor/vendor.json": "{",
+		"vendor/modules.txt": `# github.com/vendored/mod v1.0.0
+## explicit
+github.com/vendored/mod
+# github.com/replaced/mod v1.0.0 => ../mod
+# github.com/replaced/mod => ../mod
+`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the broken manifests are skipped
+	pins := ReadPins(dir)
+	expected := map[string]Pin{
+		"github.com/pkg/errors":   {Version: "645ef00459ed84a119197bfb8d8205042c6df63d", Source: "Gopkg.lock"},
+		"gopkg.in/yaml.v2":        {Version: "v2.2.1", Repo: "https://github.com/go-yaml/yaml.git", Source: "Gopkg.lock"},
+		"github.com/godeps/lib":   {Version: "aaa", Source: "Godeps/Godeps.json"},
+		"golang.org/x/sys":        {Version: "97732733099d", Source: "go.mod"},
+		"github.com/old/thing":    {Version: "v2.0.0", Source: "go.mod"},
+		"github.com/single/line":  {Version: "v1.1.0", Source: "go.mod"},
+		"github.com/vendored/mod": {Version: "v1.0.0", Source: "vendor/modules.txt"},
+		"github.com/replaced/mod": {Version: "v1.0.0", Source: "vendor/modules.txt"},
+	}
+	if len(pins) != len(expected) {
+		t.Fatalf("expected %d pins, got %d: %v", len(expected), len(pins), pins)
+	}
+	for _, p := range pins {
+		e, ok := expected[p.Package]
+		if !ok {
+			t.Errorf("unexpected pin %v", p)
+			continue
+		}
+		e.Package = p.Package
+		if p != e {
+			t.Errorf("expected %v, got %v", e, p)
+		}
+	}
+}
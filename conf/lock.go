@@ -0,0 +1,111 @@
+package conf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	yaml "github.com/cloudfoundry-incubator/candiedyaml"
+)
+
+// LockFileName is the name of the lock file, kept beside the config file.
+const LockFileName = "vendor.lock"
+
+// Lock records what every import of a Conf resolved to in the last run.
+type Lock struct {
+	Imports []LockedImport `yaml:"import,omitempty"`
+}
+
+// LockedImport is an Import pinned to a full commit.
+type LockedImport struct {
+	Package string `yaml:"package"`
+	Version string `yaml:"version"` // Version of the Import the commit was resolved from
+	Commit  string `yaml:"commit"`
+	Repo    string `yaml:"repo"`             // URL of the remote the commit was fetched from
+	Date    string `yaml:"date"`             // Commit date, RFC 3339
+	Signed  string `yaml:"signed,omitempty"` // What was verified for verify: signed, "tag <name>" or "commit"
+	Signer  string `yaml:"signer,omitempty"` // Key that signed it: gpg:<fingerprint> or ssh:<fingerprint>
+}
+
+// LockFile returns the path of the lock file belonging to confFile.
+func LockFile(confFile string) string {
+	return filepath.Join(filepath.Dir(confFile), LockFileName)
+}
+
+// ParseLock reads the lock file at path. A missing file yields an empty Lock.
+func ParseLock(path string) (*Lock, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return &Lock{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lock := &Lock{}
+	if err := yaml.NewDecoder(file).Decode(lock); err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// Get returns the locked entry for pkg.
+func (l *Lock) Get(pkg string) (LockedImport, bool) {
+	for _, li := range l.Imports {
+		if li.Package == pkg {
+			return li, true
+		}
+	}
+	return LockedImport{}, false
+}
+
+// Matches tells whether the locked entry was resolved from i as it is
+// configured now. A stale entry must be resolved again.
+func (li LockedImport) Matches(i Import) bool {
+	return li.Package == i.Package && li.Version == i.Version && (i.Repo == "" || i.Repo == li.Repo)
+}
+
+// Set adds li to the lock, replacing any entry for the same package.
+func (l *Lock) Set(li LockedImport) {
+	for k := range l.Imports {
+		if l.Imports[k].Package == li.Package {
+			l.Imports[k] = li
+			return
+		}
+	}
+	l.Imports = append(l.Imports, li)
+}
+
+// Remove drops the entry for pkg.
+func (l *Lock) Remove(pkg string) {
+	imports := l.Imports[:0]
+	for _, li := range l.Imports {
+		if li.Package != pkg {
+			imports = append(imports, li)
+		}
+	}
+	l.Imports = imports
+}
+
+func (l *Lock) Dump(path string) error {
+	sort.Sort(byPackage(l.Imports))
+	fp, err := ioutil.TempFile(filepath.Dir(path), ".vendor.lock")
+	if err != nil {
+		return err
+	}
+	if err := yaml.NewEncoder(fp).Encode(l); err != nil {
+		fp.Close()
+		os.Remove(fp.Name())
+		return err
+	}
+	fp.Close()
+	return os.Rename(fp.Name(), path)
+}
+
+type byPackage []LockedImport
+
+func (s byPackage) Len() int           { return len(s) }
+func (s byPackage) Less(i, j int) bool { return s[i].Package < s[j].Package }
+func (s byPackage) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,330 @@
+package conf
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	yaml "github.com/cloudfoundry-incubator/candiedyaml"
+	"github.com/mountkin/trash/semver"
+)
+
+// Pin is a version of a package wanted by a dependency, as found in one of
+// its manifests.
+type Pin struct {
+	Package string
+	Version string
+	Repo    string
+	Source  string // manifest the pin comes from, relative to the dependency dir
+}
+
+// pinReaders read the manifests of the package managers trash knows about,
+// most precise (lock files) first.
+var pinReaders = []struct {
+	file string
+	read func(path string) ([]Pin, error)
+}{
+	{LockFileName, readLockPins},
+	{"Gopkg.lock", readGopkgLock},
+	{"glide.lock", readGlideLock},
+	{"Godeps/Godeps.json", readGodeps},
+	{"go.mod", readGoMod},
+	{"vendor.conf", readConfPins},
+	{"vendor.yaml", readConfPins},
+	{"trash.yaml", readConfPins},
+	{"glide.yaml", readConfPins},
+	{"glide.yml", readConfPins},
+	{"vendor/modules.txt", readModulesTxt},
+	{"vendor/vendor.json", readVendorJSON},
+}
+
+// ReadPins collects the versions a dependency checked out in dir pins for
+// its own dependencies, from every manifest found there. When several
+// manifests pin the same package, the most precise one wins. The manifests
+// that cannot be parsed are skipped with a warning: a broken dependency must
+// not keep the project from being vendored.
+func ReadPins(dir string) []Pin {
+	seen := map[string]bool{}
+	var r []Pin
+	for _, pr := range pinReaders {
+		path := filepath.Join(dir, filepath.FromSlash(pr.file))
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		pins, err := pr.read(path)
+		if err != nil {
+			logrus.Warnf("Ignoring '%s': %s", path, err)
+			continue
+		}
+		for _, p := range collapsePins(pins) {
+			if p.Package == "" || p.Version == "" || seen[p.Package] {
+				continue
+			}
+			seen[p.Package] = true
+			p.Source = pr.file
+			r = append(r, p)
+		}
+	}
+	return r
+}
+
+// collapsePins maps the packages of pins to their repo roots (where they
+// can be told) and drops the pins of subpackages of other pinned packages.
+func collapsePins(pins []Pin) []Pin {
+	for k := range pins {
+		pins[k].Package = RepoRoot(pins[k].Package)
+	}
+	sort.Sort(byPinPackage(pins))
+	var r []Pin
+	for _, p := range pins {
+		if len(r) > 0 {
+			last := r[len(r)-1].Package
+			if p.Package == last || strings.HasPrefix(p.Package, last+"/") {
+				continue
+			}
+		}
+		r = append(r, p)
+	}
+	return r
+}
+
+// RepoRoot guesses the repo root of pkg for the hosts with a fixed layout.
+func RepoRoot(pkg string) string {
+	parts := strings.Split(pkg, "/")
+	n := 0
+	switch parts[0] {
+	case "github.com", "bitbucket.org", "gitlab.com", "golang.org", "launchpad.net":
+		n = 3
+	case "gopkg.in":
+		n = 2
+		if len(parts) > 2 && !strings.Contains(parts[1], ".v") {
+			n = 3
+		}
+	}
+	if n > 0 && len(parts) > n {
+		return strings.Join(parts[:n], "/")
+	}
+	return pkg
+}
+
+type byPinPackage []Pin
+
+func (s byPinPackage) Len() int           { return len(s) }
+func (s byPinPackage) Less(i, j int) bool { return s[i].Package < s[j].Package }
+func (s byPinPackage) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func readLockPins(path string) ([]Pin, error) {
+	lock, err := ParseLock(path)
+	if err != nil {
+		return nil, err
+	}
+	var r []Pin
+	for _, li := range lock.Imports {
+		r = append(r, Pin{Package: li.Package, Version: li.Commit, Repo: li.Repo})
+	}
+	return r, nil
+}
+
+func readConfPins(path string) ([]Pin, error) {
+	trashConf, err := Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	var r []Pin
+	for _, i := range trashConf.Imports {
+		r = append(r, Pin{Package: i.Package, Version: i.Version, Repo: i.Repo})
+	}
+	return r, nil
+}
+
+func readGlideLock(path string) ([]Pin, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lock := struct {
+		Imports []struct {
+			Name    string `yaml:"name"`
+			Version string `yaml:"version"`
+			Repo    string `yaml:"repo"`
+		} `yaml:"imports"`
+	}{}
+	if err := yaml.NewDecoder(file).Decode(&lock); err != nil {
+		return nil, err
+	}
+	var r []Pin
+	for _, i := range lock.Imports {
+		r = append(r, Pin{Package: i.Name, Version: i.Version, Repo: i.Repo})
+	}
+	return r, nil
+}
+
+func readGodeps(path string) ([]Pin, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	godeps := struct {
+		Deps []struct {
+			ImportPath string
+			Rev        string
+		}
+	}{}
+	if err := json.NewDecoder(file).Decode(&godeps); err != nil {
+		return nil, err
+	}
+	var r []Pin
+	for _, d := range godeps.Deps {
+		r = append(r, Pin{Package: d.ImportPath, Version: d.Rev})
+	}
+	return r, nil
+}
+
+func readVendorJSON(path string) ([]Pin, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	govendor := struct {
+		Package []struct {
+			Path     string `json:"path"`
+			Revision string `json:"revision"`
+		} `json:"package"`
+	}{}
+	if err := json.NewDecoder(file).Decode(&govendor); err != nil {
+		return nil, err
+	}
+	var r []Pin
+	for _, p := range govendor.Package {
+		r = append(r, Pin{Package: p.Path, Version: p.Revision})
+	}
+	return r, nil
+}
+
+// readGopkgLock reads the [[projects]] of a dep lock file. It understands
+// just enough TOML for that.
+func readGopkgLock(path string) ([]Pin, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var r []Pin
+	var project map[string]string
+	flush := func() {
+		if project == nil {
+			return
+		}
+		version := project["revision"]
+		if version == "" {
+			version = project["version"]
+		}
+		r = append(r, Pin{Package: project["name"], Version: version, Repo: project["source"]})
+		project = nil
+	}
+	inArray := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case inArray:
+			inArray = !strings.HasSuffix(line, "]")
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "["):
+			flush()
+			if line == "[[projects]]" {
+				project = map[string]string{}
+			}
+		case project != nil:
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			value := strings.TrimSpace(kv[1])
+			if strings.HasPrefix(value, "[") {
+				inArray = !strings.HasSuffix(value, "]")
+				continue
+			}
+			project[strings.TrimSpace(kv[0])] = strings.Trim(value, `"`)
+		}
+	}
+	flush()
+	return r, scanner.Err()
+}
+
+// moduleVersion turns a module version into a git ref: pseudo-versions map
+// to their commit, and +incompatible is dropped.
+func moduleVersion(v string) string {
+	if c, ok := semver.PseudoCommit(v); ok {
+		return c
+	}
+	return strings.TrimSuffix(v, "+incompatible")
+}
+
+// readGoMod reads the require directives of a go.mod file.
+func readGoMod(path string) ([]Pin, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var r []Pin
+	inRequire := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if comment := strings.Index(line, "//"); comment >= 0 {
+			line = line[:comment]
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+			continue
+		case inRequire && fields[0] == ")":
+			inRequire = false
+			continue
+		case fields[0] == "require" && len(fields) == 2 && fields[1] == "(":
+			inRequire = true
+			continue
+		case fields[0] == "require":
+			fields = fields[1:]
+		case !inRequire:
+			continue
+		}
+		if len(fields) >= 2 {
+			r = append(r, Pin{Package: fields[0], Version: moduleVersion(fields[1])})
+		}
+	}
+	return r, scanner.Err()
+}
+
+// readModulesTxt reads the modules listed in vendor/modules.txt.
+func readModulesTxt(path string) ([]Pin, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var r []Pin
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 3 && fields[0] == "#" && fields[2] != "=>" {
+			r = append(r, Pin{Package: fields[1], Version: moduleVersion(fields[2])})
+		}
+	}
+	return r, scanner.Err()
+}
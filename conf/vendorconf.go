@@ -0,0 +1,67 @@
+package conf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// parseVendorConf reads the line based vendor.conf format:
+//
+//	# comments start with '#' and run to the end of the line
+//	github.com/my/project                          (root package, optional, first entry only)
+//	github.com/Sirupsen/logrus  v0.8.7  https://github.com/imikushin/logrus.git
+//	github.com/urfave/cli       b5232bb
+//
+// Every import line is `package version [repo]`.
+func parseVendorConf(r io.Reader, path string) (*Conf, error) {
+	trashConf := &Conf{confFile: path}
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if commentStart := strings.Index(line, "#"); commentStart >= 0 {
+			line = line[:commentStart]
+		}
+		fields := strings.Fields(line)
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+			if trashConf.Package != "" || len(trashConf.Imports) > 0 {
+				return nil, fmt.Errorf("%s:%d: version not specified for package '%s'", path, lineNo, fields[0])
+			}
+			trashConf.Package = fields[0]
+		case 2, 3:
+			i := Import{Package: fields[0], Version: fields[1]}
+			if len(fields) == 3 {
+				i.Repo = fields[2]
+			}
+			trashConf.Imports = append(trashConf.Imports, i)
+		default:
+			return nil, fmt.Errorf("%s:%d: too many fields, expected `package version [repo]`", path, lineNo)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return trashConf, nil
+}
+
+// dumpVendorConf writes t in the vendor.conf format. Settings that only
+// exist in the YAML format (excludes, ignored tags, import options) are not
+// representable there and are left out.
+func dumpVendorConf(w io.Writer, t *Conf) error {
+	bw := bufio.NewWriter(w)
+	if t.Package != "" {
+		fmt.Fprintf(bw, "%s\n\n", t.Package)
+	}
+	for _, i := range t.Imports {
+		if i.Repo != "" {
+			fmt.Fprintf(bw, "%s\t%s\t%s\n", i.Package, i.Version, i.Repo)
+		} else {
+			fmt.Fprintf(bw, "%s\t%s\n", i.Package, i.Version)
+		}
+	}
+	return bw.Flush()
+}
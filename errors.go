@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/mountkin/trash/conf"
+)
+
+// cmdError is a failed command, along with what it printed.
+type cmdError struct {
+	args []string
+	dir  string
+	out  []byte
+	err  error
+}
+
+func (e *cmdError) Error() string {
+	s := fmt.Sprintf("`%s` failed", strings.Join(e.args, " "))
+	if e.dir != "" {
+		s += fmt.Sprintf(" in '%s'", e.dir)
+	}
+	s += ": " + e.err.Error()
+	if out := bytes.TrimSpace(e.out); len(out) > 0 {
+		s += "\n" + string(out)
+	}
+	return s
+}
+
+// combinedOutput runs cmd and returns its output, or a cmdError.
+func combinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := runCommand(cmd); err != nil {
+		return out.Bytes(), &cmdError{cmd.Args, cmd.Dir, out.Bytes(), err}
+	}
+	return out.Bytes(), nil
+}
+
+// output runs cmd and returns its standard output, or a cmdError with its
+// standard error.
+func output(cmd *exec.Cmd) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := runCommand(cmd); err != nil {
+		return stdout.Bytes(), &cmdError{cmd.Args, cmd.Dir, stderr.Bytes(), err}
+	}
+	return stdout.Bytes(), nil
+}
+
+// importError is a failure to fetch or check out an import.
+type importError struct {
+	i   conf.Import
+	err error
+}
+
+func (e *importError) Error() string {
+	repo := e.i.Repo
+	if repo == "" {
+		repo = "repo from the import path"
+	}
+	return fmt.Sprintf("'%s' at '%s' (%s): %s", e.i.Package, e.i.Version, repo, e.err)
+}
+
+// failures are the errors of several imports. They are collected while the
+// other imports go on, to be reported all at once.
+type failures []error
+
+// collect returns the errors among errs (nested failures flattened), or nil
+// if there are none.
+func collect(errs []error) error {
+	var f failures
+	for _, err := range errs {
+		switch err := err.(type) {
+		case nil:
+		case failures:
+			f = append(f, err...)
+		default:
+			f = append(f, err)
+		}
+	}
+	if len(f) == 0 {
+		return nil
+	}
+	return f
+}
+
+func (f failures) Error() string {
+	if len(f) == 1 {
+		return f[0].Error()
+	}
+	var s []string
+	for _, err := range f {
+		s = append(s, err.Error())
+	}
+	return fmt.Sprintf("%d imports failed: %s", len(f), strings.Join(s, "; "))
+}
+
+// print writes a summary of the failures to w, one paragraph each.
+func (f failures) print(w io.Writer) {
+	fmt.Fprintf(w, "\n%d import(s) failed:\n", len(f))
+	for _, err := range f {
+		lines := strings.Split(err.Error(), "\n")
+		fmt.Fprintf(w, "\n  - %s\n", lines[0])
+		for _, l := range lines[1:] {
+			fmt.Fprintf(w, "      %s\n", l)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/mountkin/trash/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCmdError(t *testing.T) {
+	assert := require.New(t)
+	cmd := exec.Command("sh", "-c", "echo out; echo oops >&2; exit 3")
+	cmd.Dir = "/"
+	out, err := output(cmd)
+	assert.Equal("out\n", string(out))
+	assert.Equal("`sh -c echo out; echo oops >&2; exit 3` failed in '/': exit status 3\noops", err.Error())
+
+	_, err = combinedOutput(exec.Command("sh", "-c", "echo out; echo oops >&2; exit 3"))
+	assert.Equal("`sh -c echo out; echo oops >&2; exit 3` failed: exit status 3\nout\noops", err.Error())
+
+	_, err = combinedOutput(exec.Command("true"))
+	assert.NoError(err)
+}
+
+func TestFailures(t *testing.T) {
+	assert := require.New(t)
+	assert.NoError(collect([]error{nil, nil}))
+
+	e1 := &importError{conf.Import{Package: "example.com/a", Version: "v1.0.0", Repo: "https://example.com/a.git"}, errors.New("could not fetch:\nfatal: no such repo")}
+	e2 := &importError{conf.Import{Package: "example.com/b", Version: "master"}, errors.New("boom")}
+	e3 := errors.New("other")
+	err := collect([]error{e1, nil, collect([]error{e2, e3})})
+	f, ok := err.(failures)
+	assert.True(ok)
+	assert.Len(f, 3)
+	assert.Equal("'example.com/b' at 'master' (repo from the import path): boom", f[1].Error())
+
+	buf := &bytes.Buffer{}
+	f.print(buf)
+	assert.Equal(strings.Join([]string{
+		"",
+		"3 import(s) failed:",
+		"",
+		"  - 'example.com/a' at 'v1.0.0' (https://example.com/a.git): could not fetch:",
+		"      fatal: no such repo",
+		"",
+		"  - 'example.com/b' at 'master' (repo from the import path): boom",
+		"",
+		"  - other",
+		"",
+	}, "\n"), buf.String())
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mountkin/trash/conf"
+)
+
+// lockTimeout is how long trash waits for a repo of the cache another run
+// holds the lock of (--lock-timeout).
+var lockTimeout = 10 * time.Minute
+
+// lockPoll is how often a lock held by another run is tried again.
+var lockPoll = 100 * time.Millisecond
+
+// repoLock is an advisory lock (flock) on a repo of the cache. Runs sharing
+// the cache hold it while they clone, fetch, check out or copy the repo, so
+// that none of them copies a commit another one is checking out. The lock
+// file, under <cache>/locks, holds the pid of the run holding it.
+type repoLock struct {
+	f  *os.File
+	mu *sync.Mutex
+}
+
+// repoMutexes keep the jobs of a run from waiting for each other's flocks.
+var repoMutexes = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: map[string]*sync.Mutex{}}
+
+// lockKey names the lock of the repo pkg is in: its root, for the hosts
+// conf.RepoRoot knows, or else its first two elements, which all the
+// packages of a repo share unless the repo is a whole host.
+func lockKey(pkg string) string {
+	pkg = strings.Trim(pkg, "/")
+	if root := conf.RepoRoot(pkg); root != pkg {
+		return root
+	}
+	parts := strings.Split(pkg, "/")
+	switch parts[0] {
+	case "github.com", "bitbucket.org", "gitlab.com", "golang.org", "launchpad.net", "gopkg.in":
+		return pkg // a repo root already
+	}
+	if len(parts) > 2 {
+		parts = parts[:2]
+	}
+	return strings.Join(parts, "/")
+}
+
+// lockRepo takes the lock of the repo of pkg in trashDir, waiting at most
+// lockTimeout for another run to release it.
+func lockRepo(trashDir, pkg string) (*repoLock, error) {
+	key := lockKey(pkg)
+	repoMutexes.Lock()
+	mu, ok := repoMutexes.m[key]
+	if !ok {
+		mu = &sync.Mutex{}
+		repoMutexes.m[key] = mu
+	}
+	repoMutexes.Unlock()
+	mu.Lock()
+
+	path := filepath.Join(trashDir, "locks", filepath.FromSlash(key)+".lock")
+	f, err := openLockFile(path)
+	if err != nil {
+		mu.Unlock()
+		return nil, fmt.Errorf("could not open the lock of '%s': %s", key, err)
+	}
+	deadline := time.Now().Add(lockTimeout)
+	logged := false
+	for tries := 0; ; tries++ {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			mu.Unlock()
+			return nil, fmt.Errorf("could not lock '%s': %s", path, err)
+		}
+		// the holder writes its pid right after it takes the lock
+		holder := lockHolder(path)
+		if !logged && (holder != "unknown" || tries > 0) {
+			logrus.Infof("Waiting for the lock of '%s' held by pid %s", key, holder)
+			logged = true
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			mu.Unlock()
+			return nil, fmt.Errorf("timed out after %s waiting for the lock of '%s' held by pid %s (see --lock-timeout)", lockTimeout, key, holder)
+		}
+		time.Sleep(lockPoll)
+	}
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &repoLock{f: f, mu: mu}, nil
+}
+
+func openLockFile(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+}
+
+// lockHolder returns the pid written in the lock file at path.
+func lockHolder(path string) string {
+	b, err := ioutil.ReadFile(path)
+	if pid := strings.TrimSpace(string(b)); err == nil && pid != "" {
+		return pid
+	}
+	return "unknown"
+}
+
+func (l *repoLock) unlock() {
+	syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+	l.f.Close()
+	l.mu.Unlock()
+}
+
+// withRepoLock runs f holding the lock of the repo of pkg.
+func withRepoLock(trashDir, pkg string, f func() error) error {
+	l, err := lockRepo(trashDir, pkg)
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+	return f()
+}
+
+// atCommit runs f holding the lock of the repo of i, with commit checked out:
+// another run sharing the cache may have checked out another one since i was
+// resolved, in which case commit is checked out again, or changed its sparse
+// checkout, which is restored. The repo is marked as used if f succeeds.
+func atCommit(ctx context.Context, log *logrus.Entry, trashDir string, i conf.Import, commit string, f func() error) error {
+	return withRepoLock(trashDir, i.Package, func() error {
+		v, repoDir, err := repoOf(trashDir, i)
+		if err != nil {
+			return err
+		}
+		if current, _, err := v.Current(repoDir); commit != "" && (err != nil || current != commit) {
+			log.Infof("Checking out '%s', commit: '%s' again: another run checked out another one", i.Package, commit)
+			if err := v.Checkout(ctx, log, repoDir, i.Repo, commit); err != nil {
+				return err
+			}
+		}
+		if v.Name() == (gitVCS{}).Name() {
+			if err := restoreSparseCheckout(repoDir); err != nil {
+				return err
+			}
+		}
+		if err := f(); err != nil {
+			return err
+		}
+		markUsed(trashDir, repoDir)
+		return nil
+	})
+}
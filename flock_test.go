@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockKey(t *testing.T) {
+	assert := require.New(t)
+	testData := []struct {
+		pkg, key string
+	}{
+		{"github.com/urfave/cli", "github.com/urfave/cli"},
+		{"github.com/urfave/cli/altsrc", "github.com/urfave/cli"},
+		{"gopkg.in/yaml.v2", "gopkg.in/yaml.v2"},
+		{"k8s.io/apimachinery/pkg/util", "k8s.io/apimachinery"},
+		{"k8s.io/apimachinery", "k8s.io/apimachinery"},
+		{"example.com", "example.com"},
+	}
+	for _, d := range testData {
+		assert.Equal(d.key, lockKey(d.pkg), d.pkg)
+	}
+}
+
+// TestLockHelper holds the lock of TRASH_LOCK_PKG in TRASH_LOCK_DIR until its
+// stdin is closed, for TestRepoLock to wait for another process.
+func TestLockHelper(t *testing.T) {
+	if os.Getenv("TRASH_LOCK_DIR") == "" {
+		return
+	}
+	l, err := lockRepo(os.Getenv("TRASH_LOCK_DIR"), os.Getenv("TRASH_LOCK_PKG"))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("locked")
+	ioutil.ReadAll(os.Stdin)
+	l.unlock()
+	os.Exit(0)
+}
+
+func TestRepoLock(t *testing.T) {
+	assert := require.New(t)
+	dir, err := ioutil.TempDir("", "trash-flock")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	defer func(d time.Duration) { lockTimeout = d }(lockTimeout)
+	out := &bytes.Buffer{}
+	defer logrus.SetOutput(logrus.StandardLogger().Out)
+	logrus.SetOutput(out)
+
+	// the jobs of a run wait for each other
+	l, err := lockRepo(dir, "example.com/foo/bar")
+	assert.NoError(err)
+	done := make(chan struct{})
+	go func() {
+		assert.NoError(withRepoLock(dir, "example.com/foo", func() error { return nil }))
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("the lock was taken twice")
+	case <-time.After(200 * time.Millisecond):
+	}
+	l.unlock()
+	<-done
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLockHelper$")
+	cmd.Env = append(os.Environ(), "TRASH_LOCK_DIR="+dir, "TRASH_LOCK_PKG=example.com/foo/baz")
+	stdin, err := cmd.StdinPipe()
+	assert.NoError(err)
+	stdout, err := cmd.StdoutPipe()
+	assert.NoError(err)
+	assert.NoError(cmd.Start())
+	defer cmd.Process.Kill()
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	assert.NoError(err)
+	assert.Equal("locked\n", line)
+
+	lockTimeout = 300 * time.Millisecond
+	pid := fmt.Sprint(cmd.Process.Pid)
+	_, err = lockRepo(dir, "example.com/foo")
+	assert.Error(err)
+	assert.Contains(err.Error(), "held by pid "+pid)
+	assert.Contains(out.String(), "Waiting for the lock of 'example.com/foo' held by pid "+pid)
+
+	// other repos are not locked
+	assert.NoError(withRepoLock(dir, "example.com/other", func() error { return nil }))
+
+	lockTimeout = 10 * time.Second
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		stdin.Close()
+	}()
+	l, err = lockRepo(dir, "example.com/foo")
+	assert.NoError(err)
+	b, err := ioutil.ReadFile(dir + "/locks/example.com/foo.lock")
+	assert.NoError(err)
+	assert.Equal(fmt.Sprint(os.Getpid()), strings.TrimSpace(string(b)))
+	l.unlock()
+	assert.NoError(cmd.Wait())
+}
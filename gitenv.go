@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// The repos of dependencies are not to be trusted: git runs isolated from
+// the config of the system and of the user (hooks, credential helpers, URL
+// rewrites, filters...), with the hooks of the repos disabled, never asks
+// for anything on the terminal, and only speaks the protocols allowed.
+var (
+	allowFile     bool     // let git fetch from local repos and bundle files (--allow-file)
+	insecureHosts []string // hosts that may be asked over plain HTTP, or HTTPS without checking certificates
+)
+
+// safeProtocols are the protocols git may always use.
+var safeProtocols = []string{"https", "ssh", "git"}
+
+// isInsecure tells whether host (which may have a port) is one of
+// insecureHosts.
+func isInsecure(host string) bool {
+	name := host
+	if k := strings.LastIndex(host, ":"); k >= 0 {
+		name = host[:k]
+	}
+	return contains(insecureHosts, host) || contains(insecureHosts, name)
+}
+
+// gitProtocols are the protocols git may use: http too if any host is
+// insecure (gitVCS.Clone keeps the other hosts from using it), file if
+// allowed, and none of the network ones with --offline.
+func gitProtocols() []string {
+	var protocols []string
+	if !offline {
+		protocols = append(protocols, safeProtocols...)
+	}
+	if len(insecureHosts) > 0 && !offline {
+		protocols = append(protocols, "http")
+	}
+	if allowFile {
+		protocols = append(protocols, "file")
+	}
+	return protocols
+}
+
+// gitEnv returns the environment of git commands: the one of trash, less
+// what configures git, plus the isolation (git 2.32 or later is needed).
+// With --offline, git does not fetch the files partial clones lack either
+// (git 2.39.4 or later is needed for that, else only the network protocols
+// are kept from it).
+func gitEnv(protocols []string) []string {
+	env := []string{
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_CONFIG_GLOBAL=" + os.DevNull,
+		"GIT_TERMINAL_PROMPT=0",
+		"GIT_ALLOW_PROTOCOL=" + strings.Join(protocols, ":"),
+	}
+	if offline {
+		env = append(env, "GIT_NO_LAZY_FETCH=1")
+	}
+	config := gitConfig()
+	env = append(env, fmt.Sprintf("GIT_CONFIG_COUNT=%d", len(config)))
+	for k, kv := range config {
+		env = append(env, fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", k, kv[0]), fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", k, kv[1]))
+	}
+	for _, e := range os.Environ() {
+		name := strings.SplitN(e, "=", 2)[0]
+		switch {
+		case strings.HasPrefix(name, "GIT_CONFIG"), name == "GIT_ALLOW_PROTOCOL", name == "GIT_TERMINAL_PROMPT",
+			name == "GIT_DIR", name == "GIT_WORK_TREE", name == "GIT_INDEX_FILE", name == "GIT_OBJECT_DIRECTORY":
+			continue
+		}
+		env = append(env, e)
+	}
+	return env
+}
+
+// gitConfig is the config of every git command (key and value): no hooks,
+// no file system monitor, and no certificate checks for the insecure hosts.
+func gitConfig() [][2]string {
+	config := [][2]string{{"core.hooksPath", os.DevNull}, {"core.fsmonitor", "false"}}
+	for _, h := range insecureHosts {
+		config = append(config, [2]string{"http.https://" + h + "/.sslVerify", "false"})
+	}
+	return config
+}
+
+// allowProtocols lets cmd, a git command, use protocols on top of the ones
+// allowed, e.g. file for the bundles trash is given to unbundle.
+func allowProtocols(cmd *exec.Cmd, protocols ...string) *exec.Cmd {
+	cmd.Env = gitEnv(append(gitProtocols(), protocols...))
+	return cmd
+}
+
+// checkRepoURL refuses the URLs of repos no VCS may fetch from: the ones
+// of protocols not allowed, plain HTTP ones of hosts that are not insecure,
+// and the ones a VCS could take for an option.
+func checkRepoURL(repo string) error {
+	if strings.HasPrefix(repo, "-") {
+		return fmt.Errorf("invalid repo URL '%s'", repo)
+	}
+	scheme, host := "file", ""
+	switch {
+	case strings.Contains(repo, "::"):
+		scheme = strings.SplitN(repo, "::", 2)[0] // transport::address, e.g. ext::
+	case strings.Contains(repo, "://"):
+		u, err := url.Parse(repo)
+		if err != nil {
+			return fmt.Errorf("invalid repo URL '%s': %s", repo, err)
+		}
+		scheme, host = u.Scheme, u.Host
+		if scheme != "file" && (u.Hostname() == "" || strings.HasPrefix(u.Host, "-") || strings.HasPrefix(u.User.Username(), "-")) {
+			return fmt.Errorf("invalid host in repo URL '%s'", repo)
+		}
+	case strings.Contains(repo, ":") && !strings.Contains(strings.SplitN(repo, ":", 2)[0], "/"):
+		scheme = "ssh" // user@host:path
+		if host := strings.SplitN(repo, ":", 2)[0]; strings.HasPrefix(host[strings.LastIndex(host, "@")+1:], "-") {
+			return fmt.Errorf("invalid host in repo URL '%s'", repo)
+		}
+	}
+	switch scheme {
+	case "https", "ssh", "git", "git+ssh", "ssh+git", "svn", "svn+ssh", "bzr", "bzr+ssh":
+		return nil // git only speaks the ones allowed by gitProtocols anyway
+	case "http":
+		if isInsecure(host) {
+			return nil
+		}
+		return fmt.Errorf("'%s' is plain HTTP: list %s as insecure to let trash use it", repo, host)
+	case "file":
+		if allowFile {
+			return nil
+		}
+		return fmt.Errorf("'%s' is local: run with --allow-file to let trash use it", repo)
+	}
+	return fmt.Errorf("'%s': protocol '%s' is not allowed", repo, scheme)
+}
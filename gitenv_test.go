@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckRepoURL(t *testing.T) {
+	assert := require.New(t)
+	defer func() { allowFile, insecureHosts = true, nil }()
+	allowFile, insecureHosts = false, []string{"insecure.example.com"}
+
+	for _, repo := range []string{
+		"https://example.com/foo",
+		"ssh://git@example.com/foo",
+		"git://example.com/foo",
+		"git+ssh://example.com/foo",
+		"git@example.com:foo.git",
+		"http://insecure.example.com/foo",
+		"http://insecure.example.com:8080/foo",
+		"svn+ssh://example.com/foo",
+	} {
+		assert.NoError(checkRepoURL(repo), repo)
+	}
+	for _, repo := range []string{
+		"http://example.com/foo",
+		"ext::sh -c touch% /tmp/pwned",
+		"fd::17",
+		"file:///tmp/foo",
+		"/tmp/foo",
+		"deps/foo.bundle",
+		"ftp://example.com/foo",
+		"-uhttps://example.com/foo",
+		"ssh://-oProxyCommand=touch% /tmp/pwned/foo",
+		"ssh://-user@example.com/foo",
+		"-oProxyCommand=touch:foo",
+		"git@-oProxyCommand=touch:foo",
+		"https:///foo",
+	} {
+		assert.Error(checkRepoURL(repo), repo)
+	}
+	allowFile = true
+	assert.NoError(checkRepoURL("/tmp/foo"))
+	assert.NoError(checkRepoURL("file:///tmp/foo"))
+}
+
+func TestGitIsolation(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "trash-gitenv")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// the global config of the user is ignored
+	global := filepath.Join(dir, "gitconfig")
+	assert.NoError(ioutil.WriteFile(global, []byte("[url \"ext::sh -c false \"]\n\tinsteadOf = https://\n"), 0644))
+	defer os.Setenv("GIT_CONFIG_GLOBAL", os.Getenv("GIT_CONFIG_GLOBAL"))
+	os.Setenv("GIT_CONFIG_GLOBAL", global)
+
+	upstream := filepath.Join(dir, "upstream")
+	makeUpstream(t, upstream)
+	_, err = output(git(upstream, "config", "--get-regexp", "^url\\."))
+	assert.Error(err)
+
+	// the hooks of the repos do not run
+	hook := filepath.Join(upstream, ".git", "hooks", "post-checkout")
+	assert.NoError(ioutil.WriteFile(hook, []byte("#!/bin/sh\ntouch "+filepath.Join(dir, "pwned")+"\n"), 0755))
+	_, err = combinedOutput(git(upstream, "checkout", "-q", "v1.0.0"))
+	assert.NoError(err)
+	_, err = os.Stat(filepath.Join(dir, "pwned"))
+	assert.True(os.IsNotExist(err))
+
+	// local repos are only fetched from if allowed
+	repo := filepath.Join(dir, "repo")
+	assert.NoError(os.MkdirAll(repo, 0755))
+	_, err = combinedOutput(git(repo, "init", "-q"))
+	assert.NoError(err)
+	defer func() { allowFile = true }()
+	allowFile = false
+	_, err = combinedOutput(git(repo, "fetch", "-q", upstream, "v1.0.0"))
+	assert.Error(err)
+	assert.Error(gitVCS{}.Clone(ctx, stdLog, repo, "example.com/upstream", upstream))
+	allowFile = true
+	_, err = combinedOutput(git(repo, "fetch", "-q", upstream, "v1.0.0"))
+	assert.NoError(err)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mountkin/trash/conf"
+	"github.com/urfave/cli"
+)
+
+const (
+	historyDir  = ".trash"
+	historyFile = "history"
+	configsDir  = "configs" // copies of the configs of the entries, by hash
+)
+
+// historyEntry records the state a successful run left the project in.
+type historyEntry struct {
+	Time     time.Time       `json:"time"`
+	Command  string          `json:"command"`
+	ConfFile string          `json:"config_file"`
+	Config   string          `json:"config"` // sha256 of the config file
+	Imports  []historyImport `json:"imports"`
+	Manifest string          `json:"manifest"` // hash of the vendor tree, see manifest.hash
+}
+
+type historyImport struct {
+	Package string `json:"package"`
+	Version string `json:"version,omitempty"`
+	Commit  string `json:"commit"`
+	Repo    string `json:"repo,omitempty"`
+}
+
+func historyPath(dir string) string {
+	return filepath.Join(dir, historyDir, historyFile)
+}
+
+func configPath(dir, hash string) string {
+	return filepath.Join(dir, historyDir, configsDir, hash)
+}
+
+// recordRun appends an entry to the history of the project in dir, and keeps
+// a copy of its config, for `trash rollback` to restore.
+func recordRun(dir, command, confFile string, lock *conf.Lock, m manifest) error {
+	b, err := ioutil.ReadFile(confFile)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(b)
+	hash := hex.EncodeToString(sum[:])
+	blob := configPath(dir, hash)
+	if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+		return err
+	}
+	if _, err := os.Stat(blob); os.IsNotExist(err) {
+		if err := ioutil.WriteFile(blob, b, 0644); err != nil {
+			return err
+		}
+	}
+
+	e := historyEntry{
+		Time:     time.Now().UTC(),
+		Command:  command,
+		ConfFile: confFile,
+		Config:   hash,
+		Manifest: m.hash(),
+	}
+	for _, li := range lock.Imports {
+		e.Imports = append(e.Imports, historyImport{Package: li.Package, Version: li.Version, Commit: li.Commit, Repo: li.Repo})
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	fp, err := os.OpenFile(historyPath(dir), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write(append(line, '\n')); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+// recordConfigRun records a run of command that changed the config and the
+// lock of the project in dir, but not its vendor dir, whose manifest is then
+// recorded as it is.
+func recordConfigRun(dir, command, confFile string, lock *conf.Lock) error {
+	m, err := readManifest(manifestFile(confFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return recordRun(dir, command, confFile, lock, m)
+}
+
+// readHistory returns the entries of the history of the project in dir,
+// oldest first.
+func readHistory(dir string) ([]historyEntry, error) {
+	fp, err := os.Open(historyPath(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	var r []historyEntry
+	scanner := bufio.NewScanner(fp)
+	scanner.Buffer(nil, 16*1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e historyEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", historyPath(dir), lineNo, err)
+		}
+		r = append(r, e)
+	}
+	return r, scanner.Err()
+}
+
+// rollbackCommand restores the config and the vendor dir of an earlier run,
+// from the cache only: the commits of the entry must be there already.
+func rollbackCommand(c *cli.Context) error {
+	p, err := loadProject(c)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	entries, err := readHistory(p.dir)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("list") {
+		for k := len(entries) - 1; k >= 0; k-- {
+			e := entries[k]
+			fmt.Printf("%d\t%s\t%s\t%d import(s)\t%s\n", len(entries)-1-k, e.Time.Local().Format(time.RFC3339), e.Command, len(e.Imports), e.Manifest)
+		}
+		return nil
+	}
+
+	n := 1
+	if c.NArg() > 0 {
+		if n, err = strconv.Atoi(c.Args().First()); err != nil || n < 1 {
+			return fmt.Errorf("invalid number of runs to go back: '%s'", c.Args().First())
+		}
+	}
+	if n >= len(entries) {
+		return fmt.Errorf("cannot go back %d run(s): %s has %d entries", n, historyPath(p.dir), len(entries))
+	}
+	e := entries[len(entries)-1-n]
+	logrus.Infof("Rolling back to the run of %s (%s)", e.Time.Local().Format(time.RFC3339), e.Command)
+	return p.restore(ctx, e)
+}
+
+// restore brings the project back to the state recorded in e.
+func (p *project) restore(ctx context.Context, e historyEntry) error {
+	b, err := ioutil.ReadFile(configPath(p.dir, e.Config))
+	if err != nil {
+		return fmt.Errorf("could not read the config of the entry: %s", err)
+	}
+	// Parse it under its own name, which tells its format
+	tmpDir, err := ioutil.TempDir("", "trash-rollback")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	tmpConf := filepath.Join(tmpDir, filepath.Base(e.ConfFile))
+	if err := ioutil.WriteFile(tmpConf, b, 0644); err != nil {
+		return err
+	}
+	trashConf, err := conf.Parse(tmpConf)
+	if err != nil {
+		return err
+	}
+
+	tx, err := beginVendor(p.vendorDir())
+	if err != nil {
+		return err
+	}
+	defer tx.rollback()
+
+	lock := &conf.Lock{}
+	var errs []error
+	for _, hi := range e.Imports {
+		// The config has the repo, backend and options of the import, unless
+		// it came from a dependency
+		i, inConf := trashConf.Get(hi.Package)
+		if !inConf {
+			i = conf.Import{Package: hi.Package}
+		}
+		i.Version = hi.Version
+		v, repoDir, err := repoOf(p.trashDir, i)
+		if err != nil {
+			errs = append(errs, &importError{i, err})
+			continue
+		}
+		if !v.HasCommit(repoDir, hi.Commit) {
+			errs = append(errs, &importError{i, fmt.Errorf("commit %s is not in the cache", hi.Commit)})
+			continue
+		}
+		err = withRepoLock(p.trashDir, i.Package, func() error {
+			stdLog.Infof("Checking out '%s', commit: '%s'", hi.Package, hi.Commit)
+			if err := v.Checkout(ctx, stdLog, repoDir, "", hi.Commit); err != nil {
+				return err
+			}
+			li, err := lockImport(p.trashDir, i)
+			if err != nil {
+				return err
+			}
+			if !inConf {
+				li.Repo = hi.Repo
+			}
+			lock.Set(li)
+			if err := cpy(tx.newDir, p.trashDir, i); err != nil {
+				return err
+			}
+			markUsed(p.trashDir, repoDir)
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, &importError{i, err})
+		}
+	}
+	if err := collect(errs); err != nil {
+		return err
+	}
+	if !p.keep {
+		if err := stripVCSDirs(tx.newDir); err != nil {
+			return err
+		}
+	}
+
+	var roots []string
+	for _, hi := range e.Imports {
+		roots = append(roots, hi.Package)
+	}
+	for _, i := range trashConf.Imports {
+		if !i.Staging {
+			continue
+		}
+		var stagingRoots []string
+		li, _ := lock.Get(i.Package)
+		err := atCommit(ctx, stdLog, p.trashDir, i, li.Commit, func() (err error) {
+			stagingRoots, err = copyStaging(p.trashDir, tx.newDir, i)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		roots = append(roots, stagingRoots...)
+	}
+	if !p.keep {
+		if err := cleanup(p.dir, p.targetDir, tx.newDir, trashConf, nil); err != nil {
+			return err
+		}
+	}
+	m, err := hashVendor(tx.newDir, roots)
+	if err != nil {
+		return err
+	}
+	m.addSigners(lock)
+	if h := m.hash(); h != e.Manifest {
+		logrus.Warnf("The restored vendor dir has hash %s, the entry recorded %s", h, e.Manifest)
+	}
+
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(e.ConfFile, b); err != nil {
+		return err
+	}
+	if err := lock.Dump(conf.LockFile(e.ConfFile)); err != nil {
+		return err
+	}
+	if err := m.dump(manifestFile(e.ConfFile)); err != nil {
+		return err
+	}
+	return recordRun(p.dir, "rollback", e.ConfFile, lock, m)
+}
+
+// writeFileAtomic replaces the file at path with one holding b.
+func writeFileAtomic(path string, b []byte) error {
+	fp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write(b); err != nil {
+		fp.Close()
+		os.Remove(fp.Name())
+		return err
+	}
+	fp.Close()
+	if fi, err := os.Stat(path); err == nil {
+		os.Chmod(fp.Name(), fi.Mode())
+	}
+	return os.Rename(fp.Name(), path)
+}
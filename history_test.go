@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mountkin/trash/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory(t *testing.T) {
+	assert := require.New(t)
+	dir, err := ioutil.TempDir("", "trash-history")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	confFile := filepath.Join(dir, "vendor.conf")
+
+	entries, err := readHistory(dir)
+	assert.NoError(err)
+	assert.Empty(entries)
+
+	assert.NoError(ioutil.WriteFile(confFile, []byte("example.com/a v1.0.0\n"), 0644))
+	lock := &conf.Lock{Imports: []conf.LockedImport{{Package: "example.com/a", Version: "v1.0.0", Commit: "aaa", Repo: "https://example.com/a.git"}}}
+	m := manifest{"example.com/a": "h1:xyz"}
+	assert.NoError(recordRun(dir, "trash", confFile, lock, m))
+
+	assert.NoError(ioutil.WriteFile(confFile, []byte("example.com/a v1.1.0\n"), 0644))
+	lock.Imports[0].Version, lock.Imports[0].Commit = "v1.1.0", "bbb"
+	assert.NoError(recordRun(dir, "update", confFile, lock, manifest{}))
+
+	entries, err = readHistory(dir)
+	assert.NoError(err)
+	assert.Len(entries, 2)
+	assert.Equal("trash", entries[0].Command)
+	assert.Equal([]historyImport{{Package: "example.com/a", Version: "v1.0.0", Commit: "aaa", Repo: "https://example.com/a.git"}}, entries[0].Imports)
+	assert.Equal(m.hash(), entries[0].Manifest)
+	assert.Equal("bbb", entries[1].Imports[0].Commit)
+	assert.NotEqual(entries[0].Config, entries[1].Config)
+
+	b, err := ioutil.ReadFile(configPath(dir, entries[0].Config))
+	assert.NoError(err)
+	assert.Equal("example.com/a v1.0.0\n", string(b))
+
+	assert.NoError(ioutil.WriteFile(historyPath(dir), []byte("{not json\n"), 0644))
+	_, err = readHistory(dir)
+	assert.Error(err)
+}
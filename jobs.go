@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mountkin/trash/conf"
+	"github.com/mountkin/trash/util"
+)
+
+// jobs is the number of repos fetched or checked out at once (--jobs).
+var jobs = 1
+
+// stdLog logs to the standard logger, for the callers of the git layer that
+// do not run as a task of forEach.
+var stdLog = logrus.NewEntry(logrus.StandardLogger())
+
+// forEach runs f for the tasks 0 to n-1, at most jobs of them at once. Each
+// task logs to its own buffer, which is written out once the task and all
+// the tasks before it are done: the output is the same as if the tasks ran
+// one after another. The errors are returned in task order.
+func forEach(n int, f func(k int, log *logrus.Entry) error) []error {
+	std := logrus.StandardLogger()
+	bufs := make([]bytes.Buffer, n)
+	done := make([]chan struct{}, n)
+	errs := make([]error, n)
+	sem := make(chan struct{}, maxInt(jobs, 1))
+	for k := 0; k < n; k++ {
+		done[k] = make(chan struct{})
+		go func(k int) {
+			defer close(done[k])
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			log := &logrus.Logger{
+				Out:       &bufs[k],
+				Formatter: std.Formatter,
+				Hooks:     make(logrus.LevelHooks),
+				Level:     std.Level,
+			}
+			errs[k] = f(k, logrus.NewEntry(log))
+		}(k)
+	}
+	for k := 0; k < n; k++ {
+		<-done[k]
+		std.Out.Write(bufs[k].Bytes())
+	}
+	return errs
+}
+
+// sortedPackages returns the packages of ps in order.
+func sortedPackages(ps util.Packages) []string {
+	var r []string
+	for p := range ps {
+		r = append(r, p)
+	}
+	sort.Strings(r)
+	return r
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// repoGroups groups the imports that may live in the same repo: packages
+// under the same (guessed) repo root, and packages nested in one another.
+// The imports of a group must not be fetched or checked out concurrently.
+// Groups come in the order of their first import.
+func repoGroups(imports []conf.Import) [][]conf.Import {
+	var pkgs []string
+	for _, i := range imports {
+		pkgs = append(pkgs, i.Package)
+	}
+	sort.Strings(pkgs) // parents first
+
+	keys := map[string]string{}
+	var roots []string
+	for _, pkg := range pkgs {
+		key, found := conf.RepoRoot(pkg), false
+		for _, r := range roots {
+			if key == r || strings.HasPrefix(key, r+"/") {
+				key, found = r, true
+				break
+			}
+		}
+		if !found {
+			roots = append(roots, key)
+		}
+		keys[pkg] = key
+	}
+
+	var groups [][]conf.Import
+	index := map[string]int{}
+	for _, i := range imports {
+		g, ok := index[keys[i.Package]]
+		if !ok {
+			g = len(groups)
+			index[keys[i.Package]] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], i)
+	}
+	return groups
+}
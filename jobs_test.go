@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mountkin/trash/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForEach(t *testing.T) {
+	assert := require.New(t)
+	out := &bytes.Buffer{}
+	std := logrus.StandardLogger()
+	defer logrus.SetOutput(std.Out)
+	logrus.SetOutput(out)
+	defer func(j int) { jobs = j }(jobs)
+	jobs = 3
+
+	var running, maxRunning int32
+	errs := forEach(6, func(k int, log *logrus.Entry) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		// Later tasks finish first
+		time.Sleep(time.Duration(6-k) * 5 * time.Millisecond)
+		log.Infof("task %d", k)
+		if k%2 == 1 {
+			return fmt.Errorf("task %d failed", k)
+		}
+		return nil
+	})
+
+	assert.True(maxRunning <= 3, "%d tasks ran at once", maxRunning)
+	assert.Equal([]error{nil, errors.New("task 1 failed"), nil, errors.New("task 3 failed"), nil, errors.New("task 5 failed")}, errs)
+
+	last := -1
+	for k := 0; k < 6; k++ {
+		at := bytes.Index(out.Bytes(), []byte(fmt.Sprintf("task %d\"", k)))
+		assert.True(at > last, "output of task %d out of order:\n%s", k, out)
+		last = at
+	}
+}
+
+func TestRepoGroups(t *testing.T) {
+	assert := require.New(t)
+	imports := []conf.Import{
+		{Package: "example.com/x/sub"},
+		{Package: "github.com/a/b"},
+		{Package: "example.com/y"},
+		{Package: "github.com/a/b/c"},
+		{Package: "example.com/x"},
+		{Package: "github.com/a/bb"},
+	}
+	var groups [][]string
+	for _, g := range repoGroups(imports) {
+		var pkgs []string
+		for _, i := range g {
+			pkgs = append(pkgs, i.Package)
+		}
+		groups = append(groups, pkgs)
+	}
+	assert.Equal([][]string{
+		{"example.com/x/sub", "example.com/x"},
+		{"github.com/a/b", "github.com/a/b/c"},
+		{"example.com/y"},
+		{"github.com/a/bb"},
+	}, groups)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mountkin/trash/conf"
+)
+
+// lockImport records the commit currently checked out for i in the cache,
+// once verified if i is to be (see verifySigned).
+func lockImport(trashDir string, i conf.Import) (conf.LockedImport, error) {
+	v, repoDir, err := repoOf(trashDir, i)
+	if err != nil {
+		return conf.LockedImport{}, err
+	}
+	commit, date, err := v.Current(repoDir)
+	if err != nil {
+		return conf.LockedImport{}, fmt.Errorf("could not read the commit checked out for '%s': %s", i.Package, err)
+	}
+	repo := v.RemoteURL(repoDir, i.Repo)
+	if isBundle(i.Repo) {
+		repo = i.Repo // as written: relative to the project dir, maybe
+	}
+	li := conf.LockedImport{
+		Package: i.Package,
+		Version: i.Version,
+		Commit:  commit,
+		Repo:    repo,
+		Date:    date,
+	}
+	if i.Verify == conf.VerifySigned {
+		if v.Name() != "git" {
+			return conf.LockedImport{}, fmt.Errorf("'%s' is to be verified, but only git repos can be: it is in a %s one", i.Package, v.Name())
+		}
+		if li.Signed, li.Signer, err = verifySigned(trashDir, repoDir, i, commit); err != nil {
+			return conf.LockedImport{}, err
+		}
+	}
+	return li, nil
+}
+
+// checkoutLocked checks out exactly the commit recorded in li. It refuses to
+// do so if i.Version is a tag that no longer points to that commit, upstream
+// (unless offline) or in the cache.
+func checkoutLocked(ctx context.Context, log *logrus.Entry, trashDir string, i conf.Import, li conf.LockedImport) error {
+	log.WithFields(logrus.Fields{"trashDir": trashDir, "i": i, "li": li}).Debug("entering checkoutLocked")
+	v, repoDir, err := repoOf(trashDir, i)
+	if err != nil {
+		return err
+	}
+	log.Infof("Checking out '%s', commit: '%s' (locked '%s')", i.Package, li.Commit, i.Version)
+	if !v.HasCommit(repoDir, li.Commit) {
+		if offline && !isBundle(i.Repo) {
+			return offlineError("locked commit '%s' of '%s'", li.Commit, i.Package)
+		}
+		if err := v.Fetch(ctx, log, repoDir, i.Repo); err != nil {
+			return fmt.Errorf("could not fetch locked commit '%s' of '%s': %s", li.Commit, i.Package, err)
+		}
+	}
+	commit, ok := v.TagCommit(repoDir, i.Version)
+	if !offline || isBundle(i.Repo) {
+		if commit, ok, err = upstreamTagCommit(ctx, log, v, repoDir, i.Repo, i.Version, commit, ok); err != nil {
+			return fmt.Errorf("could not check tag '%s' of '%s': %s", i.Version, i.Package, err)
+		}
+	}
+	if ok && commit != li.Commit {
+		return fmt.Errorf("tag '%s' of '%s' points to %s, but %s is locked in %s: the tag has been moved, run with --update to accept it",
+			i.Version, i.Package, commit, li.Commit, conf.LockFileName)
+	}
+	return v.Checkout(ctx, log, repoDir, i.Repo, li.Commit)
+}
+
+// upstreamTagCommit returns the commit tag points to upstream, if it is a tag
+// there, given the one it points to in the cache (cached, if ok): it may
+// have been moved since it was fetched. Git is asked without fetching
+// anything, and commit-like versions are not asked about. The tags of svn
+// repos and proxies are never stale, and archives have none.
+func upstreamTagCommit(ctx context.Context, log *logrus.Entry, v VCS, dir, url, tag, cached string, ok bool) (string, bool, error) {
+	switch v.(type) {
+	case gitVCS:
+		if commitPrefix.MatchString(tag) {
+			return cached, ok, nil
+		}
+		remote := remoteName(url)
+		var refs []string
+		err := retry(ctx, log, "list the tags of '"+remote+"'", func(ctx context.Context) (err error) {
+			refs, err = outputLines(gitContext(ctx, dir, "ls-remote", "--tags", remote, "refs/tags/"+tag, "refs/tags/"+tag+"^{}"))
+			return err
+		})
+		if err != nil {
+			return "", false, err
+		}
+		commit := ""
+		for _, l := range refs {
+			// an annotated tag is listed twice, its commit as "<tag>^{}"
+			switch fields := strings.Fields(l); {
+			case len(fields) != 2:
+			case fields[1] == "refs/tags/"+tag+"^{}":
+				return fields[0], true, nil
+			case fields[1] == "refs/tags/"+tag:
+				commit = fields[0]
+			}
+		}
+		return commit, commit != "", nil
+	case hgVCS, bzrVCS:
+		if !ok {
+			return cached, ok, nil
+		}
+		if err := v.Fetch(ctx, log, dir, url); err != nil {
+			return "", false, err
+		}
+		commit, ok := v.TagCommit(dir, tag)
+		return commit, ok, nil
+	}
+	return cached, ok, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mountkin/trash/conf"
+	"github.com/mountkin/trash/util"
+)
+
+const manifestFileName = "vendor.sum"
+
+// manifest maps the root of every vendored package to the hash of its
+// directory (see util.HashDir), followed by the key that signed it for the
+// imports verified as signed (see addSigners).
+type manifest map[string]string
+
+func manifestFile(confFile string) string {
+	return filepath.Join(filepath.Dir(confFile), manifestFileName)
+}
+
+// hashVendor hashes the roots present in vendorDir.
+func hashVendor(vendorDir string, roots []string) (manifest, error) {
+	m := manifest{}
+	for _, root := range roots {
+		dir := filepath.Join(vendorDir, root)
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			continue
+		}
+		h, err := util.HashDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		m[root] = h
+	}
+	return m, nil
+}
+
+func readManifest(path string) (manifest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	m := manifest{}
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: malformed line, expected `package hash [signer]`", path, lineNo)
+		}
+		m[fields[0]] = strings.Join(fields[1:], " ")
+	}
+	return m, scanner.Err()
+}
+
+// addSigners records in m the keys that signed the imports of lock verified
+// as signed, in place of those recorded before.
+func (m manifest) addSigners(lock *conf.Lock) {
+	for _, li := range lock.Imports {
+		if h, ok := m[li.Package]; ok && li.Signer != "" {
+			m[li.Package] = strings.Fields(h)[0] + " " + li.Signer
+		}
+	}
+}
+
+func (m manifest) roots() []string {
+	roots := make([]string, 0, len(m))
+	for root := range m {
+		roots = append(roots, root)
+	}
+	sort.Strings(roots)
+	return roots
+}
+
+func (m manifest) dump(path string) error {
+	fp, err := ioutil.TempFile(filepath.Dir(path), ".vendor.sum")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fp)
+	m.write(w)
+	if err := w.Flush(); err != nil {
+		fp.Close()
+		os.Remove(fp.Name())
+		return err
+	}
+	fp.Close()
+	return os.Rename(fp.Name(), path)
+}
+
+func (m manifest) write(w io.Writer) {
+	for _, root := range m.roots() {
+		fmt.Fprintf(w, "%s %s\n", root, m[root])
+	}
+}
+
+// hash identifies the whole vendor tree described by m: it is the hash of
+// its vendor.sum, in the format of util.HashDir.
+func (m manifest) hash() string {
+	h := sha256.New()
+	m.write(h)
+	return "h1:" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// diff describes how other differs from m, one line per package root.
+func (m manifest) diff(other manifest) []string {
+	all := manifest{}
+	for root := range m {
+		all[root] = ""
+	}
+	for root := range other {
+		all[root] = ""
+	}
+	var r []string
+	for _, root := range all.roots() {
+		h, ok := m[root]
+		otherH, otherOK := other[root]
+		switch {
+		case !otherOK:
+			r = append(r, fmt.Sprintf("'%s' is missing", root))
+		case !ok:
+			r = append(r, fmt.Sprintf("'%s' is unexpected", root))
+		case h != otherH:
+			r = append(r, fmt.Sprintf("'%s' has hash %s, expected %s", root, otherH, h))
+		}
+	}
+	return r
+}
+
+// unmanagedFiles lists the files in vendorDir which do not belong to any of
+// roots.
+func unmanagedFiles(vendorDir string, roots []string) ([]string, error) {
+	var r []string
+	err := filepath.Walk(vendorDir, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && p == vendorDir {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(vendorDir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		for _, root := range roots {
+			if strings.HasPrefix(rel, root+"/") {
+				return nil
+			}
+		}
+		r = append(r, rel)
+		return nil
+	})
+	return r, err
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifest(t *testing.T) {
+	assert := require.New(t)
+	dir, err := ioutil.TempDir("", "trash-manifest")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	vendorDir := filepath.Join(dir, "vendor")
+	assert.NoError(os.MkdirAll(filepath.Join(vendorDir, "github.com/a/a/sub"), 0755))
+	assert.NoError(os.MkdirAll(filepath.Join(vendorDir, "github.com/b/b"), 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(vendorDir, "github.com/a/a/sub/a.go"), []byte("package sub\n"), 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(vendorDir, "github.com/b/b/b.go"), []byte("package b\n"), 0644))
+
+	roots := []string{"github.com/a/a", "github.com/b/b", "github.com/c/c"}
+	m, err := hashVendor(vendorDir, roots)
+	assert.NoError(err)
+	assert.Len(m, 2)
+
+	manifestPath := manifestFile(filepath.Join(dir, "vendor.conf"))
+	assert.NoError(m.dump(manifestPath))
+	recorded, err := readManifest(manifestPath)
+	assert.NoError(err)
+	assert.Equal(m, recorded)
+	assert.Empty(recorded.diff(m))
+
+	assert.NoError(ioutil.WriteFile(filepath.Join(vendorDir, "github.com/b/b/b.go"), []byte("package bb\n"), 0644))
+	assert.NoError(os.RemoveAll(filepath.Join(vendorDir, "github.com/a/a")))
+	assert.NoError(ioutil.WriteFile(filepath.Join(vendorDir, "github.com/stray.go"), []byte("package stray\n"), 0644))
+
+	actual, err := hashVendor(vendorDir, roots)
+	assert.NoError(err)
+	diff := recorded.diff(actual)
+	assert.Len(diff, 2)
+	assert.Contains(diff[0], "'github.com/a/a' is missing")
+	assert.Contains(diff[1], "'github.com/b/b' has hash")
+
+	unmanaged, err := unmanagedFiles(vendorDir, roots)
+	assert.NoError(err)
+	assert.Equal([]string{"github.com/stray.go"}, unmanaged)
+}
+
+func TestManifestHash(t *testing.T) {
+	assert := require.New(t)
+	a := manifest{"example.com/a": "h1:1", "example.com/b": "h1:2"}
+	b := manifest{"example.com/b": "h1:2", "example.com/a": "h1:1"}
+	assert.Equal(a.hash(), b.hash())
+	b["example.com/b"] = "h1:3"
+	assert.NotEqual(a.hash(), b.hash())
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/mountkin/trash/conf"
+)
+
+// report describes what a run changed (or, with --dry-run, would change) in
+// the vendor dir.
+type report struct {
+	Added      []packageChange `json:"added"`
+	Removed    []packageChange `json:"removed"`
+	Changed    []packageChange `json:"changed"`
+	Pruned     []prunedPath    `json:"pruned"`
+	BytesSaved int64           `json:"bytes_saved"`
+	vendorDir  string
+}
+
+type packageChange struct {
+	Package    string `json:"package"`
+	OldVersion string `json:"old_version,omitempty"`
+	OldCommit  string `json:"old_commit,omitempty"`
+	NewVersion string `json:"new_version,omitempty"`
+	NewCommit  string `json:"new_commit,omitempty"`
+}
+
+type prunedPath struct {
+	Path   string `json:"path"`
+	Dir    bool   `json:"dir,omitempty"`
+	Reason string `json:"reason"`
+	Bytes  int64  `json:"bytes"`
+}
+
+func newReport(vendorDir string) *report {
+	return &report{vendorDir: vendorDir}
+}
+
+// compareLocks records the packages added, removed or changed between the
+// old and the new lock.
+func (r *report) compareLocks(old, new *conf.Lock) {
+	for _, li := range new.Imports {
+		oldLi, ok := old.Get(li.Package)
+		switch {
+		case !ok:
+			r.Added = append(r.Added, packageChange{Package: li.Package, NewVersion: li.Version, NewCommit: li.Commit})
+		case oldLi.Version != li.Version || oldLi.Commit != li.Commit:
+			r.Changed = append(r.Changed, packageChange{
+				Package:    li.Package,
+				OldVersion: oldLi.Version,
+				OldCommit:  oldLi.Commit,
+				NewVersion: li.Version,
+				NewCommit:  li.Commit,
+			})
+		}
+	}
+	for _, oldLi := range old.Imports {
+		if _, ok := new.Get(oldLi.Package); !ok {
+			r.Removed = append(r.Removed, packageChange{Package: oldLi.Package, OldVersion: oldLi.Version, OldCommit: oldLi.Commit})
+		}
+	}
+}
+
+// removeAll removes path and everything under it, recording it as pruned
+// for reason. A nil report just removes.
+func (r *report) removeAll(path, reason string) error {
+	if r == nil {
+		return os.RemoveAll(path)
+	}
+	size := dirSize(path)
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	r.record(path, true, reason, size)
+	return nil
+}
+
+// remove removes a file or an empty dir, recording it as pruned for reason.
+// A nil report just removes.
+func (r *report) remove(path, reason string) error {
+	if r == nil {
+		return os.Remove(path)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	var size int64
+	if !info.IsDir() {
+		size = info.Size()
+	}
+	r.record(path, info.IsDir(), reason, size)
+	return nil
+}
+
+func (r *report) record(path string, dir bool, reason string, size int64) {
+	if rel, err := filepath.Rel(r.vendorDir, path); err == nil {
+		path = filepath.ToSlash(rel)
+	}
+	r.Pruned = append(r.Pruned, prunedPath{Path: path, Dir: dir, Reason: reason, Bytes: size})
+	r.BytesSaved += size
+}
+
+func dirSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+func (r *report) print(w io.Writer) {
+	sort.Sort(byPrunedPath(r.Pruned))
+	if len(r.Added)+len(r.Removed)+len(r.Changed) == 0 {
+		fmt.Fprintln(w, "Packages: no changes")
+	} else {
+		fmt.Fprintln(w, "Packages:")
+	}
+	for _, p := range r.Added {
+		fmt.Fprintf(w, "  + %s %s (%s)\n", p.Package, p.NewVersion, shortCommit(p.NewCommit))
+	}
+	for _, p := range r.Removed {
+		fmt.Fprintf(w, "  - %s %s (%s)\n", p.Package, p.OldVersion, shortCommit(p.OldCommit))
+	}
+	for _, p := range r.Changed {
+		fmt.Fprintf(w, "  ~ %s %s (%s) -> %s (%s)\n", p.Package, p.OldVersion, shortCommit(p.OldCommit), p.NewVersion, shortCommit(p.NewCommit))
+	}
+	fmt.Fprintf(w, "Pruned (%d):\n", len(r.Pruned))
+	for _, p := range r.Pruned {
+		suffix := ""
+		if p.Dir {
+			suffix = "/"
+		}
+		fmt.Fprintf(w, "  %s%s: %s, %d bytes\n", p.Path, suffix, p.Reason, p.Bytes)
+	}
+	fmt.Fprintf(w, "Bytes saved: %d\n", r.BytesSaved)
+}
+
+func (r *report) dump(path string) error {
+	sort.Sort(byPrunedPath(r.Pruned))
+	bytes, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(bytes, '\n'), 0644)
+}
+
+func shortCommit(commit string) string {
+	if len(commit) > 12 {
+		return commit[:12]
+	}
+	return commit
+}
+
+type byPrunedPath []prunedPath
+
+func (s byPrunedPath) Len() int           { return len(s) }
+func (s byPrunedPath) Less(i, j int) bool { return s[i].Path < s[j].Path }
+func (s byPrunedPath) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
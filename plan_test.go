@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mountkin/trash/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReport(t *testing.T) {
+	assert := require.New(t)
+	dir, err := ioutil.TempDir("", "trash-report")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	old := &conf.Lock{Imports: []conf.LockedImport{
+		{Package: "github.com/a/a", Version: "v1", Commit: "aaa"},
+		{Package: "github.com/b/b", Version: "v1", Commit: "bbb"},
+	}}
+	new := &conf.Lock{Imports: []conf.LockedImport{
+		{Package: "github.com/a/a", Version: "v2", Commit: "aab"},
+		{Package: "github.com/c/c", Version: "v1", Commit: "ccc"},
+	}}
+
+	vendorDir := filepath.Join(dir, "vendor")
+	assert.NoError(os.MkdirAll(filepath.Join(vendorDir, "github.com/a/a/unused"), 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(vendorDir, "github.com/a/a/unused/x.go"), []byte("package x\n"), 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(vendorDir, "github.com/a/a/README.md"), []byte("# a\n"), 0644))
+
+	rep := newReport(vendorDir)
+	rep.compareLocks(old, new)
+	assert.NoError(rep.removeAll(filepath.Join(vendorDir, "github.com/a/a/unused"), "not imported"))
+	assert.NoError(rep.remove(filepath.Join(vendorDir, "github.com/a/a/README.md"), "not a source or license file"))
+
+	assert.Equal([]packageChange{{Package: "github.com/c/c", NewVersion: "v1", NewCommit: "ccc"}}, rep.Added)
+	assert.Equal([]packageChange{{Package: "github.com/b/b", OldVersion: "v1", OldCommit: "bbb"}}, rep.Removed)
+	assert.Equal([]packageChange{{Package: "github.com/a/a", OldVersion: "v1", OldCommit: "aaa", NewVersion: "v2", NewCommit: "aab"}}, rep.Changed)
+	assert.Len(rep.Pruned, 2)
+	assert.Equal(int64(14), rep.BytesSaved)
+	_, err = os.Stat(filepath.Join(vendorDir, "github.com/a/a/unused"))
+	assert.True(os.IsNotExist(err))
+
+	var out bytes.Buffer
+	rep.print(&out)
+	assert.Contains(out.String(), "github.com/a/a/unused/: not imported, 10 bytes")
+	assert.Contains(out.String(), "Bytes saved: 14")
+
+	reportFile := filepath.Join(dir, "report.json")
+	assert.NoError(rep.dump(reportFile))
+	data, err := ioutil.ReadFile(reportFile)
+	assert.NoError(err)
+	loaded := report{}
+	assert.NoError(json.Unmarshal(data, &loaded))
+	assert.Equal(rep.Pruned, loaded.Pruned)
+	assert.Equal("github.com/a/a/README.md", loaded.Pruned[0].Path)
+
+	var nilReport *report
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "f"), nil, 0644))
+	assert.NoError(nilReport.remove(filepath.Join(dir, "f"), "whatever"))
+}
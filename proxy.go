@@ -0,0 +1,453 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mountkin/trash/semver"
+)
+
+// proxyURL is the module proxy (GOPROXY protocol) the imports without a
+// repo or vcs of their own are downloaded from, instead of being cloned. It
+// is "" when they are cloned.
+var proxyURL string
+
+// proxyVCS downloads the versions of a module from proxyURL and extracts
+// them in place of a checkout. The "commits" it knows are module versions:
+// tags as they are, commits as pseudo-versions.
+//
+// Its metadata dir holds the module path, the proxy, the version list, and
+// the .info and .zip files of the versions downloaded so far.
+type proxyVCS struct{}
+
+const proxyMetaDir = ".trash-proxy"
+
+var errNotFound = errors.New("not found")
+
+var proxyClient = &http.Client{Timeout: 10 * time.Minute}
+
+// escapeModulePath escapes the upper case letters of p the way proxies
+// expect them: "!" and the lower case letter.
+func escapeModulePath(p string) string {
+	var b []rune
+	for _, r := range p {
+		if unicode.IsUpper(r) {
+			b = append(b, '!', unicode.ToLower(r))
+		} else {
+			b = append(b, r)
+		}
+	}
+	return string(b)
+}
+
+// proxyGet downloads url, an http(s):// or file:// one. Missing files are
+// errNotFound.
+func proxyGet(ctx context.Context, log *logrus.Entry, url string) ([]byte, error) {
+	if offline && !strings.HasPrefix(url, "file://") {
+		return nil, offlineError("'%s'", url)
+	}
+	if strings.HasPrefix(url, "file://") {
+		b, err := ioutil.ReadFile(strings.TrimPrefix(url, "file://"))
+		if os.IsNotExist(err) {
+			return nil, errNotFound
+		}
+		return b, err
+	}
+	var b []byte
+	err := retry(ctx, log, "GET "+url, func(ctx context.Context) error {
+		resp, err := httpGet(ctx, proxyClient, url)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		b, err = ioutil.ReadAll(resp.Body)
+		return err
+	})
+	return b, err
+}
+
+// httpGet gets url with client. Missing files are errNotFound, and other
+// failures but server errors are permanent.
+func httpGet(ctx context.Context, client *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, permanent(err)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return resp, nil
+	case resp.StatusCode == http.StatusNotFound, resp.StatusCode == http.StatusGone:
+		err = permanent(errNotFound)
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusTooManyRequests:
+		err = fmt.Errorf("GET %s: %s", url, resp.Status)
+	default:
+		err = permanent(fmt.Errorf("GET %s: %s", url, resp.Status))
+	}
+	resp.Body.Close()
+	return nil, err
+}
+
+// findModule returns the path of the module pkg is in, the longest prefix
+// of it the proxy has versions of.
+func findModule(ctx context.Context, log *logrus.Entry, pkg string) (string, error) {
+	for p := pkg; p != "." && p != "/"; p = path.Dir(p) {
+		_, err := proxyGet(ctx, log, proxyURL+"/"+escapeModulePath(p)+"/@v/list")
+		if err == nil {
+			log.Infof("'%s' is in module '%s' of proxy '%s'", pkg, p, proxyURL)
+			return p, nil
+		}
+		if err != errNotFound {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("no module of proxy '%s' has '%s'", proxyURL, pkg)
+}
+
+// proxyModule is the module downloaded to a dir of the cache.
+type proxyModule struct {
+	root, meta string
+	module     string
+	proxy      string
+}
+
+func openProxyModule(dir string) (*proxyModule, error) {
+	for d := filepath.Clean(dir); ; d = filepath.Dir(d) {
+		meta := filepath.Join(d, proxyMetaDir)
+		if fi, err := os.Stat(meta); err == nil && fi.IsDir() {
+			m := &proxyModule{root: d, meta: meta}
+			module, err := ioutil.ReadFile(filepath.Join(meta, "module"))
+			if err != nil {
+				return nil, err
+			}
+			proxy, err := ioutil.ReadFile(filepath.Join(meta, "proxy"))
+			if err != nil {
+				return nil, err
+			}
+			m.module, m.proxy = string(module), string(proxy)
+			return m, nil
+		}
+		if d == filepath.Dir(d) {
+			return nil, fmt.Errorf("'%s' is not in a module downloaded from a proxy", dir)
+		}
+	}
+}
+
+func (m *proxyModule) url(file string) string {
+	return m.proxy + "/" + escapeModulePath(m.module) + "/" + file
+}
+
+func (m *proxyModule) list() ([]string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(m.meta, "list"))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(b)), nil
+}
+
+type proxyInfo struct {
+	Version string
+	Time    time.Time
+}
+
+// query asks the proxy what rev (a branch, a commit, or "latest") is.
+func (m *proxyModule) query(ctx context.Context, log *logrus.Entry, rev string) (string, error) {
+	file := "@v/" + escapeModulePath(rev) + ".info"
+	if rev == "latest" {
+		file = "@latest"
+	}
+	b, err := proxyGet(ctx, log, m.url(file))
+	if err != nil {
+		return "", err
+	}
+	var info proxyInfo
+	if err := json.Unmarshal(b, &info); err != nil || info.Version == "" {
+		return "", fmt.Errorf("invalid version info of '%s' at '%s'", m.module, rev)
+	}
+	return info.Version, nil
+}
+
+// resolve returns the version of the module rev stands for: a version of
+// the list, the pseudo-version of a commit, or the latest version for
+// "master".
+func (m *proxyModule) resolve(ctx context.Context, log *logrus.Entry, rev string) (string, error) {
+	list, err := m.list()
+	if err != nil {
+		return "", err
+	}
+	if rev == "master" {
+		if v, err := m.query(ctx, log, "latest"); err != errNotFound && !offline {
+			return v, err
+		}
+		// the latest release, else the latest pre-release or commit
+		versions := semver.Tags(list)
+		if len(versions) == 0 {
+			return "", fmt.Errorf("no versions of '%s'", m.module)
+		}
+		for k := len(versions) - 1; k >= 0; k-- {
+			if versions[k].Pre == "" {
+				return versions[k].Original, nil
+			}
+		}
+		return versions[len(versions)-1].Original, nil
+	}
+	for _, v := range list {
+		if v == rev || v == rev+"+incompatible" {
+			return v, nil
+		}
+	}
+	if len(rev) >= 7 {
+		for _, v := range list {
+			if c, ok := semver.PseudoCommit(v); ok && (strings.HasPrefix(c, rev) || strings.HasPrefix(rev, c)) {
+				return v, nil
+			}
+		}
+	}
+	v, err := m.query(ctx, log, rev)
+	if err == errNotFound {
+		return "", fmt.Errorf("unknown version '%s' of '%s'", rev, m.module)
+	}
+	return v, err
+}
+
+func (m *proxyModule) zipFile(version string) string {
+	return filepath.Join(m.meta, version+".zip")
+}
+
+// download gets the .info and .zip files of version, unless they are here
+// already.
+func (m *proxyModule) download(ctx context.Context, log *logrus.Entry, version string) error {
+	if _, err := os.Stat(m.zipFile(version)); err == nil {
+		return nil
+	}
+	for _, ext := range []string{".info", ".zip"} {
+		b, err := proxyGet(ctx, log, m.url("@v/"+escapeModulePath(version)+ext))
+		if err != nil {
+			return fmt.Errorf("could not download '%s' of '%s': %s", version+ext, m.module, err)
+		}
+		if err := writeFileAtomic(filepath.Join(m.meta, version+ext), b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extract replaces the files of m.root with the ones of version.
+func (m *proxyModule) extract(version string) error {
+	r, err := zip.OpenReader(m.zipFile(version))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	files, err := ioutil.ReadDir(m.root)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.Name() != proxyMetaDir {
+			if err := os.RemoveAll(filepath.Join(m.root, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	prefix := m.module + "@" + version + "/"
+	for _, f := range r.File {
+		name := strings.TrimPrefix(f.Name, prefix)
+		if name == f.Name || path.Clean(name) == ".." || strings.HasPrefix(path.Clean(name), "../") || path.IsAbs(name) {
+			return fmt.Errorf("unexpected file '%s' in the zip of '%s'", f.Name, version)
+		}
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		target := filepath.Join(m.root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := extractFile(f, target); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(filepath.Join(m.meta, "current"), []byte(version), 0644)
+}
+
+func extractFile(f *zip.File, target string) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	mode := f.Mode().Perm()
+	if mode == 0 {
+		mode = 0644
+	}
+	fp, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fp, rc); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+func (proxyVCS) Name() string    { return "proxy" }
+func (proxyVCS) MetaDir() string { return proxyMetaDir }
+
+// Clone sets up dir for the module at url: the proxy URL and the module
+// path, unescaped.
+func (p proxyVCS) Clone(ctx context.Context, log *logrus.Entry, dir, repo, url string) error {
+	if _, err := os.Stat(filepath.Join(dir, proxyMetaDir)); err == nil {
+		return nil
+	}
+	if !strings.HasPrefix(url, proxyURL+"/") {
+		return fmt.Errorf("'%s' is not a module of proxy '%s'", url, proxyURL)
+	}
+	meta := filepath.Join(dir, proxyMetaDir)
+	if err := os.MkdirAll(meta, 0755); err != nil {
+		return err
+	}
+	for name, content := range map[string]string{"module": strings.TrimPrefix(url, proxyURL+"/"), "proxy": proxyURL} {
+		if err := ioutil.WriteFile(filepath.Join(meta, name), []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	return p.Fetch(ctx, log, dir, repo)
+}
+
+func (proxyVCS) Fetch(ctx context.Context, log *logrus.Entry, dir, url string) error {
+	m, err := openProxyModule(dir)
+	if err != nil {
+		return err
+	}
+	log.Infof("Fetching the versions of '%s' from '%s'", m.module, m.proxy)
+	b, err := proxyGet(ctx, log, m.url("@v/list"))
+	if err != nil {
+		return fmt.Errorf("could not fetch: %s", err)
+	}
+	return writeFileAtomic(filepath.Join(m.meta, "list"), b)
+}
+
+func (proxyVCS) IsBranch(dir, url, rev string) (bool, error) {
+	return rev == "master", nil
+}
+
+func (proxyVCS) Checkout(ctx context.Context, log *logrus.Entry, dir, url, rev string) error {
+	m, err := openProxyModule(dir)
+	if err != nil {
+		return err
+	}
+	version, err := m.resolve(ctx, log, rev)
+	if err != nil {
+		return err
+	}
+	if version != rev {
+		log.Debugf("'%s' of '%s' is version '%s'", rev, m.module, version)
+	}
+	if err := m.download(ctx, log, version); err != nil {
+		return err
+	}
+	return m.extract(version)
+}
+
+func (proxyVCS) Current(dir string) (string, string, error) {
+	m, err := openProxyModule(dir)
+	if err != nil {
+		return "", "", err
+	}
+	version, err := ioutil.ReadFile(filepath.Join(m.meta, "current"))
+	if err != nil {
+		return "", "", fmt.Errorf("no version of '%s' checked out", m.module)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(m.meta, string(version)+".info"))
+	if err != nil {
+		return "", "", err
+	}
+	var info proxyInfo
+	if err := json.Unmarshal(b, &info); err != nil {
+		return "", "", fmt.Errorf("invalid version info of '%s' at '%s': %s", m.module, version, err)
+	}
+	return string(version), info.Time.Format(time.RFC3339), nil
+}
+
+func (p proxyVCS) Describe(dir string) (string, error) {
+	version, _, err := p.Current(dir)
+	return version, err
+}
+
+func (proxyVCS) Tags(ctx context.Context, log *logrus.Entry, dir string) ([]string, error) {
+	m, err := openProxyModule(dir)
+	if err != nil {
+		return nil, err
+	}
+	list, err := m.list()
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	for _, v := range list {
+		if !semver.IsPseudo(v) {
+			tags = append(tags, strings.TrimSuffix(v, "+incompatible"))
+		}
+	}
+	return tags, nil
+}
+
+func (proxyVCS) TagCommit(dir, tag string) (string, bool) {
+	m, err := openProxyModule(dir)
+	if err != nil {
+		return "", false
+	}
+	list, _ := m.list()
+	for _, v := range list {
+		if (v == tag || v == tag+"+incompatible") && !semver.IsPseudo(v) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+func (proxyVCS) HasCommit(dir, commit string) bool {
+	m, err := openProxyModule(dir)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(m.zipFile(commit))
+	return err == nil
+}
+
+func (proxyVCS) Root(dir string) (string, error) {
+	m, err := openProxyModule(dir)
+	if err != nil {
+		return "", err
+	}
+	return m.root, nil
+}
+
+// RemoteURL is "" for modules of another proxy than the current one, for
+// them to be downloaded again.
+func (proxyVCS) RemoteURL(dir, url string) string {
+	m, err := openProxyModule(dir)
+	if err != nil || m.proxy != proxyURL {
+		return ""
+	}
+	return m.proxy + "/" + m.module
+}
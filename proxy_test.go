@@ -0,0 +1,130 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mountkin/trash/conf"
+	"github.com/stretchr/testify/require"
+)
+
+// writeProxy lays out a file based module proxy in dir, serving module at
+// versions. Every version has a file saying which version it is.
+func writeProxy(t *testing.T, dir, module string, versions ...string) {
+	assert := require.New(t)
+	vDir := filepath.Join(dir, escapeModulePath(module), "@v")
+	assert.NoError(os.MkdirAll(vDir, 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(vDir, "list"), []byte(strings.Join(versions, "\n")+"\n"), 0644))
+	for k, v := range versions {
+		info := fmt.Sprintf(`{"Version":"%s","Time":"2020-01-0%dT03:04:05Z"}`, v, k+1)
+		assert.NoError(ioutil.WriteFile(filepath.Join(vDir, v+".info"), []byte(info), 0644))
+		fp, err := os.Create(filepath.Join(vDir, v+".zip"))
+		assert.NoError(err)
+		w := zip.NewWriter(fp)
+		for name, content := range map[string]string{"version.go": "package foo // " + v, "sub/sub.go": "package sub"} {
+			f, err := w.Create(module + "@" + v + "/" + name)
+			assert.NoError(err)
+			_, err = f.Write([]byte(content))
+			assert.NoError(err)
+		}
+		assert.NoError(w.Close())
+		assert.NoError(fp.Close())
+	}
+}
+
+func TestProxyVCS(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "trash-proxy")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	defer func() { proxyURL = "" }()
+
+	pseudo := "v1.1.1-0.20200103030405-abcdef123456"
+	writeProxy(t, filepath.Join(dir, "proxy"), "example.com/Foo", "v1.0.0", "v1.1.0", pseudo)
+	proxyURL = "file://" + filepath.Join(dir, "proxy")
+
+	module, err := findModule(ctx, stdLog, "example.com/Foo/sub")
+	assert.NoError(err)
+	assert.Equal("example.com/Foo", module)
+	_, err = findModule(ctx, stdLog, "example.com/bar")
+	assert.Error(err)
+
+	v := proxyVCS{}
+	repoDir := filepath.Join(dir, "src", "example.com", "Foo")
+	assert.NoError(v.Clone(ctx, stdLog, repoDir, "", proxyURL+"/example.com/Foo"))
+	found, _, ok := detectVCS(filepath.Join(repoDir, "sub"), filepath.Join(dir, "src"))
+	assert.True(ok)
+	assert.Equal("proxy", found.Name())
+
+	tags, err := v.Tags(ctx, stdLog, repoDir)
+	assert.NoError(err)
+	assert.Equal([]string{"v1.0.0", "v1.1.0"}, tags)
+
+	version := func() string {
+		b, err := ioutil.ReadFile(filepath.Join(repoDir, "version.go"))
+		assert.NoError(err)
+		return strings.TrimPrefix(string(b), "package foo // ")
+	}
+	assert.NoError(v.Checkout(ctx, stdLog, repoDir, "", "v1.0.0"))
+	assert.Equal("v1.0.0", version())
+	current, date, err := v.Current(filepath.Join(repoDir, "sub"))
+	assert.NoError(err)
+	assert.Equal("v1.0.0", current)
+	assert.Equal("2020-01-01T03:04:05Z", date)
+
+	// commits map to their pseudo-versions
+	assert.NoError(v.Checkout(ctx, stdLog, repoDir, "", "abcdef1234"))
+	assert.Equal(pseudo, version())
+	described, err := v.Describe(repoDir)
+	assert.NoError(err)
+	assert.Equal(pseudo, described)
+
+	assert.NoError(v.Checkout(ctx, stdLog, repoDir, "", "master"))
+	assert.Equal("v1.1.0", version())
+	assert.Error(v.Checkout(ctx, stdLog, repoDir, "", "v2.0.0"))
+
+	commit, ok := v.TagCommit(repoDir, "v1.1.0")
+	assert.True(ok)
+	assert.Equal("v1.1.0", commit)
+	_, ok = v.TagCommit(repoDir, pseudo)
+	assert.False(ok)
+	assert.True(v.HasCommit(repoDir, "v1.0.0"))
+	assert.False(v.HasCommit(repoDir, "v2.0.0"))
+	root, err := v.Root(filepath.Join(repoDir, "sub"))
+	assert.NoError(err)
+	assert.Equal(repoDir, root)
+	assert.Equal(proxyURL+"/example.com/Foo", v.RemoteURL(repoDir, ""))
+}
+
+func TestProxyImport(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "trash-proxy")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	defer func() { proxyURL = "" }()
+
+	writeProxy(t, filepath.Join(dir, "proxy"), "example.com/foo", "v1.0.0", "v1.1.0")
+	proxyURL = "file://" + filepath.Join(dir, "proxy")
+	trashDir := filepath.Join(dir, "cache")
+
+	i := conf.Import{Package: "example.com/foo/sub", Version: "^1.0"}
+	assert.NoError(checkoutImport(ctx, stdLog, trashDir, i))
+	li, err := lockImport(trashDir, i)
+	assert.NoError(err)
+	assert.Equal("v1.1.0", li.Commit)
+	assert.Equal(proxyURL+"/example.com/foo", li.Repo)
+
+	vendorDir := filepath.Join(dir, "vendor")
+	assert.NoError(cpy(vendorDir, trashDir, i))
+	b, err := ioutil.ReadFile(filepath.Join(vendorDir, "example.com/foo/sub/sub.go"))
+	assert.NoError(err)
+	assert.Equal("package sub", string(b))
+}
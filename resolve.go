@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// repoRoot tells where the code of the import paths under Root lives.
+type repoRoot struct {
+	Root string    `json:"root"` // import path of the root of the repo
+	VCS  string    `json:"vcs"`
+	Repo string    `json:"repo"` // URL to clone
+	Time time.Time `json:"time"` // when it was discovered
+}
+
+// hostRule resolves the import paths of a known code host without asking
+// it: the first submatch of re is the root, and the vcs named group, if
+// any, the VCS.
+type hostRule struct {
+	prefix string
+	re     *regexp.Regexp
+	vcs    string
+}
+
+// hostRules mirror the ones of `go get`.
+var hostRules = []hostRule{
+	{"github.com/", regexp.MustCompile(`^(github\.com/[A-Za-z0-9_.\-]+/[A-Za-z0-9_.\-]+)(/[\p{L}0-9_.\-]+)*$`), "git"},
+	{"bitbucket.org/", regexp.MustCompile(`^(bitbucket\.org/[A-Za-z0-9_.\-]+/[A-Za-z0-9_.\-]+)(/[A-Za-z0-9_.\-]+)*$`), "git"},
+	{"gopkg.in/", regexp.MustCompile(`^(gopkg\.in/(?:[A-Za-z0-9_\-]+/)?[A-Za-z0-9_\-]+(?:\.[A-Za-z0-9_\-]+)*\.v[0-9]+(?:-unstable)?)(/[A-Za-z0-9_.\-]+)*$`), "git"},
+	{"hub.jazz.net/git/", regexp.MustCompile(`^(hub\.jazz\.net/git/[a-z0-9]+/[A-Za-z0-9_.\-]+)(/[A-Za-z0-9_.\-]+)*$`), "git"},
+	{"git.apache.org/", regexp.MustCompile(`^(git\.apache\.org/[a-z0-9_.\-]+\.git)(/[A-Za-z0-9_.\-]+)*$`), "git"},
+	{"git.openstack.org/", regexp.MustCompile(`^(git\.openstack\.org/[A-Za-z0-9_.\-]+/[A-Za-z0-9_.\-]+)(\.git)?(/[A-Za-z0-9_.\-]+)*$`), "git"},
+	{"launchpad.net/", regexp.MustCompile(`^(launchpad\.net/(?:[A-Za-z0-9_.\-]+(?:/[A-Za-z0-9_.\-]+)?|~[A-Za-z0-9_.\-]+/(?:\+junk|[A-Za-z0-9_.\-]+)/[A-Za-z0-9_.\-]+))(/[A-Za-z0-9_.\-]+)*$`), "bzr"},
+	// any host, the VCS being given away by the root: example.com/repo.git/pkg
+	{"", regexp.MustCompile(`^((?:[a-z0-9.\-]+\.)+[a-z0-9.\-]+(?::[0-9]+)?(?:/~?[A-Za-z0-9_.\-]+)+?\.(?P<vcs>bzr|git|hg|svn))(/~?[A-Za-z0-9_.\-]+)*$`), ""},
+}
+
+// matchHost resolves path with hostRules. ok is false if no rule applies,
+// err is set if one does but path is invalid for it.
+func matchHost(path string) (r repoRoot, ok bool, err error) {
+	for _, h := range hostRules {
+		if !strings.HasPrefix(path, h.prefix) {
+			continue
+		}
+		m := h.re.FindStringSubmatch(path)
+		if m == nil {
+			if h.prefix == "" {
+				continue
+			}
+			return repoRoot{}, true, fmt.Errorf("invalid import path for %s: '%s'", strings.TrimSuffix(h.prefix, "/"), path)
+		}
+		r = repoRoot{Root: m[1], VCS: h.vcs, Repo: "https://" + m[1]}
+		for k, name := range h.re.SubexpNames() {
+			if name == "vcs" {
+				r.VCS = m[k]
+			}
+		}
+		return r, true, nil
+	}
+	return repoRoot{}, false, nil
+}
+
+// resolver finds the repos of import paths, from hostRules or the go-import
+// meta tags served by their hosts. It remembers what the hosts said in its
+// file for rootsTTL.
+type resolver struct {
+	client *http.Client
+	file   string
+
+	mu     sync.Mutex
+	roots  []repoRoot
+	loaded bool
+}
+
+const rootsTTL = 24 * time.Hour
+
+var (
+	resolversMu sync.Mutex
+	resolvers   = map[string]*resolver{}
+)
+
+// resolverFor returns the resolver of the cache in trashDir.
+func resolverFor(trashDir string) *resolver {
+	resolversMu.Lock()
+	defer resolversMu.Unlock()
+	if r, ok := resolvers[trashDir]; ok {
+		return r
+	}
+	r := &resolver{
+		client: &http.Client{Timeout: 30 * time.Second},
+		file:   filepath.Join(trashDir, "import-paths.json"),
+	}
+	resolvers[trashDir] = r
+	return r
+}
+
+// resolve returns the repo root of the import path. Hosts are asked over
+// HTTPS, falling back to HTTP for the insecure ones.
+func (r *resolver) resolve(ctx context.Context, log *logrus.Entry, path string) (repoRoot, error) {
+	if root, ok, err := matchHost(path); ok {
+		return root, err
+	}
+	if root, ok := r.cached(path); ok {
+		log.Debugf("'%s' is in repo '%s' (%s), cached", path, root.Repo, root.VCS)
+		return root, nil
+	}
+
+	log.Infof("Looking up the repo of '%s'", path)
+	root, err := r.discover(ctx, log, path, "https")
+	if err != nil && isInsecure(strings.SplitN(path, "/", 2)[0]) {
+		log.Debugf("HTTPS lookup of '%s' failed: %s", path, err)
+		root, err = r.discover(ctx, log, path, "http")
+	}
+	if err != nil {
+		return repoRoot{}, fmt.Errorf("could not find the repo of '%s': %s", path, err)
+	}
+	log.Infof("'%s' is in repo '%s' (%s)", path, root.Repo, root.VCS)
+	r.remember(root)
+	return root, nil
+}
+
+func (r *resolver) cached(path string) (repoRoot, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.load()
+	for _, root := range r.roots {
+		if (path == root.Root || strings.HasPrefix(path, root.Root+"/")) && time.Since(root.Time) < rootsTTL && root.check() == nil {
+			return root, true
+		}
+	}
+	return repoRoot{}, false
+}
+
+// load reads the file of r, once. Callers hold r.mu.
+func (r *resolver) load() {
+	if r.loaded || r.file == "" {
+		return
+	}
+	r.loaded = true
+	b, err := ioutil.ReadFile(r.file)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(b, &r.roots); err != nil {
+		logrus.Warnf("Ignoring '%s': %s", r.file, err)
+		r.roots = nil
+	}
+}
+
+func (r *resolver) remember(root repoRoot) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.load()
+	roots := []repoRoot{root}
+	for _, old := range r.roots {
+		if old.Root != root.Root && time.Since(old.Time) < rootsTTL {
+			roots = append(roots, old)
+		}
+	}
+	r.roots = roots
+	if r.file == "" {
+		return
+	}
+	b, err := json.MarshalIndent(r.roots, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(r.file, b)
+	}
+	if err != nil {
+		logrus.Warnf("Could not save the repos of import paths to '%s': %s", r.file, err)
+	}
+}
+
+// discover asks the host of path for its go-import meta tags.
+func (r *resolver) discover(ctx context.Context, log *logrus.Entry, path, scheme string) (repoRoot, error) {
+	url := scheme + "://" + path + "?go-get=1"
+	var metas []repoRoot
+	err := retry(ctx, log, "GET "+url, func(ctx context.Context) error {
+		resp, err := httpGet(ctx, r.client, url)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if metas, err = parseMetaGoImports(resp.Body); err != nil {
+			return permanent(fmt.Errorf("GET %s: %s", url, err))
+		}
+		return nil
+	})
+	if err == errNotFound {
+		return repoRoot{}, fmt.Errorf("GET %s: not found", url)
+	} else if err != nil {
+		return repoRoot{}, err
+	}
+
+	var found []repoRoot
+	for _, m := range metas {
+		if (path == m.Root || strings.HasPrefix(path, m.Root+"/")) && m.VCS != "mod" {
+			found = append(found, m)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return repoRoot{}, fmt.Errorf("GET %s: no go-import meta tag for a repo of '%s'", url, path)
+	case 1:
+		if err := found[0].check(); err != nil {
+			return repoRoot{}, fmt.Errorf("GET %s: %s", url, err)
+		}
+		found[0].Time = time.Now().UTC()
+		return found[0], nil
+	}
+	return repoRoot{}, fmt.Errorf("GET %s: several go-import meta tags match '%s'", url, path)
+}
+
+// metaVCSs are the VCSs go-import meta tags may name: not the ones of trash
+// only, proxy and archive.
+var metaVCSs = []string{"git", "hg", "svn", "bzr"}
+
+// check refuses the repo roots hosts are not to give: the ones of other
+// VCSs, and the ones whose repo is not a URL trash may fetch from, e.g. a
+// local path, or one a VCS would take for an option.
+func (r repoRoot) check() error {
+	if !contains(metaVCSs, r.VCS) {
+		return fmt.Errorf("unknown vcs '%s', expected one of %s", r.VCS, strings.Join(metaVCSs, ", "))
+	}
+	if u, err := url.Parse(r.Repo); err != nil || !strings.Contains(r.Repo, "://") || u.Scheme == "file" {
+		return fmt.Errorf("repo '%s' is not the URL of a remote repo", r.Repo)
+	}
+	return checkRepoURL(r.Repo)
+}
+
+// parseMetaGoImports returns the go-import meta tags of the HTML page in
+// body, up to its <body>.
+func parseMetaGoImports(body io.Reader) ([]repoRoot, error) {
+	d := xml.NewDecoder(body)
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		if strings.ToLower(charset) == "ascii" || strings.ToLower(charset) == "utf-8" {
+			return input, nil
+		}
+		return nil, fmt.Errorf("can't decode XML document using charset %q", charset)
+	}
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	var roots []repoRoot
+	for {
+		t, err := d.RawToken()
+		if err != nil {
+			if err == io.EOF || len(roots) > 0 {
+				return roots, nil
+			}
+			return nil, err
+		}
+		if e, ok := t.(xml.StartElement); ok && strings.EqualFold(e.Name.Local, "body") {
+			return roots, nil
+		}
+		if e, ok := t.(xml.EndElement); ok && strings.EqualFold(e.Name.Local, "head") {
+			return roots, nil
+		}
+		e, ok := t.(xml.StartElement)
+		if !ok || !strings.EqualFold(e.Name.Local, "meta") || attrValue(e.Attr, "name") != "go-import" {
+			continue
+		}
+		if f := strings.Fields(attrValue(e.Attr, "content")); len(f) == 3 {
+			roots = append(roots, repoRoot{Root: f[0], VCS: f[1], Repo: f[2]})
+		}
+	}
+}
+
+func attrValue(attrs []xml.Attr, name string) string {
+	for _, a := range attrs {
+		if strings.EqualFold(a.Name.Local, name) {
+			return a.Value
+		}
+	}
+	return ""
+}
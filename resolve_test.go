@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchHost(t *testing.T) {
+	assert := require.New(t)
+	testData := []struct {
+		path, root, vcs, repo string
+	}{
+		{"github.com/urfave/cli", "github.com/urfave/cli", "git", "https://github.com/urfave/cli"},
+		{"github.com/Sirupsen/logrus/hooks/syslog", "github.com/Sirupsen/logrus", "git", "https://github.com/Sirupsen/logrus"},
+		{"bitbucket.org/ww/goautoneg", "bitbucket.org/ww/goautoneg", "git", "https://bitbucket.org/ww/goautoneg"},
+		{"gopkg.in/yaml.v2", "gopkg.in/yaml.v2", "git", "https://gopkg.in/yaml.v2"},
+		{"gopkg.in/inconshreveable/log15.v2/term", "gopkg.in/inconshreveable/log15.v2", "git", "https://gopkg.in/inconshreveable/log15.v2"},
+		{"launchpad.net/gocheck", "launchpad.net/gocheck", "bzr", "https://launchpad.net/gocheck"},
+		{"example.com/repo.hg/sub", "example.com/repo.hg", "hg", "https://example.com/repo.hg"},
+	}
+	for _, d := range testData {
+		r, ok, err := matchHost(d.path)
+		assert.True(ok, d.path)
+		assert.NoError(err, d.path)
+		assert.Equal(d.root, r.Root, d.path)
+		assert.Equal(d.vcs, r.VCS, d.path)
+		assert.Equal(d.repo, r.Repo, d.path)
+	}
+
+	_, ok, err := matchHost("github.com/urfave")
+	assert.True(ok)
+	assert.Error(err)
+	_, ok, _ = matchHost("golang.org/x/net/context")
+	assert.False(ok)
+}
+
+func TestParseMetaGoImports(t *testing.T) {
+	assert := require.New(t)
+	page := `<!DOCTYPE html>
+<html>
+<head>
+<meta http-equiv="Content-Type" content="text/html; charset=utf-8">
+<meta name="go-import" content="golang.org/x/net git https://go.googlesource.com/net">
+<meta name="go-import" content="golang.org/x/net mod https://proxy.golang.org">
+<meta name="go-source" content="golang.org/x/net https://github.com/golang/net/ https://github.com/golang/net/tree/master{/dir}">
+</head>
+<body>
+<meta name="go-import" content="golang.org/x/other git https://example.com/other">
+</body>
+</html>`
+	roots, err := parseMetaGoImports(strings.NewReader(page))
+	assert.NoError(err)
+	assert.Equal([]repoRoot{
+		{Root: "golang.org/x/net", VCS: "git", Repo: "https://go.googlesource.com/net"},
+		{Root: "golang.org/x/net", VCS: "mod", Repo: "https://proxy.golang.org"},
+	}, roots)
+}
+
+func TestResolver(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "trash-resolve")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	var hits int32
+	var host string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		assert.Equal("1", r.URL.Query().Get("go-get"))
+		if !strings.HasPrefix(r.URL.Path, "/x/repo") {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `<html><head><meta name="go-import" content="%s/x/repo hg https://example.com/repo"></head></html>`, host)
+	}))
+	defer srv.Close()
+	host = strings.TrimPrefix(srv.URL, "https://")
+
+	file := filepath.Join(dir, "import-paths.json")
+	r := &resolver{client: srv.Client(), file: file}
+	root, err := r.resolve(ctx, stdLog, host+"/x/repo/sub/pkg")
+	assert.NoError(err)
+	assert.Equal(host+"/x/repo", root.Root)
+	assert.Equal("hg", root.VCS)
+	assert.Equal("https://example.com/repo", root.Repo)
+	assert.EqualValues(1, hits)
+
+	// other packages of the same repo come from the cache, even across runs
+	_, err = r.resolve(ctx, stdLog, host+"/x/repo/other")
+	assert.NoError(err)
+	r = &resolver{client: srv.Client(), file: file}
+	root, err = r.resolve(ctx, stdLog, host+"/x/repo")
+	assert.NoError(err)
+	assert.Equal(host+"/x/repo", root.Root)
+	assert.EqualValues(1, hits)
+
+	_, err = r.resolve(ctx, stdLog, host+"/x/missing")
+	assert.Error(err)
+	assert.EqualValues(2, hits)
+}
+
+func TestResolverInsecure(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+	var host string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<meta name="go-import" content="%s/repo git http://%s/repo.git">`, host, host)
+	}))
+	defer srv.Close()
+	host = strings.TrimPrefix(srv.URL, "http://")
+
+	r := &resolver{client: srv.Client()}
+	_, err := r.resolve(ctx, stdLog, host+"/repo")
+	assert.Error(err)
+	insecureHosts = []string{strings.Split(host, ":")[0]}
+	defer func() { insecureHosts = nil }()
+	root, err := r.resolve(ctx, stdLog, host+"/repo")
+	assert.NoError(err)
+	assert.Equal("git", root.VCS)
+	assert.Equal("http://"+host+"/repo.git", root.Repo)
+}
+
+func TestResolverRejects(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+	defer func() { allowFile = true }()
+	allowFile = false
+
+	metas := map[string]string{
+		"/proxy":   "proxy https://proxy.golang.org",
+		"/archive": "archive https://example.com/repo.tar.gz",
+		"/option":  "hg --config=hooks.pre-clone=touch%20/tmp/pwned",
+		"/ssh":     "git ssh://-oProxyCommand=touch%20/tmp/pwned/repo",
+		"/local":   "git /tmp/repo",
+		"/file":    "git file:///tmp/repo",
+		"/ok":      "git https://example.com/repo",
+	}
+	var host string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<meta name="go-import" content="%s%s %s">`, host, r.URL.Path, metas[r.URL.Path])
+	}))
+	defer srv.Close()
+	host = strings.TrimPrefix(srv.URL, "https://")
+
+	r := &resolver{client: srv.Client()}
+	for path := range metas {
+		_, err := r.resolve(ctx, stdLog, host+path)
+		if path == "/ok" {
+			assert.NoError(err)
+		} else {
+			assert.Error(err, path)
+		}
+	}
+}
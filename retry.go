@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Network operations (fetches, clones, lookups and downloads) are attempted
+// netRetries+1 times, each for at most netTimeout, waiting retryBackoff
+// before the first retry and twice as long before each of the next ones.
+var (
+	netTimeout   = 5 * time.Minute // --net-timeout
+	netRetries   = 3               // --retries
+	retryBackoff = time.Second
+)
+
+// permanentError is the error of a network operation not worth retrying,
+// e.g. a missing file.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+// permanent keeps retry from retrying the operation that failed with err.
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err}
+}
+
+// retry runs op, a network operation (what tells what it does), until it
+// succeeds, is canceled with ctx, fails with a permanent error (returned as
+// it is) or has been attempted netRetries+1 times. The error of the last
+// attempt then says how many were made.
+func retry(ctx context.Context, log *logrus.Entry, what string, op func(ctx context.Context) error) error {
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		opCtx, cancel := context.WithTimeout(ctx, netTimeout)
+		err := op(opCtx)
+		timedOut := opCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if p, ok := err.(permanentError); ok {
+			return p.err
+		}
+		if timedOut {
+			err = fmt.Errorf("timed out after %s (see --net-timeout): %s", netTimeout, err)
+		}
+		if attempt > netRetries || ctx.Err() != nil {
+			return fmt.Errorf("%d attempt(s) failed, the last one with: %s", attempt, err)
+		}
+		log.Debug(err)
+		log.Warnf("Could not %s (attempt %d of %d): retrying in %s", what, attempt, netRetries+1, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fmt.Errorf("%d attempt(s) failed, the last one with: %s", attempt, err)
+		}
+		backoff *= 2
+	}
+}
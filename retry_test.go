@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetry(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+	defer func(timeout time.Duration) { netTimeout = timeout }(netTimeout)
+
+	attempts := 0
+	assert.NoError(retry(ctx, stdLog, "fail twice", func(ctx context.Context) error {
+		if attempts++; attempts < 3 {
+			return errors.New("transient")
+		}
+		return nil
+	}))
+	assert.Equal(3, attempts)
+
+	attempts = 0
+	err := retry(ctx, stdLog, "fail", func(ctx context.Context) error {
+		attempts++
+		return errors.New("transient")
+	})
+	assert.Equal(netRetries+1, attempts)
+	assert.EqualError(err, fmt.Sprintf("%d attempt(s) failed, the last one with: transient", netRetries+1))
+
+	attempts = 0
+	err = retry(ctx, stdLog, "fail for good", func(ctx context.Context) error {
+		attempts++
+		return permanent(errNotFound)
+	})
+	assert.Equal(1, attempts)
+	assert.Equal(errNotFound, err)
+
+	// attempts are given netTimeout each, and a done context stops retries
+	netTimeout = 10 * time.Millisecond
+	attempts = 0
+	err = retry(ctx, stdLog, "hang", func(ctx context.Context) error {
+		attempts++
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	assert.Equal(netRetries+1, attempts)
+	assert.Contains(err.Error(), "timed out after 10ms")
+
+	canceled, cancel := context.WithCancel(ctx)
+	attempts = 0
+	err = retry(canceled, stdLog, "cancel", func(ctx context.Context) error {
+		attempts++
+		cancel()
+		return ctx.Err()
+	})
+	assert.Equal(1, attempts)
+	assert.EqualError(err, "1 attempt(s) failed, the last one with: context canceled")
+
+	// the remote of a repo going away fails the listing of its refs
+	netTimeout = time.Minute
+	dir, err := ioutil.TempDir("", "trash-retry")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	defer func() { shallowFetch = false }()
+	upstream := filepath.Join(dir, "upstream")
+	makeUpstream(t, upstream)
+	repoDir := filepath.Join(dir, "src", "example.com", "f")
+	assert.NoError(gitVCS{}.Clone(ctx, stdLog, repoDir, upstream, upstream))
+	assert.NoError(os.Rename(upstream, upstream+".gone"))
+	failed := fmt.Sprintf("%d attempt(s) failed, the last one with: ", netRetries+1)
+	err = fetchRev(ctx, stdLog, repoDir, upstream, "v1.0.0")
+	assert.Error(err)
+	assert.Contains(err.Error(), failed)
+	assert.Contains(err.Error(), "ls-remote")
+	shallowFetch = true
+	_, err = gitVCS{}.Tags(ctx, stdLog, repoDir)
+	assert.Error(err)
+	assert.Contains(err.Error(), failed)
+}
+
+func TestProxyGetRetries(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch n := atomic.AddInt32(&hits, 1); {
+		case r.URL.Path == "/missing":
+			http.NotFound(w, r)
+		case r.URL.Path == "/forbidden":
+			w.WriteHeader(http.StatusForbidden)
+		case n < 3:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			fmt.Fprint(w, "v1.0.0\n")
+		}
+	}))
+	defer srv.Close()
+
+	b, err := proxyGet(ctx, stdLog, srv.URL+"/list")
+	assert.NoError(err)
+	assert.Equal("v1.0.0\n", string(b))
+	assert.EqualValues(3, hits)
+
+	_, err = proxyGet(ctx, stdLog, srv.URL+"/missing")
+	assert.Equal(errNotFound, err)
+	assert.EqualValues(4, hits)
+	_, err = proxyGet(ctx, stdLog, srv.URL+"/forbidden")
+	assert.EqualError(err, "GET "+srv.URL+"/forbidden: 403 Forbidden")
+	assert.EqualValues(5, hits)
+}
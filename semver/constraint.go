@@ -0,0 +1,167 @@
+package semver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Constraint restricts versions, e.g. `^1.2`, `~0.8.3` or `>=1.0 <2`.
+// Comparators separated by spaces or commas must all hold, `||` separates
+// alternatives.
+type Constraint struct {
+	ranges   [][]comparator
+	original string
+}
+
+type comparator struct {
+	op string
+	v  Version
+}
+
+var ops = []string{">=", "<=", "!=", ">", "<", "=", "^", "~"}
+
+// IsConstraint tells constraints apart from plain git refs (tags, commits,
+// branches), which are used as they are.
+func IsConstraint(s string) bool {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return false
+	}
+	return strings.ContainsAny(s[:1], "^~<>=!*") || strings.Contains(s, "||") || strings.ContainsAny(s, " ,")
+}
+
+// ParseConstraint parses a constraint.
+func ParseConstraint(s string) (Constraint, error) {
+	c := Constraint{original: s}
+	for _, alt := range strings.Split(s, "||") {
+		tokens := strings.Fields(strings.Replace(alt, ",", " ", -1))
+		var r []comparator
+		for k := 0; k < len(tokens); k++ {
+			token := tokens[k]
+			// Allow a space between the operator and the version: `>= 1.0`
+			if isOp(token) && k+1 < len(tokens) {
+				k++
+				token += tokens[k]
+			}
+			cs, err := parseComparator(token)
+			if err != nil {
+				return Constraint{}, fmt.Errorf("invalid constraint '%s': %s", s, err)
+			}
+			r = append(r, cs...)
+		}
+		if len(tokens) == 0 {
+			return Constraint{}, fmt.Errorf("invalid constraint '%s': empty alternative", s)
+		}
+		c.ranges = append(c.ranges, r)
+	}
+	return c, nil
+}
+
+func isOp(s string) bool {
+	for _, op := range ops {
+		if s == op {
+			return true
+		}
+	}
+	return false
+}
+
+func parseComparator(s string) ([]comparator, error) {
+	if s == "*" {
+		return nil, nil
+	}
+	op := ""
+	for _, o := range ops {
+		if strings.HasPrefix(s, o) {
+			op = o
+			break
+		}
+	}
+	v, n, err := parse(s[len(op):])
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case "^":
+		// The leftmost non-zero component may not change
+		upper := Version{Major: v.Major + 1}
+		switch {
+		case v.Major == 0 && (v.Minor > 0 || n == 2):
+			upper = Version{Minor: v.Minor + 1}
+		case v.Major == 0 && n == 3:
+			upper = Version{Minor: v.Minor, Patch: v.Patch + 1}
+		}
+		return []comparator{{">=", v}, {"<", upper}}, nil
+	case "~":
+		upper := Version{Major: v.Major, Minor: v.Minor + 1}
+		if n == 1 {
+			upper = Version{Major: v.Major + 1}
+		}
+		return []comparator{{">=", v}, {"<", upper}}, nil
+	case "", "=":
+		// Partial versions match the whole range they denote: `1.2` is `~1.2`
+		switch n {
+		case 1:
+			return []comparator{{">=", v}, {"<", Version{Major: v.Major + 1}}}, nil
+		case 2:
+			return []comparator{{">=", v}, {"<", Version{Major: v.Major, Minor: v.Minor + 1}}}, nil
+		}
+		return []comparator{{"=", v}}, nil
+	}
+	return []comparator{{op, v}}, nil
+}
+
+func (c comparator) check(v Version) bool {
+	cmp := v.Compare(c.v)
+	switch c.op {
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case "<":
+		return cmp < 0
+	case "!=":
+		return cmp != 0
+	}
+	return cmp == 0
+}
+
+// Check tells whether v satisfies c. Pre-releases only do if a comparator
+// of the same range names a pre-release of the same version.
+func (c Constraint) Check(v Version) bool {
+	for _, r := range c.ranges {
+		ok := true
+		preAllowed := v.Pre == ""
+		for _, cmp := range r {
+			if !cmp.check(v) {
+				ok = false
+				break
+			}
+			if cmp.v.Pre != "" && cmp.v.Major == v.Major && cmp.v.Minor == v.Minor && cmp.v.Patch == v.Patch {
+				preAllowed = true
+			}
+		}
+		if ok && preAllowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Best returns the highest of versions satisfying c.
+func (c Constraint) Best(versions []Version) (Version, bool) {
+	var best Version
+	found := false
+	for _, v := range versions {
+		if c.Check(v) && (!found || v.Compare(best) > 0) {
+			best, found = v, true
+		}
+	}
+	return best, found
+}
+
+func (c Constraint) String() string {
+	return c.original
+}
@@ -0,0 +1,161 @@
+// Package semver parses semantic versions (as found in git tags) and the
+// version constraints that can be used instead of a git ref in the config.
+package semver
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Version is a semantic version. Missing minor and patch numbers are 0.
+type Version struct {
+	Major, Minor, Patch int
+	Pre                 string
+	Original            string
+}
+
+// Parse parses a version, with or without the "v" prefix. Build metadata is
+// dropped.
+func Parse(s string) (Version, error) {
+	v, _, err := parse(s)
+	return v, err
+}
+
+// parse also returns the number of version components given (1 to 3).
+func parse(s string) (Version, int, error) {
+	v := Version{Original: s}
+	s = strings.TrimPrefix(s, "v")
+	if plus := strings.Index(s, "+"); plus >= 0 {
+		s = s[:plus]
+	}
+	if dash := strings.Index(s, "-"); dash >= 0 {
+		v.Pre = s[dash+1:]
+		if v.Pre == "" {
+			return Version{}, 0, fmt.Errorf("invalid version '%s': empty pre-release", v.Original)
+		}
+		s = s[:dash]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return Version{}, 0, fmt.Errorf("invalid version '%s': too many components", v.Original)
+	}
+	nums := []*int{&v.Major, &v.Minor, &v.Patch}
+	for k, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return Version{}, 0, fmt.Errorf("invalid version '%s'", v.Original)
+		}
+		*nums[k] = n
+	}
+	return v, len(parts), nil
+}
+
+func (v Version) String() string {
+	if v.Original != "" {
+		return v.Original
+	}
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Pre != "" {
+		s += "-" + v.Pre
+	}
+	return s
+}
+
+// Compare returns -1, 0 or 1 if v is less than, equal to or greater than o.
+func (v Version) Compare(o Version) int {
+	for _, d := range []int{v.Major - o.Major, v.Minor - o.Minor, v.Patch - o.Patch} {
+		if d < 0 {
+			return -1
+		}
+		if d > 0 {
+			return 1
+		}
+	}
+	switch {
+	case v.Pre == o.Pre:
+		return 0
+	case v.Pre == "":
+		return 1
+	case o.Pre == "":
+		return -1
+	}
+	return comparePre(v.Pre, o.Pre)
+}
+
+func comparePre(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for k := 0; k < len(as) && k < len(bs); k++ {
+		an, aErr := strconv.Atoi(as[k])
+		bn, bErr := strconv.Atoi(bs[k])
+		switch {
+		case aErr == nil && bErr == nil:
+			if an != bn {
+				return sign(an - bn)
+			}
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+		default:
+			if c := strings.Compare(as[k], bs[k]); c != 0 {
+				return c
+			}
+		}
+	}
+	return sign(len(as) - len(bs))
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// Sort sorts versions in increasing order.
+func Sort(versions []Version) {
+	sort.Sort(byVersion(versions))
+}
+
+type byVersion []Version
+
+func (s byVersion) Len() int           { return len(s) }
+func (s byVersion) Less(i, j int) bool { return s[i].Compare(s[j]) < 0 }
+func (s byVersion) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Tags parses the tags that are semantic versions, skipping all others, and
+// returns them sorted.
+func Tags(tags []string) []Version {
+	var r []Version
+	for _, tag := range tags {
+		if v, err := Parse(tag); err == nil {
+			r = append(r, v)
+		}
+	}
+	Sort(r)
+	return r
+}
+
+// pseudoVersion matches the versions the go tool makes up for commits, e.g.
+// v0.0.0-20170915032832-14c0d48ead0c. The hash is the submatch.
+var pseudoVersion = regexp.MustCompile(`^v[0-9]+\.(?:0\.0-|[0-9]+\.[0-9]+-(?:[^+]*\.)?0\.)[0-9]{14}-([A-Za-z0-9]+)(?:\+incompatible)?$`)
+
+// IsPseudo tells whether v is a pseudo-version, with or without
+// +incompatible.
+func IsPseudo(v string) bool {
+	return pseudoVersion.MatchString(v)
+}
+
+// PseudoCommit returns the (abbreviated) commit of the pseudo-version v.
+func PseudoCommit(v string) (string, bool) {
+	if m := pseudoVersion.FindStringSubmatch(v); m != nil {
+		return m[1], true
+	}
+	return "", false
+}
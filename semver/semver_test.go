@@ -0,0 +1,96 @@
+package semver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompare(t *testing.T) {
+	assert := require.New(t)
+	ordered := []string{"v0.1.0", "0.9.9", "v1.0.0-alpha", "v1.0.0-alpha.1", "v1.0.0-beta", "v1.0.0-beta.2", "v1.0.0-beta.11", "v1.0.0-rc.1", "v1.0.0", "1.0.1", "v1.10.0", "v2"}
+	for k := 0; k+1 < len(ordered); k++ {
+		a, err := Parse(ordered[k])
+		assert.NoError(err)
+		b, err := Parse(ordered[k+1])
+		assert.NoError(err)
+		assert.Equal(-1, a.Compare(b), "%s < %s", a, b)
+		assert.Equal(1, b.Compare(a), "%s > %s", b, a)
+	}
+
+	for _, bad := range []string{"master", "v1.2.3.4", "1.x", "v1.0.0-", "abc1234"} {
+		_, err := Parse(bad)
+		assert.Error(err, bad)
+	}
+
+	tags := Tags([]string{"v1.1.0", "latest", "v1.0.0", "v0.9.0-rc.1"})
+	assert.Len(tags, 3)
+	assert.Equal("v0.9.0-rc.1", tags[0].String())
+	assert.Equal("v1.1.0", tags[2].String())
+}
+
+func TestConstraint(t *testing.T) {
+	assert := require.New(t)
+	versions := Tags([]string{"v0.8.2", "v0.8.3", "v0.8.9", "v0.9.0", "v1.0.0", "v1.2.0", "v1.2.7", "v1.3.0", "v2.0.0-beta.1", "v2.0.0", "v2.1.0"})
+
+	testData := []struct {
+		constraint string
+		best       string
+	}{
+		{"^1.2", "v1.3.0"},
+		{"~1.2", "v1.2.7"},
+		{"~0.8.3", "v0.8.9"},
+		{"^0.8", "v0.8.9"},
+		{">=1.0 <2", "v1.3.0"},
+		{">= 1.0, < 2", "v1.3.0"},
+		{"<1.0 || >=2.1", "v2.1.0"},
+		{"=1.2.0", "v1.2.0"},
+		{"^2.0.0-beta.1", "v2.1.0"},
+		{">=2.0.0-beta.1 <2.0.0", "v2.0.0-beta.1"},
+		{"*", "v2.1.0"},
+		{"^3", ""},
+	}
+	for _, d := range testData {
+		assert.True(IsConstraint(d.constraint), d.constraint)
+		c, err := ParseConstraint(d.constraint)
+		assert.NoError(err, d.constraint)
+		best, ok := c.Best(versions)
+		if d.best == "" {
+			assert.False(ok, d.constraint)
+			continue
+		}
+		assert.True(ok, d.constraint)
+		assert.Equal(d.best, best.String(), d.constraint)
+	}
+
+	prerelease, _ := Parse("v1.4.0-rc.1")
+	c, _ := ParseConstraint("^1.2")
+	assert.False(c.Check(prerelease))
+
+	for _, ref := range []string{"v1.2.3", "master", "abc1234", ""} {
+		assert.False(IsConstraint(ref), ref)
+	}
+	for _, bad := range []string{"^foo", ">=1.0 ||", "~1.2.3.4"} {
+		_, err := ParseConstraint(bad)
+		assert.Error(err, bad)
+	}
+}
+
+func TestPseudoCommit(t *testing.T) {
+	assert := require.New(t)
+	for v, commit := range map[string]string{
+		"v0.0.0-20170915032832-14c0d48ead0c":                "14c0d48ead0c",
+		"v1.2.4-0.20190412213103-97732733099d":              "97732733099d",
+		"v1.2.3-pre.0.20190412213103-97732733099d":          "97732733099d",
+		"v2.0.1-0.20190412213103-97732733099d+incompatible": "97732733099d",
+	} {
+		c, ok := PseudoCommit(v)
+		assert.True(ok, v)
+		assert.Equal(commit, c, v)
+		assert.True(IsPseudo(v), v)
+	}
+	for _, v := range []string{"v1.2.3", "v2.0.0+incompatible", "v1.0.0-rc.1", "v1.2.3-20190412213103-97732733099d"} {
+		_, ok := PseudoCommit(v)
+		assert.False(ok, v)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mountkin/trash/semver"
+	"github.com/urfave/cli"
+)
+
+// proxyCommand serves the cache as a module proxy.
+func proxyCommand(c *cli.Context) error {
+	trashDir, err := filepath.Abs(c.GlobalString("cache"))
+	if err != nil {
+		return err
+	}
+	addr := c.String("listen")
+	logrus.Infof("Serving '%s' as a module proxy on %s", trashDir, addr)
+	return http.ListenAndServe(addr, &cacheProxy{src: filepath.Join(trashDir, "src")})
+}
+
+// cacheProxy serves the git repos of the cache, and the modules downloaded
+// from proxies, over the GOPROXY protocol. Tags are the versions of the git
+// repos, and any of their commits can be fetched by its pseudo-version.
+// Repos without a go.mod get one naming the module and nothing else.
+type cacheProxy struct {
+	src string
+}
+
+// cachedModule is a module of a git repo of the cache.
+type cachedModule struct {
+	path  string
+	dir   string // root of the repo
+	major int    // major version of the path: 0 for paths without /vN
+}
+
+// modVersion is a version of a cachedModule.
+type modVersion struct {
+	version string // canonical, e.g. v2.0.0+incompatible
+	rev     string // what git knows it as: a tag or a commit
+}
+
+var majorSuffix = regexp.MustCompile(`^(.+)/v([2-9]|[1-9][0-9]+)$`)
+
+func (s *cacheProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	logrus.Infof("%s %s", r.Method, r.URL.Path)
+	b, contentType, err := s.get(strings.TrimPrefix(r.URL.Path, "/"))
+	if err == errNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		logrus.Errorf("%s: %s", r.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(b)
+}
+
+// get returns the file at p (escaped module path, then @v/list, @latest or
+// @v/<version>.<ext>) and its content type.
+func (s *cacheProxy) get(p string) ([]byte, string, error) {
+	var escaped, file string
+	if k := strings.Index(p, "/@v/"); k >= 0 {
+		escaped, file = p[:k], p[k+len("/@v/"):]
+	} else if strings.HasSuffix(p, "/@latest") {
+		escaped, file = strings.TrimSuffix(p, "/@latest"), "@latest"
+	} else {
+		return nil, "", errNotFound
+	}
+	module, ok := unescapeModulePath(escaped)
+	if !ok {
+		return nil, "", errNotFound
+	}
+	if dir := filepath.Join(s.src, filepath.FromSlash(module)); isDir(filepath.Join(dir, proxyMetaDir)) {
+		return s.getDownloaded(dir, file)
+	}
+	m, ok := s.module(module)
+	if !ok {
+		return nil, "", errNotFound
+	}
+
+	if file == "list" {
+		versions, err := m.versions()
+		if err != nil {
+			return nil, "", err
+		}
+		var list []string
+		for _, v := range versions {
+			list = append(list, v.version+"\n")
+		}
+		return []byte(strings.Join(list, "")), "text/plain; charset=UTF-8", nil
+	}
+	if file == "@latest" {
+		file = "latest.info"
+	}
+	ext := filepath.Ext(file)
+	query, ok := unescapeModulePath(strings.TrimSuffix(file, ext))
+	if !ok {
+		return nil, "", errNotFound
+	}
+	v, err := m.resolve(query, ext == ".info")
+	if err != nil {
+		return nil, "", err
+	}
+	switch ext {
+	case ".info":
+		t, err := outputString(git(m.dir, "log", "-1", "--format=%cI", v.rev+"^{commit}"))
+		if err != nil {
+			return nil, "", err
+		}
+		date, err := time.Parse(time.RFC3339, t)
+		if err != nil {
+			return nil, "", err
+		}
+		b, err := json.Marshal(proxyInfo{Version: v.version, Time: date.UTC()})
+		return b, "application/json", err
+	case ".mod":
+		if b, err := output(git(m.dir, "show", v.rev+":go.mod")); err == nil {
+			return b, "text/plain; charset=UTF-8", nil
+		}
+		return []byte(fmt.Sprintf("module %s\n", m.path)), "text/plain; charset=UTF-8", nil
+	case ".zip":
+		b, err := output(git(m.dir, "archive", "--format=zip", "--prefix="+m.path+"@"+v.version+"/", v.rev))
+		return b, "application/zip", err
+	}
+	return nil, "", errNotFound
+}
+
+// getDownloaded serves the files a module downloaded from a proxy has in
+// its metadata dir. The go.mod of a version is the one of its zip.
+func (s *cacheProxy) getDownloaded(dir, file string) ([]byte, string, error) {
+	m, err := openProxyModule(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	name, ok := unescapeModulePath(file)
+	if !ok || strings.Contains(name, "/") || file == "@latest" {
+		return nil, "", errNotFound
+	}
+	if strings.HasSuffix(name, ".mod") {
+		version := strings.TrimSuffix(name, ".mod")
+		r, err := zip.OpenReader(m.zipFile(version))
+		if os.IsNotExist(err) {
+			return nil, "", errNotFound
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		defer r.Close()
+		for _, f := range r.File {
+			if f.Name == m.module+"@"+version+"/go.mod" {
+				rc, err := f.Open()
+				if err != nil {
+					return nil, "", err
+				}
+				defer rc.Close()
+				b, err := ioutil.ReadAll(rc)
+				return b, "text/plain; charset=UTF-8", err
+			}
+		}
+		return []byte(fmt.Sprintf("module %s\n", m.module)), "text/plain; charset=UTF-8", nil
+	}
+	b, err := ioutil.ReadFile(filepath.Join(m.meta, name))
+	if os.IsNotExist(err) {
+		return nil, "", errNotFound
+	}
+	return b, "application/octet-stream", err
+}
+
+// module finds the git repo of the module path: the cache dir of the path,
+// or for paths ending in /vN, the dir of the path without it.
+func (s *cacheProxy) module(path string) (*cachedModule, bool) {
+	if dir := filepath.Join(s.src, filepath.FromSlash(path)); isGitRoot(dir) {
+		return &cachedModule{path: path, dir: dir}, true
+	}
+	if m := majorSuffix.FindStringSubmatch(path); m != nil {
+		if dir := filepath.Join(s.src, filepath.FromSlash(m[1])); isGitRoot(dir) {
+			major, _ := strconv.Atoi(m[2])
+			return &cachedModule{path: path, dir: dir, major: major}, true
+		}
+	}
+	return nil, false
+}
+
+func isDir(dir string) bool {
+	fi, err := os.Stat(dir)
+	return err == nil && fi.IsDir()
+}
+
+func isGitRoot(dir string) bool {
+	return isDir(filepath.Join(dir, ".git"))
+}
+
+// versions returns the tags of m that are versions of its major version,
+// sorted.
+func (m *cachedModule) versions() ([]modVersion, error) {
+	tags, err := outputLines(git(m.dir, "tag", "-l")) // the cache is served as it is
+	if err != nil {
+		return nil, err
+	}
+	var r []modVersion
+	for _, t := range semver.Tags(tags) {
+		version := fmt.Sprintf("v%d.%d.%d", t.Major, t.Minor, t.Patch)
+		if t.Pre != "" {
+			version += "-" + t.Pre
+		}
+		switch {
+		case m.major >= 2 && (t.Major != m.major || m.goModPath(t.Original) != m.path):
+			continue
+		case m.major == 0 && t.Major >= 2:
+			// only modules that predate modules can be +incompatible
+			if runCommand(git(m.dir, "cat-file", "-e", t.Original+":go.mod")) == nil {
+				continue
+			}
+			version += "+incompatible"
+		}
+		r = append(r, modVersion{version: version, rev: t.Original})
+	}
+	return r, nil
+}
+
+// goModPath returns the module path the go.mod of m at rev declares, if any.
+func (m *cachedModule) goModPath(rev string) string {
+	b, err := output(git(m.dir, "show", rev+":go.mod"))
+	if err != nil {
+		return ""
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		if f := strings.Fields(l); len(f) >= 2 && f[0] == "module" {
+			return strings.Trim(f[1], `"`)
+		}
+	}
+	return ""
+}
+
+// resolve finds the version query stands for: a version of m, a pseudo-
+// version, or, if anyRev is set, whatever git can resolve to a commit
+// ("latest" being the latest version, or else the checked out commit).
+func (m *cachedModule) resolve(query string, anyRev bool) (modVersion, error) {
+	versions, err := m.versions()
+	if err != nil {
+		return modVersion{}, err
+	}
+	for _, v := range versions {
+		if v.version == query {
+			return v, nil
+		}
+	}
+	if c, ok := semver.PseudoCommit(query); ok {
+		v, err := m.pseudoVersion(c)
+		if err != nil || v.version != query {
+			return modVersion{}, errNotFound
+		}
+		return v, nil
+	}
+	if !anyRev {
+		return modVersion{}, errNotFound
+	}
+	if query == "latest" {
+		for k := len(versions) - 1; k >= 0; k-- {
+			if !strings.Contains(versions[k].version, "-") {
+				return versions[k], nil
+			}
+		}
+		query = "HEAD"
+	}
+	commit, err := outputString(git(m.dir, "rev-parse", "-q", "--verify", query+"^{commit}"))
+	if err != nil {
+		// branches of the cache only exist as remote branches
+		commits, err := outputLines(git(m.dir, "for-each-ref", "--format=%(objectname)", "refs/remotes/*/"+query))
+		if err != nil || len(commits) == 0 {
+			return modVersion{}, errNotFound
+		}
+		commit = commits[0]
+	}
+	for _, v := range versions {
+		if c, ok := (gitVCS{}).TagCommit(m.dir, v.rev); ok && c == commit {
+			return v, nil
+		}
+	}
+	return m.pseudoVersion(commit)
+}
+
+// pseudoVersion makes up the pseudo-version of rev, based on the latest
+// version of m it descends from, the way the go tool does.
+func (m *cachedModule) pseudoVersion(rev string) (modVersion, error) {
+	out, err := outputString(git(m.dir, "log", "-1", "--format=%H %ct", rev+"^{commit}"))
+	if err != nil {
+		return modVersion{}, errNotFound
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return modVersion{}, fmt.Errorf("unexpected `git log` output: %s", out)
+	}
+	secs, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return modVersion{}, err
+	}
+	if m.major >= 2 && m.goModPath(fields[0]) != m.path {
+		return modVersion{}, errNotFound
+	}
+	suffix := time.Unix(secs, 0).UTC().Format("20060102150405") + "-" + fields[0][:12]
+
+	versions, err := m.versions()
+	if err != nil {
+		return modVersion{}, err
+	}
+	major := m.major
+	for k := len(versions) - 1; k >= 0; k-- {
+		v := versions[k]
+		if runCommand(git(m.dir, "merge-base", "--is-ancestor", v.rev, fields[0])) != nil {
+			continue
+		}
+		base := strings.TrimSuffix(v.version, "+incompatible")
+		incompatible := strings.TrimPrefix(v.version, base)
+		if sv, _ := semver.Parse(base); sv.Pre == "" {
+			base = fmt.Sprintf("v%d.%d.%d-0", sv.Major, sv.Minor, sv.Patch+1)
+		} else {
+			base += ".0"
+		}
+		return modVersion{version: base + "." + suffix + incompatible, rev: fields[0]}, nil
+	}
+	return modVersion{version: fmt.Sprintf("v%d.0.0-%s", major, suffix), rev: fields[0]}, nil
+}
+
+// unescapeModulePath undoes escapeModulePath. It fails on upper case
+// letters, which escaped paths cannot have.
+func unescapeModulePath(p string) (string, bool) {
+	var b []rune
+	bang := false
+	for _, r := range p {
+		switch {
+		case bang:
+			if r < 'a' || r > 'z' {
+				return "", false
+			}
+			b = append(b, r-'a'+'A')
+			bang = false
+		case r == '!':
+			bang = true
+		case r >= 'A' && r <= 'Z':
+			return "", false
+		default:
+			b = append(b, r)
+		}
+	}
+	return string(b), !bang && !strings.Contains(p, "..")
+}
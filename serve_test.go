@@ -0,0 +1,121 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnescapeModulePath(t *testing.T) {
+	assert := require.New(t)
+	for _, p := range []string{"github.com/Sirupsen/logrus", "example.com/a/v2"} {
+		u, ok := unescapeModulePath(escapeModulePath(p))
+		assert.True(ok)
+		assert.Equal(p, u)
+	}
+	for _, p := range []string{"github.com/Sirupsen/logrus", "example.com/!", "example.com/!1", "example.com/../a"} {
+		_, ok := unescapeModulePath(p)
+		assert.False(ok, p)
+	}
+}
+
+func TestCacheProxy(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "trash-serve")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	defer func() { proxyURL = "" }()
+
+	repo := filepath.Join(dir, "cache", "src", "example.com", "foo")
+	assert.NoError(os.MkdirAll(repo, 0755))
+	run := func(args ...string) {
+		_, err := combinedOutput(git(repo, append([]string{"-c", "user.name=t", "-c", "user.email=t@example.com"}, args...)...))
+		assert.NoError(err, "%v", args)
+	}
+	commit := func(msg string) {
+		assert.NoError(ioutil.WriteFile(filepath.Join(repo, "foo.go"), []byte("package foo // "+msg+"\n"), 0644))
+		run("add", "-A")
+		run("commit", "-q", "-m", msg)
+	}
+	run("init", "-q")
+	commit("one")
+	run("tag", "v1.0.0")
+	commit("two")
+	run("tag", "v2.0.0")
+	commit("three")
+	head, _, err := gitVCS{}.Current(repo)
+	assert.NoError(err)
+
+	srv := httptest.NewServer(&cacheProxy{src: filepath.Join(dir, "cache", "src")})
+	defer srv.Close()
+	get := func(p string) (int, []byte) {
+		resp, err := http.Get(srv.URL + "/" + p)
+		assert.NoError(err)
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(err)
+		return resp.StatusCode, b
+	}
+
+	code, b := get("example.com/foo/@v/list")
+	assert.Equal(http.StatusOK, code)
+	assert.Equal("v1.0.0\nv2.0.0+incompatible\n", string(b))
+	code, b = get("example.com/foo/@v/v1.0.0.mod")
+	assert.Equal(http.StatusOK, code)
+	assert.Equal("module example.com/foo\n", string(b))
+
+	// commits are served at their pseudo-versions
+	code, b = get("example.com/foo/@v/" + head[:12] + ".info")
+	assert.Equal(http.StatusOK, code)
+	var info proxyInfo
+	assert.NoError(json.Unmarshal(b, &info))
+	assert.Regexp(`^v2\.0\.1-0\.[0-9]{14}-`+head[:12]+`\+incompatible$`, info.Version)
+	code, b = get("example.com/foo/@v/" + info.Version + ".zip")
+	assert.Equal(http.StatusOK, code)
+	r, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	assert.NoError(err)
+	var names []string
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	assert.Contains(names, "example.com/foo@"+info.Version+"/foo.go")
+
+	code, b = get("example.com/foo/@v/master.info")
+	assert.Equal(http.StatusOK, code)
+	assert.Contains(string(b), info.Version)
+
+	code, b = get("example.com/foo/@latest")
+	assert.Equal(http.StatusOK, code)
+	assert.Contains(string(b), `"v2.0.0+incompatible"`)
+
+	// v2.0.0 has no go.mod saying it is example.com/foo/v2
+	code, b = get("example.com/foo/v2/@v/list")
+	assert.Equal(http.StatusOK, code)
+	assert.Empty(b)
+
+	for _, p := range []string{"example.com/bar/@v/list", "example.com/foo/@v/v3.0.0.zip", "example.com/foo/@v/master.zip", "example.com/foo/v2/@v/v2.0.0.info"} {
+		code, _ = get(p)
+		assert.Equal(http.StatusNotFound, code, p)
+	}
+
+	// trash itself can use it
+	proxyURL = srv.URL
+	v := proxyVCS{}
+	modDir := filepath.Join(dir, "other", "src", "example.com", "foo")
+	assert.NoError(v.Clone(ctx, stdLog, modDir, "", proxyURL+"/example.com/foo"))
+	assert.NoError(v.Checkout(ctx, stdLog, modDir, "", head[:7]))
+	b, err = ioutil.ReadFile(filepath.Join(modDir, "foo.go"))
+	assert.NoError(err)
+	assert.True(strings.HasSuffix(string(b), "three\n"))
+}
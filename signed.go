@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mountkin/trash/conf"
+	"github.com/mountkin/trash/util"
+)
+
+// keyringDir is the keyring of the config (see conf.VerifySigned): the GPG
+// public keys of its *.asc and *.gpg files, and the SSH keys of its
+// allowed_signers file (in the format of ssh-keygen).
+var keyringDir string
+
+const allowedSignersFile = "allowed_signers"
+
+// keyringsDir is where the GPG keys of the keyrings are imported to, in the
+// cache: a GNUPGHOME per content of a keyring dir.
+const keyringsDir = "keyrings"
+
+// gnupgHome returns the GNUPGHOME with the GPG keys of the keyring, made if
+// needed.
+func gnupgHome(trashDir string) (string, error) {
+	var keys []string
+	for _, pattern := range []string{"*.asc", "*.gpg"} {
+		matches, err := filepath.Glob(filepath.Join(keyringDir, pattern))
+		if err != nil {
+			return "", err
+		}
+		keys = append(keys, matches...)
+	}
+	h, err := util.HashDir(keyringDir)
+	if err != nil {
+		return "", fmt.Errorf("could not read the keyring '%s': %s", keyringDir, err)
+	}
+	sum := sha256.Sum256([]byte(h))
+	home := filepath.Join(trashDir, keyringsDir, hex.EncodeToString(sum[:])[:16])
+	if isDir(home) {
+		return home, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(home), 0755); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(home), ".new-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	if len(keys) > 0 {
+		if _, err := combinedOutput(command(tmp, "gpg", append([]string{"--batch", "--quiet", "--homedir", tmp, "--import"}, keys...)...)); err != nil {
+			return "", fmt.Errorf("could not import the GPG keys of the keyring '%s': %s", keyringDir, err)
+		}
+	}
+	if err := os.Rename(tmp, home); err != nil && !isDir(home) {
+		return "", err
+	}
+	return home, nil
+}
+
+// verifyGit returns a git command verifying a signature (verify-tag or
+// verify-commit) against the keyring.
+func verifyGit(dir, home string, args ...string) *exec.Cmd {
+	signers := os.DevNull
+	if _, err := os.Stat(filepath.Join(keyringDir, allowedSignersFile)); err == nil {
+		signers = filepath.Join(keyringDir, allowedSignersFile)
+	}
+	cmd := git(dir, append([]string{"-c", "gpg.ssh.allowedSignersFile=" + signers}, args...)...)
+	cmd.Env = append(cmd.Env, "GNUPGHOME="+home)
+	return cmd
+}
+
+var (
+	gpgSigner = regexp.MustCompile(`(?m)^\[GNUPG:\] VALIDSIG .* ([0-9A-F]{40})$`)
+	sshSigner = regexp.MustCompile(`Good "git" signature for .* key (SHA256:\S+)`)
+	gpgKeyID  = regexp.MustCompile(`(?m)^\[GNUPG:\] (?:NO_PUBKEY|ERRSIG) ([0-9A-F]+)`)
+	sshKey    = regexp.MustCompile(`signature with .* key (SHA256:\S+)`)
+)
+
+// signerOf reads the key that made a good signature in the output of `git
+// verify-tag --raw` or `git verify-commit --raw`.
+func signerOf(out string) string {
+	if m := gpgSigner.FindStringSubmatch(out); m != nil {
+		return "gpg:" + m[1] // of the primary key
+	}
+	if m := sshSigner.FindStringSubmatch(out); m != nil {
+		return "ssh:" + m[1]
+	}
+	return ""
+}
+
+// whyNotSigned tells why a verification that failed with out did.
+func whyNotSigned(out string) string {
+	switch {
+	case gpgKeyID.MatchString(out):
+		return "signed with GPG key " + gpgKeyID.FindStringSubmatch(out)[1] + ", which is not in the keyring"
+	case sshKey.MatchString(out):
+		return "signed with SSH key " + sshKey.FindStringSubmatch(out)[1] + ", which is not in the keyring"
+	case strings.Contains(out, "BADSIG"), strings.Contains(out, "verification failed"):
+		return "badly signed"
+	}
+	return "not signed"
+}
+
+// verifySigned checks that commit, checked out in the git repo dir for i, is
+// signed by a key of the keyring: an annotated tag of it (i.Version, or any
+// other), or else the commit itself. It returns what it verified and the
+// key that signed it.
+func verifySigned(trashDir, dir string, i conf.Import, commit string) (signed, signer string, err error) {
+	home, err := gnupgHome(trashDir)
+	if err != nil {
+		return "", "", err
+	}
+	tags, err := outputLines(git(dir, "tag", "--points-at", commit))
+	if err != nil {
+		return "", "", err
+	}
+	for k, tag := range tags {
+		if tag == i.Version {
+			tags[0], tags[k] = tags[k], tags[0] // the tag of the version first
+		}
+	}
+	why := ""
+	for _, tag := range tags {
+		if t, _ := outputString(git(dir, "cat-file", "-t", "refs/tags/"+tag)); t != "tag" {
+			continue // a lightweight tag, which cannot be signed
+		}
+		out, err := combinedOutput(verifyGit(dir, home, "verify-tag", "--raw", "refs/tags/"+tag))
+		if err == nil && signerOf(string(out)) != "" {
+			return "tag " + tag, signerOf(string(out)), nil
+		}
+		why = fmt.Sprintf("tag '%s' is %s", tag, whyNotSigned(string(out)))
+	}
+	out, err := combinedOutput(verifyGit(dir, home, "verify-commit", "--raw", commit))
+	if err == nil && signerOf(string(out)) != "" {
+		return "commit", signerOf(string(out)), nil
+	}
+	if why == "" {
+		why = "no annotated tag points to it"
+	}
+	return "", "", fmt.Errorf("'%s' of '%s' is not signed by a key of the keyring '%s': commit %s is %s, and %s",
+		i.Version, i.Package, keyringDir, commit, whyNotSigned(string(out)), why)
+}
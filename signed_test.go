@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mountkin/trash/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifySigned(t *testing.T) {
+	for _, name := range []string{"gpg", "gpgconf", "ssh-keygen"} {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("%s is not installed", name)
+		}
+	}
+	assert := require.New(t)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "trash-signed")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	defer func() { keyringDir = "" }()
+
+	// a GPG key and an SSH key in the keyring, and an SSH key that is not
+	home := filepath.Join(dir, "gnupg")
+	assert.NoError(os.Mkdir(home, 0700))
+	defer exec.Command("gpgconf", "--homedir", home, "--kill", "all").Run()
+	gpg := func(args ...string) string {
+		out, err := combinedOutput(command(dir, "gpg", append([]string{"--batch", "--homedir", home}, args...)...))
+		assert.NoError(err, "%s", out)
+		return string(out)
+	}
+	gpg("--passphrase", "", "--quick-gen-key", "Dev <dev@example.com>", "ed25519", "sign", "never")
+	var fingerprint string
+	for _, l := range strings.Split(gpg("--with-colons", "--fingerprint"), "\n") {
+		if fields := strings.Split(l, ":"); fields[0] == "fpr" && fingerprint == "" {
+			fingerprint = fields[9]
+		}
+	}
+	keyring := filepath.Join(dir, "keyring")
+	assert.NoError(os.Mkdir(keyring, 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(keyring, "dev.asc"), []byte(gpg("--armor", "--export", "dev@example.com")), 0644))
+	var sshFingerprints []string
+	for _, key := range []string{"dev", "stranger"} {
+		_, err := combinedOutput(command(dir, "ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", key, "-f", filepath.Join(dir, key)))
+		assert.NoError(err)
+		out, err := outputString(command(dir, "ssh-keygen", "-l", "-f", filepath.Join(dir, key+".pub")))
+		assert.NoError(err)
+		sshFingerprints = append(sshFingerprints, strings.Fields(out)[1])
+	}
+	pub, err := ioutil.ReadFile(filepath.Join(dir, "dev.pub"))
+	assert.NoError(err)
+	assert.NoError(ioutil.WriteFile(filepath.Join(keyring, allowedSignersFile), []byte("dev@example.com "+string(pub)), 0644))
+
+	// v1.0.0 is a signed tag, the next commit is signed, v1.2.0 is not, and
+	// the last commit is signed by a stranger
+	upstream := filepath.Join(dir, "upstream")
+	commits := makeUpstream(t, upstream)
+	run := func(args ...string) {
+		cmd := git(upstream, append([]string{"-c", "user.name=t", "-c", "user.email=t@example.com"}, args...)...)
+		cmd.Env = append(cmd.Env, "GNUPGHOME="+home)
+		out, err := combinedOutput(cmd)
+		assert.NoError(err, "%s", out)
+	}
+	run("tag", "-d", "v1.0.0")
+	run("-c", "user.signingkey="+fingerprint, "tag", "-s", "-m", "v1.0.0", "v1.0.0", commits[0])
+	run("checkout", "-q", "-b", "signed", commits[1])
+	run("-c", "gpg.format=ssh", "-c", "user.signingkey="+filepath.Join(dir, "dev"), "commit", "-q", "-S", "--amend", "-m", "two")
+	signed, err := outputString(git(upstream, "rev-parse", "HEAD"))
+	assert.NoError(err)
+	run("tag", "v1.2.0", commits[2])
+	run("checkout", "-q", "-b", "stranger")
+	run("-c", "gpg.format=ssh", "-c", "user.signingkey="+filepath.Join(dir, "stranger"), "commit", "-q", "-S", "--allow-empty", "-m", "four")
+	stranger, err := outputString(git(upstream, "rev-parse", "HEAD"))
+	assert.NoError(err)
+
+	keyringDir = keyring
+	trashDir := filepath.Join(dir, "cache")
+	lock := func(version string) (conf.LockedImport, error) {
+		i := conf.Import{Package: "example.com/f", Version: version, Repo: upstream, Options: conf.Options{Verify: conf.VerifySigned}}
+		assert.NoError(checkoutImport(ctx, stdLog, trashDir, i))
+		return lockImport(trashDir, i)
+	}
+	li, err := lock("v1.0.0")
+	assert.NoError(err)
+	assert.Equal("tag v1.0.0", li.Signed)
+	assert.Equal("gpg:"+fingerprint, li.Signer)
+	li, err = lock(signed)
+	assert.NoError(err)
+	assert.Equal("commit", li.Signed)
+	assert.Equal("ssh:"+sshFingerprints[0], li.Signer)
+
+	_, err = lock("v1.2.0")
+	assert.Error(err)
+	assert.Contains(err.Error(), "commit "+commits[2]+" is not signed, and no annotated tag points to it")
+	_, err = lock(stranger)
+	assert.Error(err)
+	assert.Contains(err.Error(), "signed with SSH key "+sshFingerprints[1]+", which is not in the keyring")
+
+	// the signers are recorded in the manifest too
+	m := manifest{"example.com/f": "h1:xyz", "example.com/g": "h1:abc"}
+	m.addSigners(&conf.Lock{Imports: []conf.LockedImport{li}})
+	m.addSigners(&conf.Lock{Imports: []conf.LockedImport{{Package: "example.com/f", Signer: "gpg:" + fingerprint}}})
+	manifestPath := filepath.Join(dir, manifestFileName)
+	assert.NoError(m.dump(manifestPath))
+	recorded, err := readManifest(manifestPath)
+	assert.NoError(err)
+	assert.Equal(manifest{"example.com/f": "h1:xyz gpg:" + fingerprint, "example.com/g": "h1:abc"}, recorded)
+
+	// and rollbacks verify the imports again
+	proj := filepath.Join(dir, "proj")
+	assert.NoError(os.MkdirAll(proj, 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(proj, "main.go"), []byte("package main\n\nimport _ \"example.com/f\"\n\nfunc main() {}\n"), 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(proj, "trash.yaml"), []byte(`package: example.com/proj
+keyring: ../keyring
+import:
+- package: example.com/f
+  version: v1.0.0
+  repo: `+upstream+`
+  verify: signed
+`), 0644))
+	assert.NoError(runTrash(proj))
+	assert.NoError(runTrash(proj))
+	assert.NoError(runTrash(proj, "rollback"))
+	restored, err := conf.ParseLock(conf.LockFile(filepath.Join(proj, "trash.yaml")))
+	assert.NoError(err)
+	li, ok := restored.Get("example.com/f")
+	assert.True(ok)
+	assert.Equal("tag v1.0.0", li.Signed)
+	assert.Equal("gpg:"+fingerprint, li.Signer)
+}
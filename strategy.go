@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mountkin/trash/conf"
+	"github.com/mountkin/trash/semver"
+)
+
+// resolveConstraint returns the highest semver tag of the repo in repoDir
+// satisfying constraint.
+func resolveConstraint(ctx context.Context, log *logrus.Entry, v VCS, repoDir, constraint string) (string, error) {
+	c, err := semver.ParseConstraint(constraint)
+	if err != nil {
+		return "", err
+	}
+	tags, err := v.Tags(ctx, log, repoDir)
+	if err != nil {
+		return "", err
+	}
+	best, ok := c.Best(semver.Tags(tags))
+	if !ok {
+		return "", fmt.Errorf("no tag satisfies '%s'", constraint)
+	}
+	return best.Original, nil
+}
+
+// nextVersion returns the version `trash update` moves i to, following its
+// update strategy. Constraints are left as they are: they get resolved to
+// the highest matching tag on checkout.
+func nextVersion(ctx context.Context, trashDir string, trashConf *conf.Conf, i conf.Import) (string, error) {
+	if semver.IsConstraint(i.Version) {
+		return i.Version, nil
+	}
+	strategy := trashConf.Strategy(i)
+	switch strategy {
+	case conf.UpdateLatest, conf.UpdateMinor, conf.UpdatePatch:
+		var tags []string
+		err := withRepoLock(trashDir, i.Package, func() error {
+			if err := prepareCache(ctx, stdLog, trashDir, i); err != nil {
+				return err
+			}
+			v, repoDir, err := repoOf(trashDir, i)
+			if err != nil {
+				return err
+			}
+			if err := fetch(ctx, stdLog, v, repoDir, i.Repo); err != nil {
+				return err
+			}
+			tags, err = v.Tags(ctx, stdLog, repoDir)
+			return err
+		})
+		if err != nil {
+			return "", &importError{i, err}
+		}
+		return latestTag(i, strategy, semver.Tags(tags))
+	}
+
+	b := i
+	b.Version = "master"
+	if strategy == conf.UpdateBranch && i.Branch != "" {
+		b.Version = i.Branch
+	}
+	var version string
+	err := withRepoLock(trashDir, i.Package, func() error {
+		if err := prepareCache(ctx, stdLog, trashDir, b); err != nil {
+			return err
+		}
+		if err := checkout(ctx, stdLog, trashDir, b); err != nil {
+			return err
+		}
+		var err error
+		version, err = getLatestVersion(filepath.Join(trashDir, "src"), i.Package)
+		return err
+	})
+	if err != nil {
+		return "", &importError{b, err}
+	}
+	return version, nil
+}
+
+// latestTag picks the highest release among tags allowed by strategy. The
+// current version is kept if there is none.
+func latestTag(i conf.Import, strategy string, tags []semver.Version) (string, error) {
+	current, err := semver.Parse(i.Version)
+	if err != nil && strategy != conf.UpdateLatest {
+		logrus.Warnf("'%s' of '%s' is not a semantic version: updating to the latest tag instead of the latest %s", i.Version, i.Package, strategy)
+		strategy = conf.UpdateLatest
+	}
+	latest := ""
+	for _, v := range tags { // tags are sorted
+		if v.Pre != "" {
+			continue
+		}
+		switch strategy {
+		case conf.UpdateMinor:
+			if v.Major != current.Major || v.Compare(current) < 0 {
+				continue
+			}
+		case conf.UpdatePatch:
+			if v.Major != current.Major || v.Minor != current.Minor || v.Compare(current) < 0 {
+				continue
+			}
+		}
+		latest = v.Original
+	}
+	if latest == "" {
+		if i.Version == "" {
+			return "", fmt.Errorf("'%s' has no release tags", i.Package)
+		}
+		logrus.Infof("No release of '%s' matches update strategy '%s': keeping '%s'", i.Package, strategy, i.Version)
+		return i.Version, nil
+	}
+	return latest, nil
+}
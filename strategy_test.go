@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mountkin/trash/conf"
+	"github.com/mountkin/trash/semver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatestTag(t *testing.T) {
+	assert := require.New(t)
+	tags := semver.Tags([]string{"v0.9.0", "v1.2.0", "v1.2.5", "v1.3.0", "v1.4.0-rc.1", "v2.0.0", "v2.1.0-beta"})
+
+	testData := []struct {
+		version  string
+		strategy string
+		expected string
+	}{
+		{"v1.2.0", conf.UpdateLatest, "v2.0.0"},
+		{"v1.2.0", conf.UpdateMinor, "v1.3.0"},
+		{"v1.2.0", conf.UpdatePatch, "v1.2.5"},
+		{"v1.2.3-4-gabcdef0", conf.UpdatePatch, "v1.2.5"},
+		{"v0.9.0", conf.UpdatePatch, "v0.9.0"},
+		{"v3.0.0", conf.UpdateMinor, "v3.0.0"},
+		{"abc1234", conf.UpdatePatch, "v2.0.0"},
+	}
+	for _, d := range testData {
+		v, err := latestTag(conf.Import{Package: "github.com/a/a", Version: d.version}, d.strategy, tags)
+		assert.NoError(err)
+		assert.Equal(d.expected, v, "%s, %s", d.version, d.strategy)
+	}
+
+	_, err := latestTag(conf.Import{Package: "github.com/a/a"}, conf.UpdateLatest, nil)
+	assert.Error(err)
+}
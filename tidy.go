@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mountkin/trash/conf"
+	"github.com/mountkin/trash/util"
+	"github.com/urfave/cli"
+)
+
+// excluded tells whether pkg is in one of the excluded dirs, which trash
+// removes from the vendor dir (see removeExcludes).
+func excluded(excludes []string, pkg string) bool {
+	for _, e := range excludes {
+		if pkg == e || strings.HasPrefix(pkg, e+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// coveringImport returns the import whose repo contains pkg.
+func coveringImport(imports []conf.Import, pkg string) (conf.Import, bool) {
+	var r conf.Import
+	for _, i := range imports {
+		if (pkg == i.Package || strings.HasPrefix(pkg, i.Package+"/")) && len(i.Package) > len(r.Package) {
+			r = i
+		}
+	}
+	return r, r.Package != ""
+}
+
+// tidyCommand syncs the config with the code: repos imported by the project
+// (directly or not) and missing from the config are added at their latest
+// version, and imports nothing uses any more (the ones cleanup would remove
+// entirely) are dropped. The versions of all the other imports are left
+// alone.
+func tidyCommand(c *cli.Context) error {
+	p, err := loadProject(c)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	rootPackage := p.trashConf.Package
+	if rootPackage == "" {
+		if rootPackage, err = guessRootPackage(p.dir); err != nil {
+			return err
+		}
+	}
+	rootPackage = strings.Trim(rootPackage, "/")
+	isProjectPackage := func(pkg string) bool {
+		return pkg == rootPackage || strings.HasPrefix(pkg, rootPackage+"/")
+	}
+
+	os.MkdirAll(filepath.Join(p.trashDir, "src"), 0755)
+	libRoot := filepath.Join(p.trashDir, "src")
+
+	// The cache must hold the pinned versions, as they define what gets imported
+	resolved, err := resolveImports(ctx, p.trashDir, p.trashConf.Imports, p.lock)
+	if err != nil {
+		return err
+	}
+	for _, li := range resolved {
+		p.lock.Set(li)
+	}
+
+	var added []conf.Import
+	known := append([]conf.Import{}, p.trashConf.Imports...)
+	seen := util.Packages{}
+	var imports util.Packages
+	var errs []error
+	for progress := true; progress; {
+		progress = false
+		if err := widenSparseCheckouts(p.trashDir, p.dir, p.targetDir, p.trashConf); err != nil {
+			return err
+		}
+		imports = collectImports(rootPackage, libRoot, p.targetDir, p.trashConf)
+		for pkg := range imports {
+			if excluded(p.trashConf.Excludes, pkg) {
+				delete(imports, pkg)
+			}
+		}
+		for _, pkg := range sortedPackages(imports) {
+			if isProjectPackage(pkg) || seen[pkg] {
+				continue
+			}
+			seen[pkg] = true
+			if _, ok := coveringImport(known, pkg); ok {
+				continue
+			}
+
+			i := conf.Import{Package: pkg, Version: "master"}
+			if err := checkoutImport(ctx, stdLog, p.trashDir, i); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			root, err := topLevel(pkg, libRoot)
+			if err != nil {
+				return err
+			}
+			version, err := getLatestVersion(libRoot, root)
+			if err != nil {
+				return err
+			}
+			added = append(added, conf.Import{Package: root, Version: version})
+			known = append(known, added[len(added)-1])
+			progress = true
+		}
+	}
+	if err := collect(errs); err != nil {
+		return err
+	}
+
+	used := map[string]bool{}
+	for pkg := range imports {
+		if i, ok := coveringImport(p.trashConf.Imports, pkg); ok {
+			used[i.Package] = true
+		}
+	}
+	var removed []string
+	for _, i := range p.trashConf.Imports {
+		// Packages from staging dirs are not covered by the import of their repo
+		if !used[i.Package] && !i.Staging {
+			removed = append(removed, i.Package)
+		}
+	}
+
+	for _, i := range added {
+		li, err := lockImport(p.trashDir, i)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("Adding '%s' at '%s'", i.Package, i.Version)
+		p.trashConf.Set(i)
+		p.lock.Set(li)
+	}
+	for _, pkg := range removed {
+		logrus.Infof("Removing unused '%s'", pkg)
+		p.trashConf.Remove(pkg)
+		p.lock.Remove(pkg)
+	}
+
+	if err := p.trashConf.Dump(p.confFile); err != nil {
+		return err
+	}
+	if err := p.lock.Dump(conf.LockFile(p.confFile)); err != nil {
+		return err
+	}
+	if len(added)+len(removed) > 0 {
+		logrus.Infof("%s is tidy: %d import(s) added, %d removed. Run trash to vendor them", p.confFile, len(added), len(removed))
+	}
+	return recordConfigRun(p.dir, "tidy", p.confFile, p.lock)
+}
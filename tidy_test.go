@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mountkin/trash/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoveringImport(t *testing.T) {
+	assert := require.New(t)
+	imports := []conf.Import{
+		{Package: "github.com/a/a"},
+		{Package: "github.com/a/a/nested"},
+		{Package: "github.com/b/b"},
+	}
+
+	i, ok := coveringImport(imports, "github.com/a/a/sub/pkg")
+	assert.True(ok)
+	assert.Equal("github.com/a/a", i.Package)
+
+	i, ok = coveringImport(imports, "github.com/a/a/nested/pkg")
+	assert.True(ok)
+	assert.Equal("github.com/a/a/nested", i.Package)
+
+	i, ok = coveringImport(imports, "github.com/b/b")
+	assert.True(ok)
+	assert.Equal("github.com/b/b", i.Package)
+
+	_, ok = coveringImport(imports, "github.com/b/bb")
+	assert.False(ok)
+}
+
+func TestTidy(t *testing.T) {
+	assert := require.New(t)
+	dir, err := ioutil.TempDir("", "trash-tidy")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	proj, fooCommits, barCommits := makeProject(t, dir)
+	confFile := filepath.Join(proj, "vendor.conf")
+
+	// baz is pinned but not imported, and bar is imported but not pinned: it
+	// is found by its import path, in the cache
+	baz := filepath.Join(dir, "baz")
+	makeUpstream(t, baz)
+	fp, err := os.OpenFile(confFile, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(err)
+	_, err = fp.WriteString("example.com/baz v1.0.0 " + baz + "\n")
+	assert.NoError(err)
+	assert.NoError(fp.Close())
+	barDir := filepath.Join(dir, "cache", "src", "example.com", "bar")
+	assert.NoError(os.MkdirAll(filepath.Dir(barDir), 0755))
+	_, err = combinedOutput(git(filepath.Dir(barDir), "clone", "-q", filepath.Join(dir, "bar"), barDir))
+	assert.NoError(err)
+	latest, err := outputString(git(filepath.Join(dir, "bar"), "describe", "--tags", "--always"))
+	assert.NoError(err)
+
+	assert.NoError(runTrash(proj, "tidy"))
+	trashConf, err := conf.Parse(confFile)
+	assert.NoError(err)
+	lock, err := conf.ParseLock(conf.LockFile(confFile))
+	assert.NoError(err)
+	assert.Equal([]conf.Import{
+		{Package: "example.com/bar", Version: latest},
+		{Package: "example.com/foo", Version: "v1.0.0", Repo: filepath.Join(dir, "foo")},
+	}, trashConf.Imports)
+	li, ok := lock.Get("example.com/foo")
+	assert.True(ok)
+	assert.Equal(fooCommits[0], li.Commit)
+	li, ok = lock.Get("example.com/bar")
+	assert.True(ok)
+	assert.Equal(barCommits[2], li.Commit)
+	_, ok = lock.Get("example.com/baz")
+	assert.False(ok)
+
+	entries, err := readHistory(proj)
+	assert.NoError(err)
+	assert.Len(entries, 1)
+	assert.Equal("tidy", entries[0].Command)
+
+	// a tidy config stays as it is
+	before, err := ioutil.ReadFile(confFile)
+	assert.NoError(err)
+	assert.NoError(runTrash(proj, "tidy"))
+	after, err := ioutil.ReadFile(confFile)
+	assert.NoError(err)
+	assert.Equal(string(before), string(after))
+}
+
+func TestTidyExcludes(t *testing.T) {
+	assert := require.New(t)
+	dir, err := ioutil.TempDir("", "trash-tidy")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	proj, _, _ := makeProject(t, dir)
+	assert.NoError(os.Remove(filepath.Join(proj, "vendor.conf")))
+	confFile := filepath.Join(proj, "trash.yaml")
+	assert.NoError(ioutil.WriteFile(confFile, []byte(`package: example.com/proj
+import:
+- package: example.com/foo
+  version: v1.0.0
+  repo: `+filepath.Join(dir, "foo")+`
+exclude:
+- example.com/bar
+`), 0644))
+	// bar could be added from the cache, were it not excluded
+	barDir := filepath.Join(dir, "cache", "src", "example.com", "bar")
+	assert.NoError(os.MkdirAll(filepath.Dir(barDir), 0755))
+	_, err = combinedOutput(git(filepath.Dir(barDir), "clone", "-q", filepath.Join(dir, "bar"), barDir))
+	assert.NoError(err)
+
+	assert.NoError(runTrash(proj, "tidy"))
+	trashConf, err := conf.Parse(confFile)
+	assert.NoError(err)
+	assert.Equal([]conf.Import{{Package: "example.com/foo", Version: "v1.0.0", Repo: filepath.Join(dir, "foo")}}, trashConf.Imports)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mountkin/trash/conf"
+	"github.com/mountkin/trash/semver"
+)
+
+// wantedPin is a pin and the dependency wanting it.
+type wantedPin struct {
+	dep string
+	conf.Pin
+}
+
+func (w wantedPin) String() string {
+	return fmt.Sprintf("'%s' wants '%s' (%s)", w.dep, w.Version, w.Source)
+}
+
+// resolveTransitive picks one version for every package pinned by the
+// dependencies in pins (keyed by dependency). The policy is:
+//
+//  1. the version in the top level config wins,
+//  2. otherwise the highest semantic version wins,
+//  3. otherwise (commits, branches) the pin of the first dependency, by
+//     name, wins.
+//
+// It returns the imports to add to trashConf and a report of the conflicts.
+func resolveTransitive(trashConf *conf.Conf, pins map[string][]conf.Pin) ([]conf.Import, []string) {
+	wanted := map[string][]wantedPin{}
+	var deps []string
+	for dep := range pins {
+		deps = append(deps, dep)
+	}
+	sort.Strings(deps)
+	for _, dep := range deps {
+		for _, p := range pins[dep] {
+			if p.Package == dep || isOwnPackage(trashConf.Package, p.Package) {
+				continue
+			}
+			wanted[p.Package] = append(wanted[p.Package], wantedPin{dep, p})
+		}
+	}
+
+	var pkgs []string
+	for pkg := range wanted {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+
+	var extra []conf.Import
+	var conflicts []string
+	for _, pkg := range pkgs {
+		ws := wanted[pkg]
+		if i, ok := coveringImport(trashConf.Imports, pkg); ok {
+			for _, w := range ws {
+				if i.Package == pkg && w.Version != i.Version {
+					conflicts = append(conflicts, fmt.Sprintf("'%s': %s, using '%s' from %s (top level wins)", pkg, describeWants(ws), i.Version, trashConf.ConfFile()))
+					break
+				}
+			}
+			continue
+		}
+
+		chosen, reason := ws[0], "first dependency wins, no semantic versions"
+		var best semver.Version
+		found := false
+		for _, w := range ws {
+			if v, err := semver.Parse(w.Version); err == nil && (!found || v.Compare(best) > 0) {
+				chosen, best, found = w, v, true
+				reason = "highest semantic version wins"
+			}
+		}
+		for _, w := range ws {
+			if w.Version != chosen.Version {
+				conflicts = append(conflicts, fmt.Sprintf("'%s': %s, using '%s' (%s)", pkg, describeWants(ws), chosen.Version, reason))
+				break
+			}
+		}
+		extra = append(extra, conf.Import{Package: pkg, Version: chosen.Version, Repo: chosen.Repo})
+	}
+	return extra, conflicts
+}
+
+func describeWants(ws []wantedPin) string {
+	var s []string
+	for _, w := range ws {
+		s = append(s, w.String())
+	}
+	return strings.Join(s, ", ")
+}
+
+func isOwnPackage(rootPackage, pkg string) bool {
+	return rootPackage != "" && (pkg == rootPackage || strings.HasPrefix(pkg, rootPackage+"/"))
+}
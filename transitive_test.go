@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mountkin/trash/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveTransitive(t *testing.T) {
+	assert := require.New(t)
+	trashConf := &conf.Conf{
+		Package: "example.com/proj",
+		Imports: []conf.Import{
+			{Package: "github.com/a/a", Version: "v1.0.0", Options: conf.Options{Transitive: true}},
+			{Package: "github.com/b/b", Version: "v2.0.0", Options: conf.Options{Transitive: true}},
+			{Package: "github.com/top/top", Version: "v1.0.0"},
+		},
+	}
+	pins := map[string][]conf.Pin{
+		"github.com/a/a": {
+			{Package: "github.com/a/a", Version: "v0.1.0", Source: "go.mod"},
+			{Package: "example.com/proj/sub", Version: "v0.1.0", Source: "go.mod"},
+			{Package: "github.com/top/top", Version: "v0.9.0", Source: "go.mod"},
+			{Package: "github.com/sem/ver", Version: "v1.2.0", Source: "go.mod"},
+			{Package: "github.com/com/mit", Version: "aaaaaaa", Source: "glide.lock"},
+			{Package: "github.com/only/a", Version: "v0.1.0", Repo: "https://example.com/a.git", Source: "go.mod"},
+		},
+		"github.com/b/b": {
+			{Package: "github.com/top/top", Version: "v1.0.0", Source: "vendor.conf"},
+			{Package: "github.com/sem/ver", Version: "v1.10.0", Source: "vendor.conf"},
+			{Package: "github.com/com/mit", Version: "bbbbbbb", Source: "vendor.conf"},
+		},
+	}
+
+	extra, conflicts := resolveTransitive(trashConf, pins)
+	assert.Equal([]conf.Import{
+		{Package: "github.com/com/mit", Version: "aaaaaaa"},
+		{Package: "github.com/only/a", Version: "v0.1.0", Repo: "https://example.com/a.git"},
+		{Package: "github.com/sem/ver", Version: "v1.10.0"},
+	}, extra)
+
+	assert.Len(conflicts, 3)
+	assert.Contains(conflicts[0], "'github.com/com/mit'")
+	assert.Contains(conflicts[0], "using 'aaaaaaa' (first dependency wins")
+	assert.Contains(conflicts[1], "'github.com/sem/ver'")
+	assert.Contains(conflicts[1], "'github.com/b/b' wants 'v1.10.0' (vendor.conf)")
+	assert.Contains(conflicts[2], "'github.com/top/top'")
+	assert.Contains(conflicts[2], "'github.com/a/a' wants 'v0.9.0' (go.mod)")
+	assert.True(strings.Contains(conflicts[2], "top level wins"), conflicts[2])
+}
@@ -1,8 +1,7 @@
 package main
 
 import (
-	"crypto/sha1"
-	"encoding/hex"
+	"context"
 	"fmt"
 	"go/ast"
 	"go/parser"
@@ -14,10 +13,11 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
-	"github.com/Masterminds/glide/godep"
 	"github.com/Sirupsen/logrus"
 	"github.com/mountkin/trash/conf"
+	"github.com/mountkin/trash/semver"
 	"github.com/mountkin/trash/util"
 	"github.com/urfave/cli"
 )
@@ -25,11 +25,26 @@ import (
 var Version string = "v0.3.0-dev"
 
 func main() {
+	if err := newApp().Run(os.Args); err != nil {
+		if f, ok := err.(failures); ok {
+			f.print(os.Stderr)
+			os.Exit(1)
+		}
+		logrus.Fatal(err)
+	}
+}
+
+func newApp() *cli.App {
 	app := cli.NewApp()
 	app.Version = Version
 	app.Author = "@imikushin, @ibuildthecloud, @mountkin"
 	app.Usage = "Vendor imported packages and throw away the trash!"
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "file, f",
+			Value: "vendor.conf",
+			Usage: "Vendored packages list (vendor.conf, vendor.yaml, glide.yaml, glide.yml and trash.yaml are tried if not set)",
+		},
 		cli.StringFlag{
 			Name:  "directory, C",
 			Value: ".",
@@ -44,13 +59,71 @@ func main() {
 			Name:  "keep, k",
 			Usage: "Keep all downloaded vendor code (preserving .git dirs)",
 		},
+		cli.BoolFlag{
+			Name:  "dry-run, n",
+			Usage: "Vendor to a scratch dir and print what would change in the vendor dir, without touching it",
+		},
+		cli.StringFlag{
+			Name:  "report",
+			Usage: "Write a JSON report of the changes made to the vendor dir (or, with --dry-run, the changes that would be made) to this file",
+		},
 		cli.BoolFlag{
 			Name:  "update, u",
-			Usage: "Update vendored packages, add missing ones",
+			Usage: "Update vendored packages, add missing ones (same as the update command)",
+		},
+		cli.IntFlag{
+			Name:  "jobs, j",
+			Value: 8,
+			Usage: "Number of repos to fetch and check out in parallel",
+		},
+		cli.DurationFlag{
+			Name:  "lock-timeout",
+			Value: 10 * time.Minute,
+			Usage: "How long to wait for the repos of the cache other trash runs are using",
 		},
 		cli.BoolFlag{
+			Name:  "offline",
+			Usage: "Never touch the network: resolve everything from the cache, as it was last fetched",
+		},
+		cli.BoolFlag{
+			Name:  "partial",
+			Usage: "Clone the git repos of the cache without the contents of their files (--filter=blob:none), which are fetched on checkout",
+		},
+		cli.BoolFlag{
+			Name:  "shallow",
+			Usage: "Fetch only the commits checked out, with depth 1 (everything, if the remote does not let it)",
+		},
+		cli.BoolFlag{
+			Name:  "sparse",
+			Usage: "Check out only the dirs of the packages in use from the git repos of the cache (ignored with --keep)",
+		},
+		cli.StringFlag{
+			Name:   "proxy",
+			Usage:  "Download the imports without a repo of their own from this module proxy (GOPROXY protocol, https:// or file:// URL)",
+			EnvVar: "TRASH_PROXY",
+		},
+		cli.StringSliceFlag{
 			Name:  "insecure",
-			Usage: "Pass -insecure to 'go get'",
+			Usage: "Host whose repos may be fetched, and import paths looked up, over plain HTTP (or HTTPS without checking certificates); may be repeated",
+		},
+		cli.BoolFlag{
+			Name:  "allow-file",
+			Usage: "Let git fetch from local repos and bundle files",
+		},
+		cli.DurationFlag{
+			Name:  "command-timeout",
+			Usage: "How long a VCS command may run",
+			Value: 10 * time.Minute,
+		},
+		cli.DurationFlag{
+			Name:  "net-timeout",
+			Usage: "How long each attempt of a fetch, clone, lookup or download may take",
+			Value: 5 * time.Minute,
+		},
+		cli.IntFlag{
+			Name:  "retries",
+			Usage: "How many times to retry a fetch, clone, lookup or download that failed, waiting 1s, 2s, 4s... in between",
+			Value: 3,
 		},
 		cli.BoolFlag{
 			Name:  "debug, d",
@@ -68,157 +141,373 @@ func main() {
 			EnvVar: "GOPATH",
 		},
 	}
+	app.Before = func(c *cli.Context) error {
+		if c.Bool("debug") {
+			logrus.SetLevel(logrus.DebugLevel)
+		}
+		return nil
+	}
 	app.Action = run
-
-	app.Run(os.Args)
+	app.Commands = []cli.Command{
+		{
+			Name:      "add",
+			Usage:     "Add a package to the config (or change its version) and vendor only that package",
+			ArgsUsage: "<package>[@<version>]",
+			Action:    addCommand,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "repo",
+					Usage: "Git URL to fetch the package from",
+				},
+			},
+		},
+		{
+			Name:      "remove",
+			Aliases:   []string{"rm"},
+			Usage:     "Remove packages from the config, the lock and the vendor dir",
+			ArgsUsage: "<package>...",
+			Action:    removeCommand,
+		},
+		{
+			Name:      "update",
+			Usage:     "Bump the named packages (or all of them, adding missing ones) to the latest version",
+			ArgsUsage: "[<package>...]",
+			Action:    updateCommand,
+		},
+		{
+			Name:   "tidy",
+			Usage:  "Add the missing imports to the config and drop the unused ones, without bumping any version",
+			Action: tidyCommand,
+		},
+		{
+			Name:   "prune",
+			Usage:  "Only remove the unused packages and files from the existing vendor dir",
+			Action: pruneCommand,
+		},
+		{
+			Name:      "rollback",
+			Usage:     "Restore the config and the vendor dir of the run N runs back (1 by default) from " + historyDir + "/" + historyFile + ", without fetching anything",
+			ArgsUsage: "[N]",
+			Action:    rollbackCommand,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "list, l",
+					Usage: "List the recorded runs, latest (0) first",
+				},
+			},
+		},
+		{
+			Name:   "proxy",
+			Usage:  "Serve the git repos of the cache, at their tags and any of their commits, as a module proxy (GOPROXY protocol)",
+			Action: proxyCommand,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "listen",
+					Value: ":8080",
+					Usage: "Address to listen on",
+				},
+			},
+		},
+		{
+			Name:   "verify",
+			Usage:  "Check that the vendor dir matches " + manifestFileName + " and what trash would produce, without changing it",
+			Action: verifyCommand,
+		},
+		{
+			Name:      "bundle",
+			Usage:     "Write the repos of the cache the project needs, at the commits of " + conf.LockFileName + ", to a tar file, for `trash unbundle` to seed a cache without network access with",
+			ArgsUsage: "<out.tar>",
+			Action:    bundleCommand,
+		},
+		{
+			Name:      "unbundle",
+			Usage:     "Add the repos of a tar file written by `trash bundle` to the cache",
+			ArgsUsage: "<in.tar>",
+			Action:    unbundleCommand,
+		},
+		{
+			Name:  "cache",
+			Usage: "Maintain the cache",
+			Subcommands: []cli.Command{
+				{
+					Name:   "ls",
+					Usage:  "List the repos of the cache, with their size in bytes and when they were last copied to a vendor dir",
+					Action: cacheLsCommand,
+				},
+				{
+					Name:      "verify",
+					Usage:     "Check the git repos of the cache with `git fsck`, and report their orphaned remotes and the dirs of the cache no repo is in",
+					ArgsUsage: "[<config or project dir>...]",
+					Action:    cacheVerifyCommand,
+				},
+				{
+					Name:      "prune",
+					Usage:     "Remove the repos the configs given do not use, or that were not used for --days, and the dirs no repo is in",
+					ArgsUsage: "[<config or project dir>...]",
+					Action:    cachePruneCommand,
+					Flags: []cli.Flag{
+						cli.IntFlag{
+							Name:  "days",
+							Usage: "Remove the repos not used for that many days (unless the configs given use them)",
+						},
+					},
+				},
+				{
+					Name:   "gc",
+					Usage:  "Repack the git repos of the cache",
+					Action: cacheGCCommand,
+				},
+			},
+		},
+	}
+	return app
 }
 
 var gopath string
 
-func run(c *cli.Context) error {
-	if c.Bool("debug") {
-		logrus.SetLevel(logrus.DebugLevel)
+// setup changes to the project dir and loads its config. It works both for
+// the app and for its commands, as all the flags it reads are global.
+func setup(c *cli.Context) (dir, confFile, trashDir string, trashConf *conf.Conf, err error) {
+	dir = c.GlobalString("directory")
+	confFile = c.GlobalString("file")
+	gopath = c.GlobalString("gopath")
+	jobs = c.GlobalInt("jobs")
+	lockTimeout = c.GlobalDuration("lock-timeout")
+	proxyURL = strings.TrimSuffix(c.GlobalString("proxy"), "/")
+	offline = c.GlobalBool("offline")
+	allowFile = c.GlobalBool("allow-file")
+	commandTimeout = c.GlobalDuration("command-timeout")
+	netTimeout = c.GlobalDuration("net-timeout")
+	netRetries = c.GlobalInt("retries")
+	partialClone = c.GlobalBool("partial")
+	shallowFetch = c.GlobalBool("shallow")
+	sparseCheckout = c.GlobalBool("sparse") && !c.GlobalBool("keep")
+
+	trashDir, err = filepath.Abs(c.GlobalString("cache"))
+	if err != nil {
+		return
+	}
+
+	if err = os.Chdir(dir); err != nil {
+		return
 	}
+	dir, err = os.Getwd()
+	if err != nil {
+		return
+	}
+	logrus.Debugf("dir: '%s'", dir)
+
+	if !c.GlobalIsSet("file") {
+		if f := conf.Find(dir); f != "" {
+			confFile = f
+		}
+	}
+	logrus.Debugf("confFile: '%s'", confFile)
+
+	if trashConf, err = conf.Parse(confFile); err != nil {
+		return
+	}
+	defaultSource, archiveTemplates = trashConf.Source, trashConf.Archives
+	insecureHosts = append(c.GlobalStringSlice("insecure"), trashConf.Insecure...)
+	if keyringDir = trashConf.Keyring; keyringDir != "" && !filepath.IsAbs(keyringDir) {
+		keyringDir, err = filepath.Abs(filepath.Join(filepath.Dir(confFile), keyringDir))
+	}
+	return
+}
 
-	dir := c.String("directory")
+func run(c *cli.Context) error {
 	targetDir := c.String("target")
-	confFile := "vendor.yaml"
 	keep := c.Bool("keep")
 	update := c.Bool("update")
-	insecure := c.Bool("insecure")
-	trashDir := c.String("cache")
-	gopath = c.String("gopath")
+	dryRun := c.Bool("dry-run")
+	reportFile := c.String("report")
 
-	trashDir, err := filepath.Abs(trashDir)
+	dir, confFile, trashDir, trashConf, err := setup(c)
 	if err != nil {
 		return err
 	}
+	ctx := context.Background()
 
-	if err := os.Chdir(dir); err != nil {
-		return err
+	lockFile := conf.LockFile(confFile)
+	if update {
+		return updateTrash(ctx, trashDir, dir, targetDir, confFile, trashConf)
 	}
-	dir, err = os.Getwd()
+
+	lock, err := conf.ParseLock(lockFile)
 	if err != nil {
 		return err
 	}
-	logrus.Debugf("dir: '%s'", dir)
 
-	trashConf, err := conf.Parse(confFile)
+	vendorDir := path.Join(dir, targetDir)
+	var newDir string // where the vendor dir is populated
+	if dryRun {
+		if newDir, err = ioutil.TempDir("", "trash-dry-run"); err != nil {
+			return err
+		}
+		defer os.RemoveAll(newDir)
+	}
+	var tx *vendorTx
+	if !dryRun {
+		if tx, err = beginVendor(vendorDir); err != nil {
+			return err
+		}
+		defer tx.rollback()
+		newDir = tx.newDir
+	}
+	rep := newReport(newDir)
+	newLock, roots, err := populate(ctx, keep, trashDir, dir, targetDir, newDir, trashConf, lock, rep)
 	if err != nil {
 		return err
 	}
+	rep.compareLocks(lock, newLock)
 
-	if update {
-		return updateTrash(trashDir, dir, targetDir, confFile, trashConf, insecure)
+	if reportFile != "" {
+		if err := rep.dump(reportFile); err != nil {
+			return err
+		}
+	}
+	if dryRun {
+		rep.print(os.Stdout)
+		return nil
 	}
 
-	if err := vendor(keep, trashDir, dir, targetDir, trashConf, insecure); err != nil {
+	if err := tx.commit(); err != nil {
 		return err
 	}
+	if err := newLock.Dump(lockFile); err != nil {
+		return err
+	}
+	m, err := hashVendor(vendorDir, roots)
+	if err != nil {
+		return err
+	}
+	m.addSigners(newLock)
+	if err := m.dump(manifestFile(confFile)); err != nil {
+		return err
+	}
+	return recordRun(dir, "trash", confFile, newLock, m)
+}
+
+// populate fills vendorDir with the imports of trashConf (and their
+// transitive dependencies) and prunes it, unless keep is set, recording what
+// is pruned in rep. targetDir is the vendor dir of the project, which need
+// not be vendorDir. populate returns the resolved lock and the roots of all
+// the vendored packages.
+func populate(ctx context.Context, keep bool, trashDir, dir, targetDir, vendorDir string, trashConf *conf.Conf, lock *conf.Lock, rep *report) (*conf.Lock, []string, error) {
+	if _, err := vendor(ctx, keep, trashDir, dir, targetDir, vendorDir, trashConf, lock); err != nil {
+		return nil, nil, err
+	}
 
-	var extraImports []conf.Import
+	pins := map[string][]conf.Pin{}
 	for _, packageImport := range trashConf.Imports {
 		if packageImport.Transitive {
 			repoDir := path.Join(trashDir, "src", packageImport.Package)
-			transitiveDependencies, err := godep.Parse(repoDir)
-			if err != nil {
-				return err
-			}
-			for _, transitiveDependency := range transitiveDependencies {
-				extraImports = append(extraImports, conf.Import{
-					Package: transitiveDependency.Name,
-					Version: transitiveDependency.Reference,
-					Repo:    transitiveDependency.Repository,
-				})
-			}
+			pins[packageImport.Package] = conf.ReadPins(repoDir)
 		}
 	}
-
-	var filteredExtraImports []conf.Import
-	for _, extraImport := range extraImports {
-		packageAlreadyImported := false
-		for _, packageImport := range trashConf.Imports {
-			if packageImport.Package == extraImport.Package {
-				packageAlreadyImported = true
-				break
-			}
-		}
-		if !packageAlreadyImported {
-			filteredExtraImports = append(filteredExtraImports, extraImport)
-		}
+	extraImports, conflicts := resolveTransitive(trashConf, pins)
+	for _, c := range conflicts {
+		logrus.Warnf("Conflicting versions of %s", c)
 	}
-	trashConf.Imports = append(trashConf.Imports, filteredExtraImports...)
+	trashConf.Imports = append(trashConf.Imports, extraImports...)
 
-	if err := vendor(keep, trashDir, dir, targetDir, trashConf, insecure); err != nil {
-		return err
+	newLock, err := vendor(ctx, keep, trashDir, dir, targetDir, vendorDir, trashConf, lock)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	vendorDir := path.Join(dir, targetDir)
+	var roots []string
 	for _, packageImport := range trashConf.Imports {
+		roots = append(roots, packageImport.Package)
 		if !packageImport.Staging {
 			continue
 		}
-
-		packageLocation := path.Dir(packageImport.Package)
-		baseDir := path.Join(trashDir, "src", packageImport.Package, "staging/src", packageLocation)
-
-		files, err := ioutil.ReadDir(baseDir)
-		if err != nil {
+		var stagingRoots []string
+		li, _ := newLock.Get(packageImport.Package)
+		err := atCommit(ctx, stdLog, trashDir, packageImport, li.Commit, func() (err error) {
+			stagingRoots, err = copyStaging(trashDir, vendorDir, packageImport)
 			return err
+		})
+		if err != nil {
+			return nil, nil, err
 		}
-		for _, f := range files {
-			repoDir := path.Join(baseDir, f.Name())
-			target := path.Join(vendorDir, packageLocation)
-			os.MkdirAll(target, 0755)
-			if bytes, err := exec.Command("cp", "-a", repoDir, target).CombinedOutput(); err != nil {
-				return fmt.Errorf("`cp -a %s %s` failed:\n%s", repoDir, target, bytes)
-			}
-		}
+		roots = append(roots, stagingRoots...)
 	}
 
 	if keep {
-		return nil
+		return newLock, roots, nil
 	}
-	return cleanup(dir, targetDir, trashConf)
+	return newLock, roots, cleanup(dir, targetDir, vendorDir, trashConf, rep)
 }
 
-func updateTrash(trashDir, dir, targetDir, trashFile string, trashConf *conf.Conf, insecure bool) error {
+func updateTrash(ctx context.Context, trashDir, dir, targetDir, trashFile string, trashConf *conf.Conf) error {
 	// TODO collect imports, create `trashConf *conf.Trash`
 	rootPackage := trashConf.Package
 	if rootPackage == "" {
-		rootPackage = guessRootPackage(dir)
+		var err error
+		if rootPackage, err = guessRootPackage(dir); err != nil {
+			return err
+		}
 	}
 	rootPackage = strings.Trim(rootPackage, "/")
 
 	os.MkdirAll(filepath.Join(trashDir, "src"), 0755)
-	os.Setenv("GOPATH", trashDir)
 
 	libRoot := filepath.Join(trashDir, "src")
 	importsLen := 0
 
-	os.Chdir(dir)
+	// Versions the imports already in the config are updated to, following their update strategies
+	next := map[string]string{}
+
 	imports := collectImports(rootPackage, libRoot, targetDir, trashConf)
 	for len(imports) > importsLen {
 		importsLen = len(imports)
-		for pkg := range imports {
-			i, ok := trashConf.Get(pkg)
-			if !ok {
-				i = conf.Import{Package: pkg}
-			}
-			i.Version = "master"
+		var round []conf.Import
+		seen := map[string]bool{}
+		for _, pkg := range sortedPackages(imports) {
 			if pkg == rootPackage || strings.HasPrefix(pkg, rootPackage+"/") {
 				continue
 			}
-			prepareCache(trashDir, i, insecure)
-			checkout(trashDir, i)
+			i, ok := coveringImport(trashConf.Imports, pkg)
+			if !ok {
+				i = conf.Import{Package: pkg, Version: "master"}
+			} else {
+				if _, ok := next[i.Package]; !ok {
+					version, err := nextVersion(ctx, trashDir, trashConf, i)
+					if err != nil {
+						return err
+					}
+					next[i.Package] = version
+				}
+				i.Version = next[i.Package]
+			}
+			if !seen[i.Package] {
+				seen[i.Package] = true
+				round = append(round, i)
+			}
+		}
+		groups := repoGroups(round)
+		errs := forEach(len(groups), func(k int, log *logrus.Entry) error {
+			var errs []error
+			for _, i := range groups[k] {
+				if err := checkoutImport(ctx, log, trashDir, i); err != nil {
+					errs = append(errs, err)
+				}
+			}
+			return collect(errs)
+		})
+		if err := collect(errs); err != nil {
+			return err
+		}
+		if err := widenSparseCheckouts(trashDir, dir, targetDir, trashConf); err != nil {
+			return err
 		}
-		os.Chdir(dir)
 		imports = collectImports(rootPackage, libRoot, targetDir, trashConf)
 	}
 
 	trashConf.Package = rootPackage // Overwrite possibly non existent root package name
 	trashConf.Imports = nil         // Drop any old imports to include only new ones
-	for pkg := range imports {
+	for _, pkg := range sortedPackages(imports) {
 		if pkg == rootPackage || strings.HasPrefix(pkg, rootPackage+"/") {
 			continue
 		}
@@ -230,265 +519,378 @@ func updateTrash(trashDir, dir, targetDir, trashFile string, trashConf *conf.Con
 		if !ok {
 			i = conf.Import{Package: pkg}
 		}
-		i.Version, err = getLatestVersion(libRoot, pkg)
-		if err != nil {
+		if version, ok := next[pkg]; ok {
+			i.Version = version
+		} else if i.Version, err = getLatestVersion(libRoot, pkg); err != nil {
 			return err
 		}
-		os.Chdir(dir)
 		trashConf.Imports = append(trashConf.Imports, i)
 	}
 	trashConf.Dedupe()
 
-	os.Chdir(dir)
-	trashConf.Dump(trashFile)
+	groups := repoGroups(trashConf.Imports)
+	locked := make([][]conf.LockedImport, len(groups))
+	errs := forEach(len(groups), func(k int, log *logrus.Entry) error {
+		var errs []error
+		for _, i := range groups[k] {
+			err := withRepoLock(trashDir, i.Package, func() error {
+				if err := checkout(ctx, log, trashDir, i); err != nil {
+					return err
+				}
+				li, err := lockImport(trashDir, i)
+				if err == nil {
+					locked[k] = append(locked[k], li)
+				}
+				return err
+			})
+			if err != nil {
+				errs = append(errs, &importError{i, err})
+			}
+		}
+		return collect(errs)
+	})
+	if err := collect(errs); err != nil {
+		return err
+	}
+	lock := &conf.Lock{}
+	for _, lis := range locked {
+		for _, li := range lis {
+			lock.Set(li)
+		}
+	}
 
-	return nil
+	if err := trashConf.Dump(trashFile); err != nil {
+		return err
+	}
+	if err := lock.Dump(conf.LockFile(trashFile)); err != nil {
+		return err
+	}
+	return recordConfigRun(dir, "update", trashFile, lock)
 }
 
 func topLevel(pkg, libRoot string) (string, error) {
-	if err := os.Chdir(filepath.Join(libRoot, pkg)); err != nil {
-		return "", err
-	}
-	bytes, err := exec.Command("git", "rev-parse", "--show-toplevel").Output()
-	if err != nil {
-		return "", err
+	_, root, ok := detectVCS(filepath.Join(libRoot, pkg), libRoot)
+	if !ok {
+		return "", fmt.Errorf("'%s' is not in a repo of '%s'", pkg, libRoot)
 	}
-	s := strings.TrimSpace(string(bytes))
-	return s[len(libRoot)+1:], nil
+	return filepath.Rel(libRoot, root)
 }
 
 func getLatestVersion(libRoot, pkg string) (string, error) {
-	if err := os.Chdir(filepath.Join(libRoot, pkg)); err != nil {
-		return "", err
+	v, root, ok := detectVCS(filepath.Join(libRoot, pkg), libRoot)
+	if !ok {
+		return "", fmt.Errorf("'%s' is not in a repo of '%s'", pkg, libRoot)
 	}
-	bytes, err := exec.Command("git", "describe", "--tags", "--always").Output()
-	if err != nil {
-		return "", err
-	}
-	s := strings.TrimSpace(string(bytes))
-	return s, nil
+	return v.Describe(root)
 }
 
-func vendor(keep bool, trashDir, dir, targetDir string, trashConf *conf.Conf, insecure bool) error {
+// vendor checks out every import (at the commit locked in lock, if it is
+// still valid) and copies them to vendorDir. It returns the lock resolved
+// for trashConf.
+func vendor(ctx context.Context, keep bool, trashDir, dir, targetDir, vendorDir string, trashConf *conf.Conf, lock *conf.Lock) (*conf.Lock, error) {
 	logrus.WithFields(logrus.Fields{"keep": keep, "dir": dir, "trashConf": trashConf}).Debug("vendor")
-	defer os.Chdir(dir)
 
 	for _, i := range trashConf.Imports {
 		if i.Version == "" {
-			return fmt.Errorf("version not specified for package '%s'", i.Package)
+			return nil, fmt.Errorf("version not specified for package '%s'", i.Package)
 		}
 	}
 
 	os.MkdirAll(trashDir, 0755)
-	os.Setenv("GOPATH", trashDir)
 
-	for _, i := range trashConf.Imports {
-		prepareCache(trashDir, i, insecure)
-		checkout(trashDir, i)
+	resolved, err := resolveImports(ctx, trashDir, trashConf.Imports, lock)
+	if err != nil {
+		return nil, err
+	}
+	newLock := &conf.Lock{}
+	for _, li := range resolved {
+		newLock.Set(li)
+	}
+	if err := widenSparseCheckouts(trashDir, dir, targetDir, trashConf); err != nil {
+		return nil, err
 	}
 
-	vendorDir := path.Join(dir, targetDir)
-	os.RemoveAll(vendorDir)
-	os.MkdirAll(vendorDir, 0755)
+	if err := emptyDir(vendorDir); err != nil {
+		return nil, err
+	}
 
 	logrus.Info("Copying deps...")
 	for _, i := range trashConf.Imports {
-		if err := cpy(vendorDir, trashDir, i); err != nil {
-			return err
+		li, _ := newLock.Get(i.Package)
+		if err := atCommit(ctx, stdLog, trashDir, i, li.Commit, func() error { return cpy(vendorDir, trashDir, i) }); err != nil {
+			return nil, err
 		}
 	}
 	logrus.Info("Copying deps... Done")
 	if !keep {
-		if err := filepath.Walk(vendorDir, func(path string, info os.FileInfo, err error) error {
-			if os.IsNotExist(err) {
-				return filepath.SkipDir
-			}
-			if err != nil {
-				return err
-			}
-			if !info.IsDir() {
-				return nil
-			}
-			if _, d := filepath.Split(path); d == ".git" {
-				logrus.Infof("removing '%s", path)
-				return os.RemoveAll(path)
-			}
-			return nil
-		}); err != nil {
-			logrus.Errorf("Error stripping .git dirs: %s", err)
-			return err
+		if err := stripVCSDirs(vendorDir); err != nil {
+			return nil, err
 		}
 	}
 
+	return newLock, nil
+}
+
+// emptyDir removes what dir holds, making it if need be, but keeps dir itself
+// and its mode, which beginVendor set.
+func emptyDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := os.RemoveAll(filepath.Join(dir, f.Name())); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func prepareCache(trashDir string, i conf.Import, insecure bool) {
-	logrus.WithFields(logrus.Fields{"trashDir": trashDir, "i": i}).Debug("entering prepareCache")
-	os.Chdir(trashDir)
-	repoDir := path.Join(trashDir, "src", i.Package)
-	if err := checkGitRepo(trashDir, repoDir, i, insecure); err != nil {
-		logrus.WithFields(logrus.Fields{"err": err}).Fatal("checkGitRepo failed")
+// resolveImport prepares the cache for i and checks it out, at the commit
+// locked in lock if it is still valid. It returns the new lock entry for i.
+func resolveImport(ctx context.Context, log *logrus.Entry, trashDir string, i conf.Import, lock *conf.Lock) (conf.LockedImport, error) {
+	var li conf.LockedImport
+	err := withRepoLock(trashDir, i.Package, func() error {
+		if err := prepareCache(ctx, log, trashDir, i); err != nil {
+			return err
+		}
+		var err error
+		if locked, ok := lock.Get(i.Package); ok && locked.Matches(i) {
+			err = checkoutLocked(ctx, log, trashDir, i, locked)
+		} else {
+			err = checkout(ctx, log, trashDir, i)
+		}
+		if err != nil {
+			return err
+		}
+		li, err = lockImport(trashDir, i)
+		return err
+	})
+	if err != nil {
+		return conf.LockedImport{}, &importError{i, err}
 	}
+	return li, nil
 }
 
-func isBranch(remote, version string) bool {
-	b := remote + "/" + version
-	logrus.Debugf("Checking if '%s' is a branch", b)
-	for l := range util.CmdOutLines(exec.Command("git", "branch", "--list", "-r", b)) {
-		if strings.TrimSpace(l) == b {
-			return true
+// checkoutImport prepares the cache for i and checks it out.
+func checkoutImport(ctx context.Context, log *logrus.Entry, trashDir string, i conf.Import) error {
+	err := withRepoLock(trashDir, i.Package, func() error {
+		if err := prepareCache(ctx, log, trashDir, i); err != nil {
+			return err
 		}
+		return checkout(ctx, log, trashDir, i)
+	})
+	if err != nil {
+		return &importError{i, err}
 	}
-	return false
+	return nil
 }
 
-func checkout(trashDir string, i conf.Import) {
-	logrus.WithFields(logrus.Fields{"trashDir": trashDir, "i": i}).Debug("entering checkout")
-	repoDir := path.Join(trashDir, "src", i.Package)
-	if err := os.Chdir(repoDir); err != nil {
-		logrus.Fatalf("Could not change to dir '%s'", repoDir)
-	}
-	logrus.Infof("Checking out '%s', commit: '%s'", i.Package, i.Version)
-	version := i.Version
-	if i.Version == "master" || isBranch(remoteName(i.Repo), i.Version) {
-		version = remoteName(i.Repo) + "/" + i.Version
-		if err := fetch(i); err != nil {
-			logrus.WithFields(logrus.Fields{"i": i}).Fatalf("fetch failed")
-		}
-	}
-	if bytes, err := exec.Command("git", "checkout", "-f", "--detach", version).CombinedOutput(); err != nil {
-		logrus.Debugf("Error running `git checkout -f --detach %s`:\n%s", version, bytes)
-		if i.Version == "master" {
-			logrus.Warn("Failed to checkout 'master' branch: checking out the latest commit git can find")
-			bytes, err := exec.Command("git", "log", "--all", "--pretty=oneline", "--abbrev-commit", "-1").Output()
+// resolveImports runs resolveImport for imports, --jobs repos at a time. It
+// goes through all of them even if some fail, and returns the failures.
+func resolveImports(ctx context.Context, trashDir string, imports []conf.Import, lock *conf.Lock) ([]conf.LockedImport, error) {
+	groups := repoGroups(imports)
+	resolved := make([][]conf.LockedImport, len(groups))
+	errs := forEach(len(groups), func(k int, log *logrus.Entry) error {
+		var errs []error
+		for _, i := range groups[k] {
+			li, err := resolveImport(ctx, log, trashDir, i, lock)
 			if err != nil {
-				logrus.Fatalf("Failed to get latest commit with `git log --all --pretty=oneline --abbrev-commit -1`: %s", err)
+				errs = append(errs, err)
+				continue
 			}
-			version = strings.Fields(strings.TrimSpace(string(bytes)))[0]
-		} else if err := fetch(i); err != nil {
-			logrus.WithFields(logrus.Fields{"i": i}).Fatalf("fetch failed")
-		}
-		logrus.Debugf("Retrying!: `git checkout -f --detach %s`", version)
-		if bytes, err := exec.Command("git", "checkout", "-f", "--detach", version).CombinedOutput(); err != nil {
-			logrus.Fatalf("`git checkout -f --detach %s` failed:\n%s", version, bytes)
+			resolved[k] = append(resolved[k], li)
 		}
+		return collect(errs)
+	})
+	if err := collect(errs); err != nil {
+		return nil, err
 	}
+	var r []conf.LockedImport
+	for _, lis := range resolved {
+		r = append(r, lis...)
+	}
+	return r, nil
 }
 
-func cpy(vendorDir, trashDir string, i conf.Import) error {
-	repoDir := path.Join(trashDir, "src", i.Package)
-	target, _ := path.Split(path.Join(vendorDir, i.Package))
-	os.MkdirAll(target, 0755)
-	if bytes, err := exec.Command("cp", "-a", repoDir, target).CombinedOutput(); err != nil {
-		return fmt.Errorf("`cp -a %s %s` failed:\n%s", repoDir, target, bytes)
+func stripVCSDirs(dir string) error {
+	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if _, d := filepath.Split(path); isMetaDir(d) {
+			logrus.Infof("removing '%s", path)
+			return os.RemoveAll(path)
+		}
+		return nil
+	}); err != nil {
+		logrus.Errorf("Error stripping VCS dirs: %s", err)
+		return err
 	}
 	return nil
 }
 
-func checkGitRepo(trashDir, repoDir string, i conf.Import, insecure bool) error {
-	logrus.WithFields(logrus.Fields{"repoDir": repoDir, "i": i}).Debug("checkGitRepo")
-	if err := os.Chdir(repoDir); err != nil {
-		if os.IsNotExist(err) {
-			return cloneGitRepo(trashDir, repoDir, i, insecure)
-		} else {
-			logrus.Errorf("repoDir '%s' cannot be CD'ed to", repoDir)
-			return err
+// copyStaging copies the packages kept in the staging/src dir of i (the way
+// k8s.io/kubernetes does) to vendorDir. It returns their roots.
+func copyStaging(trashDir, vendorDir string, i conf.Import) ([]string, error) {
+	packageLocation := path.Dir(i.Package)
+	baseDir := path.Join(trashDir, "src", i.Package, "staging/src", packageLocation)
+
+	files, err := ioutil.ReadDir(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	var roots []string
+	for _, f := range files {
+		repoDir := path.Join(baseDir, f.Name())
+		target := path.Join(vendorDir, packageLocation)
+		os.MkdirAll(target, 0755)
+		if bytes, err := exec.Command("cp", "-a", repoDir, target).CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("`cp -a %s %s` failed:\n%s", repoDir, target, bytes)
 		}
+		roots = append(roots, path.Join(packageLocation, f.Name()))
 	}
-	if !isCurrentDirARepo(trashDir) {
-		os.Chdir(trashDir)
-		return cloneGitRepo(trashDir, repoDir, i, insecure)
+	return roots, nil
+}
+
+// prepareCache makes sure the cache has a repo for i, holding its repo if it
+// has one, and cloned with the VCS its vcs: field names.
+func prepareCache(ctx context.Context, log *logrus.Entry, trashDir string, i conf.Import) error {
+	log.WithFields(logrus.Fields{"trashDir": trashDir, "i": i}).Debug("entering prepareCache")
+	repoDir := path.Join(trashDir, "src", i.Package)
+	v, root, ok := detectVCS(repoDir, path.Join(trashDir, "src"))
+	switch wanted := wantedVCS(i); {
+	case ok && wanted != "" && v.Name() != wanted:
+		log.Infof("'%s' is in a %s repo, not %s: cloning it again", i.Package, v.Name(), wanted)
+		ok = false
+	case ok && i.Repo == "" && v.RemoteURL(root, "") == "":
+		// only ever fetched from the repo of the import
+		ok = false
+	}
+	if offline && !isBundle(i.Repo) {
+		switch {
+		case !ok:
+			return offlineError("the repo of '%s'", i.Package)
+		case i.Repo != "" && v.RemoteURL(root, i.Repo) == "":
+			return offlineError("repo '%s' of '%s'", i.Repo, i.Package)
+		}
+		return nil
+	}
+	var err error
+	if ok {
+		err = v.Clone(ctx, log, root, i.Repo, repoURL(i.Repo))
+	} else {
+		err = cloneRepo(ctx, log, trashDir, repoDir, i)
 	}
-	if i.Repo != "" && !remoteExists(remoteName(i.Repo)) {
-		addRemote(i.Repo)
-	} else if !remoteExists("origin") {
-		return cloneGitRepo(trashDir, repoDir, i, insecure)
+	if err != nil {
+		return fmt.Errorf("could not prepare the cache: %s", err)
 	}
 	return nil
 }
 
-func isCurrentDirARepo(trashDir string) bool {
-	d, err := os.Getwd()
+func checkout(ctx context.Context, log *logrus.Entry, trashDir string, i conf.Import) error {
+	log.WithFields(logrus.Fields{"trashDir": trashDir, "i": i}).Debug("entering checkout")
+	v, repoDir, err := repoOf(trashDir, i)
 	if err != nil {
-		logrus.Fatalf("Error getting current dir: %s", err)
+		return err
 	}
-	bytes, err := exec.Command("git", "rev-parse", "--show-toplevel").Output()
+	if semver.IsConstraint(i.Version) {
+		if err := fetch(ctx, log, v, repoDir, i.Repo); err != nil {
+			return err
+		}
+		tag, err := resolveConstraint(ctx, log, v, repoDir, i.Version)
+		if err != nil {
+			return fmt.Errorf("could not resolve version: %s", err)
+		}
+		log.Infof("'%s' of '%s' resolves to '%s'", i.Version, i.Package, tag)
+		i.Version = tag
+	}
+	log.Infof("Checking out '%s', commit: '%s'", i.Package, i.Version)
+	log.Debugf("Checking if '%s' is a branch", i.Version)
+	branch, err := v.IsBranch(repoDir, i.Repo, i.Version)
 	if err != nil {
-		logrus.Debugf("Not in a git repo: `git rev-parse --show-toplevel` in dir %s failed: %s", d, err)
-		return false
+		return err
 	}
-	return strings.HasPrefix(string(bytes), trashDir+"/src/")
-}
-
-func remoteExists(remoteName string) bool {
-	lines := util.CmdOutLines(exec.Command("git", "remote"))
-	for line := range lines {
-		if strings.TrimSpace(line) == remoteName {
-			return true
+	if branch {
+		if err := fetch(ctx, log, v, repoDir, i.Repo); err != nil {
+			return err
 		}
 	}
-	return false
-}
-
-func addRemote(url string) {
-	remoteName := remoteName(url)
-	if bytes, err := exec.Command("git", "remote", "add", "-f", remoteName, url).CombinedOutput(); err != nil {
-		logrus.Debugf("err: '%v', out: '%s'", err, string(bytes))
-		if strings.Contains(string(bytes), fmt.Sprintf("remote %s already exists", remoteName)) {
-			logrus.Warnf("Already have the remote '%s', '%s'", remoteName, url)
-		} else {
-			logrus.Errorf("Could not add remote '%s' '%s'", remoteName, url)
+	if err := v.Checkout(ctx, log, repoDir, i.Repo, i.Version); err != nil {
+		if branch {
+			return err
+		}
+		log.Debug(err)
+		if offline {
+			return offlineError("'%s' of '%s'", i.Version, i.Package)
+		}
+		if err := fetch(ctx, log, v, repoDir, i.Repo); err != nil {
+			return err
 		}
+		log.Debugf("Retrying!: checking out '%s'", i.Version)
+		return v.Checkout(ctx, log, repoDir, i.Repo, i.Version)
 	}
+	return nil
 }
 
-func remoteName(url string) string {
-	if url == "" {
-		return "origin"
+func cpy(vendorDir, trashDir string, i conf.Import) error {
+	repoDir := path.Join(trashDir, "src", i.Package)
+	target, _ := path.Split(path.Join(vendorDir, i.Package))
+	os.MkdirAll(target, 0755)
+	if bytes, err := exec.Command("cp", "-a", repoDir, target).CombinedOutput(); err != nil {
+		return fmt.Errorf("`cp -a %s %s` failed:\n%s", repoDir, target, bytes)
 	}
-	ss := sha1.Sum([]byte(url))
-	return hex.EncodeToString(ss[:])[:7]
+	return nil
 }
 
-func cloneGitRepo(trashDir, repoDir string, i conf.Import, insecure bool) error {
-	logrus.Infof("Preparing cache for '%s'", i.Package)
-	os.Chdir(trashDir)
-	if err := os.RemoveAll(repoDir); err != nil {
-		logrus.WithFields(logrus.Fields{"err": err, "repoDir": repoDir}).Error("os.RemoveAll() failed")
-		return err
-	}
-	args := []string{"get", "-d", "-f", "-u"}
-	if insecure {
-		args = append(args, "-insecure")
+// cloneRepo clones a fresh repo for i into the cache: i.Repo into repoDir if
+// it has one, else the module of the proxy or the repo its import path
+// resolves to, into the dir of its root.
+func cloneRepo(ctx context.Context, log *logrus.Entry, trashDir, repoDir string, i conf.Import) error {
+	log.Infof("Preparing cache for '%s'", i.Package)
+	name, dir, url := wantedVCS(i), repoDir, repoURL(i.Repo)
+	switch {
+	case name == proxyVCS{}.Name():
+		module, err := findModule(ctx, log, i.Package)
+		if err != nil {
+			return err
+		}
+		dir = path.Join(trashDir, "src", module)
+		url = proxyURL + "/" + module
+	case i.Repo == "":
+		root, err := resolverFor(trashDir).resolve(ctx, log, i.Package)
+		if err != nil {
+			return err
+		}
+		dir = path.Join(trashDir, "src", root.Root)
+		url = root.Repo
+		if name == "" {
+			name = root.VCS
+		}
 	}
-	args = append(args, i.Package)
-	if bytes, err := exec.Command("go", args...).CombinedOutput(); err != nil {
-		logrus.WithFields(logrus.Fields{"err": err}).Debugf("`go %s` returned err:\n%s", strings.Join(args, " "), bytes)
+	if name == "" {
+		name = gitVCS{}.Name()
 	}
-	if err := os.MkdirAll(repoDir, 0755); err != nil {
-		logrus.WithFields(logrus.Fields{"err": err, "repoDir": repoDir}).Error("os.MkdirAll() failed")
+	v, err := vcsByName(name)
+	if err != nil {
 		return err
 	}
-	os.Chdir(repoDir)
-	if !isCurrentDirARepo(trashDir) {
-		logrus.WithFields(logrus.Fields{"repoDir": repoDir}).Debug("not a git repo, creating one")
-		exec.Command("git", "init", "-q").Run()
-	}
-	if i.Repo != "" {
-		addRemote(i.Repo)
+	if err := os.RemoveAll(repoDir); err != nil {
+		return err
 	}
-	return nil
-}
-
-func fetch(i conf.Import) error {
-	remote := remoteName(i.Repo)
-	logrus.Infof("Fetching latest commits from '%s' for '%s'", remote, i.Package)
-	if bytes, err := exec.Command("git", "fetch", "-f", "-t", remote).CombinedOutput(); err != nil {
-		logrus.Errorf("`git fetch -f -t %s` failed:\n%s", remote, bytes)
+	if err := os.RemoveAll(dir); err != nil {
 		return err
 	}
-	return nil
+	return v.Clone(ctx, log, dir, i.Repo, url)
 }
 
 func parentPackages(root, p string) util.Packages {
@@ -588,7 +990,7 @@ func listImports(rootPackage, libRoot, pkg string, cfg *conf.Conf) <-chan util.P
 		logrus.Infof("Collecting imports for package '%s'", pkg)
 		for _, p := range ps {
 			// Ignore main package in vendor directory.
-			if p.Name == "main" && strings.HasPrefix(pkgPath, "vendor/") {
+			if p.Name == "main" && strings.HasPrefix(pkgPath, libRoot+"/") {
 				fmt.Printf("Program %s in vendor directory is ignored.\n", pkgPath)
 				continue
 			}
@@ -772,7 +1174,65 @@ func collectImports(rootPackage, libRoot, targetDir string, cfg *conf.Conf) util
 	return imports
 }
 
-func removeUnusedImports(imports util.Packages, targetDir string) error {
+// widenSparseCheckouts adds the dirs of the packages the project in dir
+// needs, directly or not, to the sparse checkouts of the cache, until they
+// have them all. Imports also need the staging dirs they copy, and the
+// manifests in subdirs they read dependencies from.
+func widenSparseCheckouts(trashDir, dir, targetDir string, trashConf *conf.Conf) error {
+	if !sparseCheckout {
+		return nil
+	}
+	rootPackage := trashConf.Package
+	if rootPackage == "" {
+		var err error
+		if rootPackage, err = guessRootPackage(dir); err != nil {
+			return err
+		}
+	}
+	rootPackage = strings.Trim(rootPackage, "/")
+	libRoot := filepath.Join(trashDir, "src")
+
+	for widened := true; widened; {
+		dirs := map[string][]string{} // by repo root
+		need := func(p string) {
+			v, root, ok := detectVCS(p, libRoot)
+			if !ok || v.Name() != (gitVCS{}).Name() {
+				return
+			}
+			if rel, err := filepath.Rel(root, p); err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+				dirs[root] = append(dirs[root], filepath.ToSlash(rel))
+			}
+		}
+		for pkg := range collectImports(rootPackage, libRoot, targetDir, trashConf) {
+			need(filepath.Join(libRoot, pkg))
+		}
+		for _, i := range trashConf.Imports {
+			if i.Staging {
+				need(filepath.Join(libRoot, i.Package, "staging"))
+			}
+			if i.Transitive {
+				need(filepath.Join(libRoot, i.Package, "Godeps"))
+				need(filepath.Join(libRoot, i.Package, "vendor"))
+			}
+		}
+
+		widened = false
+		for root, ds := range dirs {
+			var added bool
+			err := withRepoLock(trashDir, strings.TrimPrefix(root, libRoot+"/"), func() (err error) {
+				added, err = addSparseDirs(root, ds)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("could not widen the sparse checkout of '%s': %s", root, err)
+			}
+			widened = widened || added
+		}
+	}
+	return nil
+}
+
+func removeUnusedImports(imports util.Packages, targetDir string, rep *report) error {
 	importsParents := util.Packages{}
 	for i := range imports {
 		importsParents.Merge(parentPackages("", i))
@@ -792,7 +1252,11 @@ func removeUnusedImports(imports util.Packages, targetDir string) error {
 			pkg := path[len(targetDir+"/"):strings.LastIndex(path, "/")]
 			if strings.HasSuffix(path, "_test.go") || strings.HasSuffix(path, ".go") && !imports[pkg] {
 				logrus.Debugf("Removing unused source file: '%s'", path)
-				if err := os.Remove(path); err != nil {
+				reason := "source file of an unused package"
+				if strings.HasSuffix(path, "_test.go") {
+					reason = "test file"
+				}
+				if err := rep.remove(path, reason); err != nil {
 					if os.IsNotExist(err) {
 						return nil
 					}
@@ -805,7 +1269,7 @@ func removeUnusedImports(imports util.Packages, targetDir string) error {
 		pkg := path[len(targetDir+"/"):]
 		if !imports[pkg] && !importsParents[pkg] {
 			logrus.Infof("Removing unused dir: '%s'", path)
-			err := os.RemoveAll(path)
+			err := rep.removeAll(path, "not imported")
 			if err == nil {
 				return filepath.SkipDir
 			}
@@ -819,7 +1283,7 @@ func removeUnusedImports(imports util.Packages, targetDir string) error {
 	})
 }
 
-func removeExcludes(excludes []string, targetDir string) error {
+func removeExcludes(excludes []string, targetDir string, rep *report) error {
 	exclude := make(map[string]bool)
 	for _, dir := range excludes {
 		exclude[dir] = true
@@ -838,7 +1302,7 @@ func removeExcludes(excludes []string, targetDir string) error {
 		pkg := path[len(targetDir+"/"):]
 		if exclude[pkg] {
 			logrus.Infof("Removing excluded dir: '%s'", path)
-			err := os.RemoveAll(path)
+			err := rep.removeAll(path, "excluded")
 			if err == nil {
 				return filepath.SkipDir
 			}
@@ -852,7 +1316,7 @@ func removeExcludes(excludes []string, targetDir string) error {
 	})
 }
 
-func removeEmptyDirs(targetDir string) error {
+func removeEmptyDirs(targetDir string, rep *report) error {
 	for count := 1; count != 0; {
 		count = 0
 		if err := filepath.Walk(targetDir, func(path string, info os.FileInfo, err error) error {
@@ -867,7 +1331,7 @@ func removeEmptyDirs(targetDir string) error {
 				return nil
 			}
 			if info.IsDir() {
-				err := os.Remove(path)
+				err := rep.remove(path, "empty")
 				if err == nil {
 					logrus.Infof("Removed Empty dir: '%s'", path)
 					count++
@@ -885,49 +1349,53 @@ func removeEmptyDirs(targetDir string) error {
 	return nil
 }
 
-func guessRootPackage(dir string) string {
+func guessRootPackage(dir string) (string, error) {
 	logrus.Warn("Trying to guess the root package using GOPATH. It's best to specify it in `vendor.conf`")
 	logrus.Warnf("GOPATH is '%s'", gopath)
 	if gopath == "" || strings.Contains(gopath, ":") {
-		logrus.Fatalf("GOPATH not set or is not a single path. You need to specify the root package!")
+		return "", fmt.Errorf("GOPATH not set or is not a single path. You need to specify the root package!")
 	}
 	srcPath := filepath.Clean(path.Join(gopath, "src"))
 	if !strings.HasPrefix(dir, srcPath+"/") {
-		logrus.Fatalf("Your project dir is not a subdir of $GOPATH/src. You need to specify the root package!")
+		return "", fmt.Errorf("Your project dir is not a subdir of $GOPATH/src. You need to specify the root package!")
 	}
 	if _, err := os.Stat(srcPath); err != nil {
-		logrus.Fatalf("It didn't work: $GOPATH/src does not exist or something: %s", err)
+		return "", fmt.Errorf("It didn't work: $GOPATH/src does not exist or something: %s", err)
 	}
 	logrus.Debugf("srcPath: '%s'", srcPath)
-	return dir[len(srcPath+"/"):]
+	return dir[len(srcPath+"/"):], nil
 }
 
-func cleanup(dir, targetDir string, trashConf *conf.Conf) error {
+// cleanup prunes vendorDir, keeping only what the packages of the project in
+// dir (outside of its targetDir) import. Everything removed is recorded in
+// rep, if it is not nil.
+func cleanup(dir, targetDir, vendorDir string, trashConf *conf.Conf, rep *report) error {
 	rootPackage := trashConf.Package
 	if rootPackage == "" {
-		rootPackage = guessRootPackage(dir)
+		var err error
+		if rootPackage, err = guessRootPackage(dir); err != nil {
+			return err
+		}
 	}
 
 	logrus.Debugf("rootPackage: '%s'", rootPackage)
 
-	os.Chdir(dir)
-
-	imports := collectImports(rootPackage, targetDir, targetDir, trashConf)
-	if err := removeExcludes(trashConf.Excludes, targetDir); err != nil {
+	imports := collectImports(rootPackage, vendorDir, targetDir, trashConf)
+	if err := removeExcludes(trashConf.Excludes, vendorDir, rep); err != nil {
 		logrus.Errorf("Error removing excluded dirs: %v", err)
 	}
-	if err := removeUnusedImports(imports, targetDir); err != nil {
+	if err := removeUnusedImports(imports, vendorDir, rep); err != nil {
 		logrus.Errorf("Error removing unused dirs: %v", err)
 	}
-	if err := removeEmptyDirs(targetDir); err != nil {
+	if err := removeEmptyDirs(vendorDir, rep); err != nil {
 		logrus.Errorf("Error removing empty dirs: %v", err)
 	}
-	if err := removeUnusedFiles(targetDir); err != nil {
+	if err := removeUnusedFiles(vendorDir, rep); err != nil {
 		logrus.Errorf("Error removing unused doc files: %v", err)
 	}
 
 	for _, i := range trashConf.Imports {
-		pth := dir + "/" + targetDir + "/" + i.Package
+		pth := vendorDir + "/" + i.Package
 		if _, err := os.Stat(pth); err != nil {
 			if os.IsNotExist(err) {
 				logrus.Warnf("Package '%s' has been completely removed: it's probably useless (in %s)", i.Package, trashConf.ConfFile())
@@ -967,7 +1435,7 @@ func isGoFile(f string) bool {
 	return goSuffixes[parts[len(parts)-1]]
 }
 
-func removeUnusedFiles(targetDir string) error {
+func removeUnusedFiles(targetDir string, rep *report) error {
 	return filepath.Walk(targetDir, func(path string, info os.FileInfo, err error) error {
 		if os.IsNotExist(err) {
 			return filepath.SkipDir
@@ -983,7 +1451,7 @@ func removeUnusedFiles(targetDir string) error {
 		}
 
 		if !isGoFile(info.Name()) && !isLicenseFile(info.Name()) {
-			return os.Remove(path)
+			return rep.remove(path, "not a source or license file")
 		}
 		return nil
 	})
@@ -1,17 +1,29 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"go/parser"
 	"go/token"
+	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/mountkin/trash/conf"
 	"github.com/stretchr/testify/require"
 )
 
+func TestMain(m *testing.M) {
+	// the tests fetch from local repos, and retry failures without waiting
+	allowFile = true
+	retryBackoff = time.Millisecond
+	os.Exit(m.Run())
+}
+
 func TestCollectImports(t *testing.T) {
 	defer logrus.SetLevel(logrus.GetLevel())
 	logrus.SetLevel(logrus.FatalLevel)
@@ -24,12 +36,12 @@ func TestCollectImports(t *testing.T) {
 	trashCache := path.Join(os.Getenv("HOME"), ".trash-cache")
 
 	// Test that build tags are ignored
-	allPackages := collectImports(".", libRoot, trashCache, []string{})
+	allPackages := collectImports(".", libRoot, trashCache, &conf.Conf{})
 	assert.Equal(2, len(allPackages))
 	assert.Contains(allPackages, "github.com/Sirupsen/logrus")
 
 	// Test that a build tag can be used to filter
-	filteredPackages := collectImports(".", libRoot, trashCache, []string{"ignore"})
+	filteredPackages := collectImports(".", libRoot, trashCache, &conf.Conf{IgnoredTags: []string{"ignore"}})
 	assert.Equal(1, len(filteredPackages))
 	assert.NotContains(filteredPackages, "github.com/Sirupsen/logrus")
 }
@@ -72,9 +84,175 @@ func TestListPackages(t *testing.T) {
 	assert := require.New(t)
 	p := listPackages("github.com/rancher/trash", "vendor")
 	logrus.Debug(p)
-	assert.Equal(4, len(p))
+	assert.Equal(5, len(p))
 	assert.Contains(p, "github.com/rancher/trash")
 	assert.Contains(p, "github.com/rancher/trash/util")
 	assert.Contains(p, "github.com/rancher/trash/conf")
+	assert.Contains(p, "github.com/rancher/trash/semver")
 	assert.Contains(p, "github.com/rancher/trash/test")
 }
+
+func TestWidenSparseCheckouts(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "trash-sparse")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	defer func() { sparseCheckout = false }()
+
+	upstream := filepath.Join(dir, "upstream")
+	files := map[string]string{
+		"LICENSE":       "MIT",
+		"a/a.go":        `package a; import _ "example.com/f/b"`,
+		"b/b.go":        "package b",
+		"b/sub/sub.go":  "package sub",
+		"c/c.go":        "package c",
+		"staging/s.go":  "package s",
+		"proj/main.go":  `package main; import _ "example.com/f/a"`,
+		"proj/other.go": "package main",
+	}
+	for name, content := range files {
+		assert.NoError(os.MkdirAll(filepath.Dir(filepath.Join(upstream, name)), 0755))
+		assert.NoError(ioutil.WriteFile(filepath.Join(upstream, name), []byte(content), 0644))
+	}
+	for _, args := range [][]string{{"init", "-q"}, {"add", "-A"}, {"-c", "user.name=t", "-c", "user.email=t@example.com", "commit", "-q", "-m", "one"}} {
+		_, err := combinedOutput(git(upstream, args...))
+		assert.NoError(err)
+	}
+
+	sparseCheckout = true
+	trashDir := filepath.Join(dir, "cache")
+	repoDir := filepath.Join(trashDir, "src", "example.com", "f")
+	v := gitVCS{}
+	assert.NoError(v.Clone(ctx, stdLog, repoDir, upstream, upstream))
+	assert.NoError(v.Checkout(ctx, stdLog, repoDir, upstream, "master"))
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(repoDir, name))
+		return err == nil
+	}
+	assert.True(exists("LICENSE"))
+	assert.False(exists("a"))
+
+	wd, err := os.Getwd()
+	assert.NoError(err)
+	assert.NoError(os.Chdir(filepath.Join(upstream, "proj")))
+	defer os.Chdir(wd)
+	trashConf := &conf.Conf{Package: "example.com/proj", Imports: []conf.Import{
+		{Package: "example.com/f", Version: "master", Repo: upstream, Options: conf.Options{Staging: true}},
+	}}
+	assert.NoError(widenSparseCheckouts(trashDir, ".", "vendor", trashConf))
+	for name, present := range map[string]bool{"a/a.go": true, "b/b.go": true, "b/sub/sub.go": true, "staging/s.go": true, "c": false, "proj": false} {
+		assert.Equal(present, exists(name), name)
+	}
+
+	// another run sharing the cache narrows it at the same commit: it is
+	// widened again before copying
+	commit, _, err := v.Current(repoDir)
+	assert.NoError(err)
+	_, err = combinedOutput(git(repoDir, "sparse-checkout", "set", "--cone"))
+	assert.NoError(err)
+	assert.False(exists("a"))
+	assert.NoError(atCommit(ctx, stdLog, trashDir, trashConf.Imports[0], commit, func() error {
+		assert.True(exists("a/a.go"))
+		assert.True(exists("staging/s.go"))
+		return nil
+	}))
+
+	// without --sparse, the checkout is full again
+	sparseCheckout = false
+	assert.NoError(v.Checkout(ctx, stdLog, repoDir, upstream, "master"))
+	assert.True(exists("c/c.go"))
+}
+
+func TestOffline(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "trash-offline")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	defer func() { offline = false }()
+
+	upstream := filepath.Join(dir, "upstream")
+	assert.NoError(os.MkdirAll(upstream, 0755))
+	run := func(args ...string) {
+		_, err := combinedOutput(git(upstream, append([]string{"-c", "user.name=t", "-c", "user.email=t@example.com"}, args...)...))
+		assert.NoError(err, "%v", args)
+	}
+	commit := func(msg string) string {
+		assert.NoError(ioutil.WriteFile(filepath.Join(upstream, "f.go"), []byte("package f // "+msg+"\n"), 0644))
+		run("add", "-A")
+		run("commit", "-q", "-m", msg)
+		head, _, err := gitVCS{}.Current(upstream)
+		assert.NoError(err)
+		return head
+	}
+	run("init", "-q")
+	one := commit("one")
+	run("tag", "v1.0.0")
+	two := commit("two")
+
+	trashDir := filepath.Join(dir, "cache")
+	i := conf.Import{Package: "example.com/f", Version: "master", Repo: upstream}
+	assert.NoError(checkoutImport(ctx, stdLog, trashDir, i))
+	three := commit("three")
+
+	// the upstream repo is gone: anything fetched would fail
+	assert.NoError(os.Rename(upstream, upstream+".gone"))
+	offline = true
+	assert.NoError(checkoutImport(ctx, stdLog, trashDir, i))
+	li, err := lockImport(trashDir, i)
+	assert.NoError(err)
+	assert.Equal(two, li.Commit)
+	i.Version = "v1.0.0"
+	assert.NoError(checkoutImport(ctx, stdLog, trashDir, i))
+	li, err = lockImport(trashDir, i)
+	assert.NoError(err)
+	assert.Equal(one, li.Commit)
+
+	i.Version = three
+	err = checkoutImport(ctx, stdLog, trashDir, i)
+	assert.Error(err)
+	assert.Contains(err.Error(), "'"+three+"' of 'example.com/f' is not in the cache")
+	li.Commit = three
+	err = checkoutLocked(ctx, stdLog, trashDir, i, li)
+	assert.Error(err)
+	assert.Contains(err.Error(), "locked commit '"+three+"'")
+	err = checkoutImport(ctx, stdLog, trashDir, conf.Import{Package: "example.com/g", Version: "master", Repo: upstream})
+	assert.Error(err)
+	assert.Contains(err.Error(), "--offline")
+}
+
+func TestMovedTag(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "trash-moved")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	defer func() { offline = false }()
+
+	upstream := filepath.Join(dir, "upstream")
+	commits := makeUpstream(t, upstream)
+	run := func(args ...string) {
+		_, err := combinedOutput(git(upstream, append([]string{"-c", "user.name=t", "-c", "user.email=t@example.com"}, args...)...))
+		assert.NoError(err, "%v", args)
+	}
+	trashDir := filepath.Join(dir, "cache")
+	i := conf.Import{Package: "example.com/f", Version: "v1.0.0", Repo: upstream}
+	assert.NoError(checkoutImport(ctx, stdLog, trashDir, i))
+	li, err := lockImport(trashDir, i)
+	assert.NoError(err)
+	assert.NoError(checkoutLocked(ctx, stdLog, trashDir, i, li))
+
+	// the locked commit is in the cache, but the tag is checked upstream
+	run("tag", "-f", "v1.0.0", commits[1])
+	err = checkoutLocked(ctx, stdLog, trashDir, i, li)
+	assert.Error(err)
+	assert.Contains(err.Error(), "tag 'v1.0.0' of 'example.com/f' points to "+commits[1])
+	offline = true
+	assert.NoError(checkoutLocked(ctx, stdLog, trashDir, i, li))
+	offline = false
+
+	// annotated tags are compared by the commit they point to
+	run("tag", "-f", "-a", "-m", "v1.0.0", "v1.0.0", commits[0])
+	assert.NoError(checkoutLocked(ctx, stdLog, trashDir, i, li))
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// vendorTx builds a new vendor dir next to the current one (a dot dir, so
+// that it is not mistaken for a package of the project) and swaps it in only
+// when it is complete. Until then, the current vendor dir is left alone,
+// even if trash is interrupted.
+//
+// The swap is two renames (the current dir out of the way, then the new one
+// in place), as there is no portable way to exchange two dirs: a trash killed
+// in between leaves no vendor dir, but the old one, which the next
+// beginVendor puts back. A run holds the flock of its new vendor dir, so that
+// the next beginVendor also removes the ones of the runs that were killed,
+// but not the ones of the runs in progress.
+type vendorTx struct {
+	vendorDir string
+	newDir    string   // where the new vendor dir is built
+	newLock   *os.File // holds the flock of newDir
+
+	mu   sync.Mutex
+	done bool
+	sigs chan os.Signal
+}
+
+// beginVendor starts building a new vendor dir to replace vendorDir. Either
+// commit or rollback must be called.
+func beginVendor(vendorDir string) (*vendorTx, error) {
+	parent, base := filepath.Split(vendorDir)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, err
+	}
+	if err := recoverVendor(vendorDir); err != nil {
+		return nil, err
+	}
+	newDir, err := ioutil.TempDir(parent, "."+base+".new-")
+	if err != nil {
+		return nil, err
+	}
+	mode := os.FileMode(0755) // rather than the 0700 of temp dirs
+	if fi, err := os.Stat(vendorDir); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	if err := os.Chmod(newDir, mode); err != nil {
+		os.RemoveAll(newDir)
+		return nil, err
+	}
+	newLock, err := tryLockDir(newDir)
+	if err != nil {
+		os.RemoveAll(newDir)
+		return nil, err
+	}
+	tx := &vendorTx{vendorDir: vendorDir, newDir: newDir, newLock: newLock, sigs: make(chan os.Signal, 1)}
+	signal.Notify(tx.sigs, os.Interrupt, syscall.SIGTERM)
+	go tx.handleSignals()
+	return tx, nil
+}
+
+// recoverVendor puts back the vendor dir a commit interrupted between its
+// renames moved out of the way, and drops those it did not get to remove, as
+// well as the new vendor dirs of the runs killed before their commit.
+func recoverVendor(vendorDir string) error {
+	parent, base := filepath.Split(vendorDir)
+	news, err := filepath.Glob(filepath.Join(parent, "."+base+".new-*"))
+	if err != nil {
+		return err
+	}
+	for _, n := range news {
+		f, err := tryLockDir(n)
+		if err != nil {
+			continue // being built by another run
+		}
+		logrus.Warnf("Removing '%s', which an interrupted run left", n)
+		err = os.RemoveAll(n)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	olds, err := filepath.Glob(filepath.Join(parent, "."+base+".old-*"))
+	if err != nil || len(olds) == 0 {
+		return err
+	}
+	if _, err := os.Lstat(vendorDir); os.IsNotExist(err) {
+		latest := olds[0]
+		for _, old := range olds {
+			if a, b := modTime(old), modTime(latest); a.After(b) {
+				latest = old
+			}
+		}
+		logrus.Warnf("Restoring '%s', which an interrupted run left as '%s'", vendorDir, latest)
+		if err := os.Rename(latest, vendorDir); err != nil {
+			return err
+		}
+	}
+	for _, old := range olds {
+		if err := os.RemoveAll(old); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tryLockDir takes the flock of dir, unless another process holds it. Closing
+// the file returned releases it.
+func tryLockDir(dir string) (*os.File, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func modTime(path string) time.Time {
+	if fi, err := os.Lstat(path); err == nil {
+		return fi.ModTime()
+	}
+	return time.Time{}
+}
+
+func (tx *vendorTx) handleSignals() {
+	sig, ok := <-tx.sigs
+	if !ok {
+		return
+	}
+	tx.mu.Lock() // never interrupt a swap
+	defer tx.mu.Unlock()
+	if !tx.done {
+		os.RemoveAll(tx.newDir)
+		logrus.Errorf("Interrupted by %s: '%s' left as it was", sig, tx.vendorDir)
+	}
+	os.Exit(1)
+}
+
+func (tx *vendorTx) finish() {
+	tx.done = true
+	tx.newLock.Close()
+	signal.Stop(tx.sigs)
+	close(tx.sigs)
+}
+
+// copyCurrent fills the new vendor dir with a copy of the current one, for
+// the changes that only touch some of its packages.
+func (tx *vendorTx) copyCurrent() error {
+	if _, err := os.Stat(tx.vendorDir); os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := combinedOutput(exec.Command("cp", "-a", tx.vendorDir+"/.", tx.newDir)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// commit replaces the vendor dir with the new one.
+func (tx *vendorTx) commit() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return fmt.Errorf("vendor dir transaction already finished")
+	}
+	defer tx.finish()
+
+	oldDir := ""
+	if _, err := os.Lstat(tx.vendorDir); err == nil {
+		parent, base := filepath.Split(tx.vendorDir)
+		if oldDir, err = ioutil.TempDir(parent, "."+base+".old-"); err != nil {
+			os.RemoveAll(tx.newDir)
+			return err
+		}
+		os.Remove(oldDir) // only the name is needed
+		if err := os.Rename(tx.vendorDir, oldDir); err != nil {
+			os.RemoveAll(tx.newDir)
+			return err
+		}
+	}
+	if err := os.Rename(tx.newDir, tx.vendorDir); err != nil {
+		if oldDir != "" {
+			os.Rename(oldDir, tx.vendorDir)
+		}
+		os.RemoveAll(tx.newDir)
+		return err
+	}
+	if oldDir != "" {
+		return os.RemoveAll(oldDir)
+	}
+	return nil
+}
+
+// rollback drops the new vendor dir, leaving the current one as it is. It
+// does nothing after commit, so that it can be deferred.
+func (tx *vendorTx) rollback() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return
+	}
+	defer tx.finish()
+	os.RemoveAll(tx.newDir)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVendorTx(t *testing.T) {
+	assert := require.New(t)
+	dir, err := ioutil.TempDir("", "trash-tx")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	vendorDir := filepath.Join(dir, "vendor")
+
+	// No vendor dir yet
+	tx, err := beginVendor(vendorDir)
+	assert.NoError(err)
+	assert.NoError(ioutil.WriteFile(filepath.Join(tx.newDir, "a"), []byte("1"), 0644))
+	assert.NoError(tx.commit())
+	tx.rollback() // no-op after commit
+	assertFile(t, filepath.Join(vendorDir, "a"), "1")
+	fi, err := os.Stat(vendorDir)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0755), fi.Mode().Perm())
+
+	// Rollback leaves the vendor dir alone
+	tx, err = beginVendor(vendorDir)
+	assert.NoError(err)
+	assert.NoError(ioutil.WriteFile(filepath.Join(tx.newDir, "a"), []byte("2"), 0644))
+	tx.rollback()
+	assertFile(t, filepath.Join(vendorDir, "a"), "1")
+	_, err = os.Stat(tx.newDir)
+	assert.True(os.IsNotExist(err))
+
+	// Changes on top of a copy of the current vendor dir
+	tx, err = beginVendor(vendorDir)
+	assert.NoError(err)
+	assert.NoError(tx.copyCurrent())
+	assert.NoError(ioutil.WriteFile(filepath.Join(tx.newDir, "b"), []byte("3"), 0644))
+	assert.NoError(tx.commit())
+	assertFile(t, filepath.Join(vendorDir, "a"), "1")
+	assertFile(t, filepath.Join(vendorDir, "b"), "3")
+	assert.Error(tx.commit())
+
+	// The mode of the vendor dir is kept
+	assert.NoError(os.Chmod(vendorDir, 0750))
+	tx, err = beginVendor(vendorDir)
+	assert.NoError(err)
+	assert.NoError(tx.copyCurrent())
+	assert.NoError(tx.commit())
+	fi, err = os.Stat(vendorDir)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0750), fi.Mode().Perm())
+
+	// A vendor dir moved out of the way by an interrupted commit is put back
+	assert.NoError(os.Rename(vendorDir, filepath.Join(dir, ".vendor.old-123")))
+	tx, err = beginVendor(vendorDir)
+	assert.NoError(err)
+	tx.rollback()
+	assertFile(t, filepath.Join(vendorDir, "b"), "3")
+
+	// So are the new vendor dirs of killed runs dropped, but not the ones of
+	// runs in progress
+	killed := filepath.Join(dir, ".vendor.new-123")
+	assert.NoError(os.Mkdir(killed, 0755))
+	inProgress, err := beginVendor(vendorDir)
+	assert.NoError(err)
+	tx, err = beginVendor(vendorDir)
+	assert.NoError(err)
+	_, err = os.Stat(killed)
+	assert.True(os.IsNotExist(err))
+	assert.True(isDir(inProgress.newDir))
+	tx.rollback()
+	inProgress.rollback()
+
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(err)
+	assert.Len(files, 1, "no leftovers next to the vendor dir")
+}
+
+func assertFile(t *testing.T, path, content string) {
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, content, string(b))
+}
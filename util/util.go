@@ -1,12 +1,14 @@
 package util
 
 import (
-	"bufio"
-	"os/exec"
-	"strings"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
 	"sync"
-
-	"github.com/Sirupsen/logrus"
 )
 
 type Packages map[string]bool
@@ -27,27 +29,6 @@ func ChanPackages(f func() Packages) <-chan Packages {
 	return c
 }
 
-func CmdOutLines(cmd *exec.Cmd) <-chan string {
-	r := make(chan string, 1000)
-	out, err := cmd.StdoutPipe()
-	if err != nil {
-		logrus.Fatalf("Could not obtain stdout of `%s`: %s", strings.Join(cmd.Args, " "), err)
-	}
-	scanner := bufio.NewScanner(out)
-	go func() {
-		defer close(r)
-		defer out.Close()
-		defer cmd.Wait()
-		for scanner.Scan() {
-			r <- scanner.Text()
-		}
-	}()
-	if err := cmd.Start(); err != nil {
-		logrus.Fatalf("Could not start `%s`: %s", strings.Join(cmd.Args, " "), err)
-	}
-	return r
-}
-
 func MergePackagesChans(cs ...<-chan Packages) <-chan Packages {
 	out := make(chan Packages)
 	wg := sync.WaitGroup{}
@@ -95,3 +76,62 @@ func OneStr(s string) <-chan string {
 	c <- s
 	return c
 }
+
+// HashDir returns a hash of all the files under dir, in the spirit of the h1:
+// hashes in go.sum: the SHA-256 of the sorted list of per file SHA-256 sums
+// and paths relative to dir. Symlinks are hashed by their target.
+func HashDir(dir string) (string, error) {
+	var files []string
+	if err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	}); err != nil {
+		return "", err
+	}
+	sort.Strings(files)
+
+	h := sha256.New()
+	for _, f := range files {
+		sum, err := hashFile(filepath.Join(dir, filepath.FromSlash(f)))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%x  %s\n", sum, f)
+	}
+	return "h1:" + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashFile(p string) ([]byte, error) {
+	h := sha256.New()
+	info, err := os.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(p)
+		if err != nil {
+			return nil, err
+		}
+		io.WriteString(h, "symlink:"+target)
+		return h.Sum(nil), nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
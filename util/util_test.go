@@ -1,6 +1,10 @@
 package util
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -17,3 +21,32 @@ func TestOneMsg(t *testing.T) {
 	s, ok = <-c
 	assert.False(ok)
 }
+
+func TestHashDir(t *testing.T) {
+	assert := require.New(t)
+	dir, err := ioutil.TempDir("", "trash-hash")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(os.MkdirAll(filepath.Join(dir, "a/b"), 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "a/b/c.go"), []byte("package b\n"), 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "LICENSE"), []byte("MIT\n"), 0644))
+
+	h1, err := HashDir(dir)
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(h1, "h1:"))
+
+	h2, err := HashDir(dir)
+	assert.NoError(err)
+	assert.Equal(h1, h2)
+
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "a/b/c.go"), []byte("package c\n"), 0644))
+	h3, err := HashDir(dir)
+	assert.NoError(err)
+	assert.NotEqual(h1, h3)
+
+	assert.NoError(os.Rename(filepath.Join(dir, "a/b/c.go"), filepath.Join(dir, "a/b/d.go")))
+	h4, err := HashDir(dir)
+	assert.NoError(err)
+	assert.NotEqual(h3, h4)
+}
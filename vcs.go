@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mountkin/trash/conf"
+)
+
+// VCS is a version control system the cache repos can be kept in.
+//
+// The url arguments are the repo of the import (conf.Import.Repo), empty for
+// the repo the import path points to. The methods that may use the network
+// take a context: their commands are killed once it is done, and they retry
+// what fails (see retry).
+type VCS interface {
+	// Name is what selects the backend in the vcs: field of an import.
+	Name() string
+	// MetaDir is the dir holding the metadata of a checkout, e.g. ".git".
+	MetaDir() string
+
+	// Clone makes dir a repo to fetch repo into, from url (repo itself when
+	// not empty): it clones url, or just registers it with the repo already
+	// there, when the VCS allows.
+	Clone(ctx context.Context, log *logrus.Entry, dir, repo, url string) error
+	// Fetch gets the latest commits and tags from url.
+	Fetch(ctx context.Context, log *logrus.Entry, dir, url string) error
+	// IsBranch tells whether rev is a branch of url (rather than a tag or a
+	// commit), so that it has to be fetched before it is checked out.
+	IsBranch(dir, url, rev string) (bool, error)
+	// Checkout checks out rev, a tag, branch or commit of url.
+	Checkout(ctx context.Context, log *logrus.Entry, dir, url, rev string) error
+
+	// Current returns the commit checked out in dir and its date (RFC 3339).
+	Current(dir string) (commit, date string, err error)
+	// Describe names the commit checked out in dir after the latest tag.
+	Describe(dir string) (string, error)
+	// Tags lists the tags of the repo in dir, and those of its remotes when
+	// the VCS does not keep them all locally.
+	Tags(ctx context.Context, log *logrus.Entry, dir string) ([]string, error)
+	// TagCommit returns the commit tag points to, if there is such a tag.
+	TagCommit(dir, tag string) (string, bool)
+	// HasCommit tells whether commit is in the repo in dir already.
+	HasCommit(dir, commit string) bool
+	// Root returns the root dir of the checkout dir is in.
+	Root(dir string) (string, error)
+	// RemoteURL returns the actual URL url stands for in the repo in dir.
+	RemoteURL(dir, url string) string
+}
+
+// vcsList are the backends trash knows, the default first.
+var vcsList = []VCS{gitVCS{}, hgVCS{}, svnVCS{}, bzrVCS{}, proxyVCS{}, archiveVCS{}}
+
+// vcsByName returns the backend named name.
+func vcsByName(name string) (VCS, error) {
+	for _, v := range vcsList {
+		if v.Name() == name {
+			return v, nil
+		}
+	}
+	var names []string
+	for _, v := range vcsList {
+		names = append(names, v.Name())
+	}
+	return nil, fmt.Errorf("unknown vcs '%s', expected one of %s", name, strings.Join(names, ", "))
+}
+
+// detectVCS finds the checkout dir is in, looking no higher than top. It
+// returns the backend and the root of the checkout.
+func detectVCS(dir, top string) (VCS, string, bool) {
+	top = filepath.Clean(top)
+	for d := filepath.Clean(dir); d != top && strings.HasPrefix(d, top+"/"); d = filepath.Dir(d) {
+		for _, v := range vcsList {
+			if fi, err := os.Stat(filepath.Join(d, v.MetaDir())); err == nil && fi.IsDir() {
+				return v, d, true
+			}
+		}
+	}
+	return nil, "", false
+}
+
+// offline forbids any network access: everything has to come from the cache.
+var offline bool
+
+// offlineError says what is missing from the cache, when --offline forbids
+// fetching it.
+func offlineError(format string, args ...interface{}) error {
+	return fmt.Errorf(format+" is not in the cache, and --offline forbids fetching it", args...)
+}
+
+// fetch runs v.Fetch, unless --offline is set: then the repo stays as it was
+// last fetched (unless url is a local bundle file).
+func fetch(ctx context.Context, log *logrus.Entry, v VCS, dir, url string) error {
+	if offline && !isBundle(url) {
+		log.Debugf("Not fetching '%s': offline", dir)
+		return nil
+	}
+	return v.Fetch(ctx, log, dir, url)
+}
+
+// wantedVCS names the backend i has to be fetched with: archives if that is
+// its source, the one of its vcs: field, the proxy if there is one and i has
+// no repo or source of its own, or "" if any will do.
+func wantedVCS(i conf.Import) string {
+	source := i.Source
+	if source == "" {
+		source = defaultSource
+	}
+	switch {
+	case source == conf.SourceArchive:
+		return archiveVCS{}.Name()
+	case i.VCS == "" && i.Repo == "" && i.Source == "" && proxyURL != "":
+		return proxyVCS{}.Name()
+	}
+	return i.VCS
+}
+
+// repoOf returns the backend of i and the root of its repo in the cache,
+// where its commands run: the dir of the package itself may not be checked
+// out yet. The backend is the one i wants, else the one of the repo.
+func repoOf(trashDir string, i conf.Import) (VCS, string, error) {
+	v, root, ok := detectVCS(filepath.Join(trashDir, "src", i.Package), filepath.Join(trashDir, "src"))
+	if !ok {
+		return nil, "", fmt.Errorf("no repo of '%s' in the cache", i.Package)
+	}
+	if name := wantedVCS(i); name != "" {
+		w, err := vcsByName(name)
+		return w, root, err
+	}
+	return v, root, nil
+}
+
+// commandTimeout is how long a VCS command may run (--command-timeout).
+var commandTimeout = 10 * time.Minute
+
+// command returns the command name args, to run in dir with runCommand (or
+// output or combinedOutput).
+func command(dir, name string, args ...string) *exec.Cmd {
+	return commandContext(context.Background(), dir, name, args...)
+}
+
+// commandContext is command, killed as well once ctx is done.
+func commandContext(ctx context.Context, dir, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	return cmd
+}
+
+// runCommand runs cmd, killing it if it runs longer than commandTimeout.
+func runCommand(cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	timer := time.AfterFunc(commandTimeout, func() { cmd.Process.Kill() })
+	err := cmd.Wait()
+	if !timer.Stop() && err != nil {
+		return fmt.Errorf("timed out after %s (see --command-timeout)", commandTimeout)
+	}
+	return err
+}
+
+// outputLines runs cmd and returns the non empty lines of its output.
+func outputLines(cmd *exec.Cmd) ([]string, error) {
+	out, err := output(cmd)
+	if err != nil {
+		return nil, err
+	}
+	var r []string
+	for _, l := range strings.Split(string(out), "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			r = append(r, l)
+		}
+	}
+	return r, nil
+}
+
+// outputString runs cmd and returns its trimmed output.
+func outputString(cmd *exec.Cmd) (string, error) {
+	b, err := output(cmd)
+	return strings.TrimSpace(string(b)), err
+}
+
+func contains(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// pullSource names url in logs, for the VCSs that pull from URLs rather than
+// remotes.
+func pullSource(url string) string {
+	if url == "" {
+		return "default"
+	}
+	return url
+}
+
+// isMetaDir tells whether name is the metadata dir of one of the backends.
+func isMetaDir(name string) bool {
+	for _, v := range vcsList {
+		if v.MetaDir() == name {
+			return true
+		}
+	}
+	return false
+}
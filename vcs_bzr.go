@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// bzrVCS keeps a branch of the repo of the import, pulled with --overwrite
+// on every fetch so that it follows the upstream branch, and updates its
+// working tree to the revision to check out.
+type bzrVCS struct{}
+
+func bzr(dir string, args ...string) *exec.Cmd {
+	return bzrContext(context.Background(), dir, args...)
+}
+
+func bzrContext(ctx context.Context, dir string, args ...string) *exec.Cmd {
+	return commandContext(ctx, dir, "bzr", args...)
+}
+
+// bzrRev makes a revision spec of rev, which may name a tag.
+func bzrRev(dir, rev string) string {
+	if tags, err := bzrTags(dir); err == nil && contains(tags, rev) {
+		return "tag:" + rev
+	}
+	return rev
+}
+
+func (bzrVCS) Name() string    { return "bzr" }
+func (bzrVCS) MetaDir() string { return ".bzr" }
+
+func (bzrVCS) Clone(ctx context.Context, log *logrus.Entry, dir, repo, url string) error {
+	if _, err := os.Stat(filepath.Join(dir, ".bzr")); err == nil {
+		return nil
+	}
+	if url == "" {
+		return fmt.Errorf("no repo to branch '%s' from", dir)
+	}
+	if err := checkRepoURL(url); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+	return retry(ctx, log, "branch '"+url+"'", func(ctx context.Context) error {
+		os.RemoveAll(dir)
+		_, err := combinedOutput(bzrContext(ctx, filepath.Dir(dir), "branch", "-q", "--", url, dir))
+		return err
+	})
+}
+
+func (bzrVCS) Fetch(ctx context.Context, log *logrus.Entry, dir, url string) error {
+	log.Infof("Pulling latest commits from '%s'", pullSource(url))
+	args := []string{"pull", "-q", "--overwrite"}
+	if url != "" {
+		if err := checkRepoURL(url); err != nil {
+			return err
+		}
+		args = append(args, "--", url)
+	}
+	err := retry(ctx, log, "pull from '"+pullSource(url)+"'", func(ctx context.Context) error {
+		_, err := combinedOutput(bzrContext(ctx, dir, args...))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not pull: %s", err)
+	}
+	return nil
+}
+
+func (bzrVCS) IsBranch(dir, url, rev string) (bool, error) {
+	// a bzr branch is a repo of its own: only the one pulled from counts
+	return rev == "master", nil
+}
+
+func (bzrVCS) Checkout(ctx context.Context, log *logrus.Entry, dir, url, rev string) error {
+	args := []string{"update", "-q"}
+	if rev != "master" {
+		args = append(args, "-r", bzrRev(dir, rev))
+	}
+	_, err := combinedOutput(bzr(dir, args...))
+	return err
+}
+
+func (bzrVCS) Current(dir string) (string, string, error) {
+	out, err := outputString(bzr(dir, "version-info", "--custom", "--template={revision_id} {date}"))
+	if err != nil {
+		return "", "", err
+	}
+	// e.g. john@example.com-20160512140334-0cqdodo2tdk3xn5e 2016-05-12 16:03:34 +0200
+	fields := strings.SplitN(out, " ", 2)
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("unexpected `bzr version-info` output: %s", out)
+	}
+	date, err := time.Parse("2006-01-02 15:04:05 -0700", fields[1])
+	if err != nil {
+		return "", "", fmt.Errorf("unexpected `bzr version-info` date: %s", fields[1])
+	}
+	return fields[0], date.Format(time.RFC3339), nil
+}
+
+func (bzrVCS) Describe(dir string) (string, error) {
+	out, err := outputString(bzr(dir, "version-info", "--custom", "--template={revno}"))
+	if err != nil {
+		return "", err
+	}
+	lines, err := outputLines(bzr(dir, "tags", "-r", out))
+	if err == nil && len(lines) > 0 {
+		return strings.Fields(lines[0])[0], nil
+	}
+	return out, nil
+}
+
+func (bzrVCS) Tags(ctx context.Context, log *logrus.Entry, dir string) ([]string, error) {
+	return bzrTags(dir)
+}
+
+func bzrTags(dir string) ([]string, error) {
+	lines, err := outputLines(bzr(dir, "tags"))
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	for _, l := range lines {
+		tags = append(tags, strings.Fields(l)[0])
+	}
+	return tags, nil
+}
+
+func (bzrVCS) TagCommit(dir, tag string) (string, bool) {
+	out, err := outputString(bzr(dir, "version-info", "-r", "tag:"+tag, "--custom", "--template={revision_id}"))
+	return out, err == nil && out != ""
+}
+
+func (bzrVCS) HasCommit(dir, commit string) bool {
+	return runCommand(bzr(dir, "log", "-q", "-r", "revid:"+commit)) == nil
+}
+
+func (bzrVCS) Root(dir string) (string, error) {
+	return outputString(bzr(dir, "root"))
+}
+
+func (bzrVCS) RemoteURL(dir, url string) string {
+	if url != "" {
+		return url
+	}
+	out, err := output(bzr(dir, "info"))
+	if err != nil {
+		return ""
+	}
+	for _, l := range strings.Split(string(out), "\n") {
+		if kv := strings.SplitN(strings.TrimSpace(l), ": ", 2); len(kv) == 2 && kv[0] == "parent branch" {
+			return strings.TrimSpace(kv[1])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// gitVCS keeps every repo an import is fetched from as a remote of the same
+// cache repo: origin for the default one, remoteName(url) for the others.
+type gitVCS struct{}
+
+// git returns a git command to run in dir, isolated (see gitEnv).
+func git(dir string, args ...string) *exec.Cmd {
+	return gitContext(context.Background(), dir, args...)
+}
+
+// gitContext is git, for the commands that use the network.
+func gitContext(ctx context.Context, dir string, args ...string) *exec.Cmd {
+	cmd := commandContext(ctx, dir, "git", args...)
+	cmd.Env = gitEnv(gitProtocols())
+	return cmd
+}
+
+// How the git repos of the cache are cloned and checked out, from the flags.
+var (
+	partialClone   bool // fetch the files of the commits checked out only (--filter=blob:none)
+	shallowFetch   bool // fetch the commits checked out only, with depth 1
+	sparseCheckout bool // check out the dirs of the packages in use only
+)
+
+func remoteName(url string) string {
+	if url == "" {
+		return "origin"
+	}
+	ss := sha1.Sum([]byte(url))
+	return hex.EncodeToString(ss[:])[:7]
+}
+
+func (gitVCS) Name() string    { return "git" }
+func (gitVCS) MetaDir() string { return ".git" }
+
+func (g gitVCS) Clone(ctx context.Context, log *logrus.Entry, dir, repo, url string) error {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if _, err := combinedOutput(git(dir, "init", "-q")); err != nil {
+			return err
+		}
+	}
+	if url == "" {
+		return nil
+	}
+	if err := checkRepoURL(url); err != nil {
+		return err
+	}
+	remote := remoteName(repo)
+	remotes, err := outputLines(git(dir, "remote"))
+	if err != nil {
+		return err
+	}
+	if contains(remotes, remote) {
+		// bundle files given relative to the project move with it
+		if g.RemoteURL(dir, repo) != url {
+			_, err = combinedOutput(git(dir, "remote", "set-url", "--", remote, url))
+		}
+		return err
+	}
+	if _, err := combinedOutput(git(dir, "remote", "add", "--", remote, url)); err != nil {
+		return fmt.Errorf("could not add remote '%s' '%s': %s", remote, url, err)
+	}
+	if partialClone {
+		for k, v := range map[string]string{"promisor": "true", "partialclonefilter": "blob:none"} {
+			if _, err := combinedOutput(git(dir, "config", "remote."+remote+"."+k, v)); err != nil {
+				return err
+			}
+		}
+	}
+	if shallowFetch {
+		return nil
+	}
+	return g.Fetch(ctx, log, dir, repo)
+}
+
+// Fetch fetches everything, unless only the commits checked out are: then
+// Checkout fetches them.
+func (gitVCS) Fetch(ctx context.Context, log *logrus.Entry, dir, url string) error {
+	if shallowFetch {
+		return nil
+	}
+	return fetchAll(ctx, log, dir, url)
+}
+
+func fetchAll(ctx context.Context, log *logrus.Entry, dir, url string) error {
+	remote := remoteName(url)
+	log.Infof("Fetching latest commits from '%s'", remote)
+	args := []string{"fetch", "-f", "-t", remote}
+	if _, err := os.Stat(filepath.Join(dir, ".git", "shallow")); err == nil {
+		args = append(args, "--unshallow")
+	}
+	err := retry(ctx, log, "fetch '"+remote+"'", func(ctx context.Context) error {
+		_, err := combinedOutput(gitContext(ctx, dir, args...))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not fetch: %s", err)
+	}
+	return nil
+}
+
+// fetchRev fetches rev alone, with depth 1: the tag or branch it names, or
+// else the commit. If the remote does not let it, it fetches everything.
+func fetchRev(ctx context.Context, log *logrus.Entry, dir, url, rev string) error {
+	if offline {
+		return offlineError("'%s'", rev)
+	}
+	remote := remoteName(url)
+	var refs []string
+	err := retry(ctx, log, "list the refs of '"+remote+"'", func(ctx context.Context) (err error) {
+		refs, err = outputLines(gitContext(ctx, dir, "ls-remote", remote, rev))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not list the refs of '%s': %s", remote, err)
+	}
+	refspec := rev
+	if rev == "master" {
+		refspec = "+HEAD:refs/remotes/" + remote + "/master"
+	}
+	for _, l := range refs {
+		switch fields := strings.Fields(l); {
+		case len(fields) != 2:
+		case fields[1] == "refs/heads/"+rev:
+			refspec = "+refs/heads/" + rev + ":refs/remotes/" + remote + "/" + rev
+		case fields[1] == "refs/tags/"+rev:
+			refspec = "+refs/tags/" + rev + ":refs/tags/" + rev
+		}
+		if strings.HasPrefix(refspec, "+refs/tags/") {
+			break
+		}
+	}
+	log.Infof("Fetching '%s' from '%s'", rev, remote)
+	fetchCtx, cancel := context.WithTimeout(ctx, netTimeout)
+	defer cancel()
+	_, err = combinedOutput(gitContext(fetchCtx, dir, "fetch", "-f", "--no-tags", "--depth", "1", remote, refspec))
+	if err == nil {
+		return nil
+	}
+	log.Debug(err)
+	log.Warnf("Could not fetch '%s' alone: fetching all of '%s'", rev, remote)
+	return fetchAll(ctx, log, dir, url)
+}
+
+func (gitVCS) IsBranch(dir, url, rev string) (bool, error) {
+	if rev == "master" {
+		return true, nil
+	}
+	b := remoteName(url) + "/" + rev
+	branches, err := outputLines(git(dir, "branch", "--list", "-r", b))
+	if err != nil {
+		return false, err
+	}
+	return contains(branches, b), nil
+}
+
+func (g gitVCS) Checkout(ctx context.Context, log *logrus.Entry, dir, url, rev string) error {
+	if err := syncSparseCheckout(dir); err != nil {
+		return err
+	}
+	version := rev
+	branch, err := g.IsBranch(dir, url, rev)
+	if err != nil {
+		return err
+	} else if branch {
+		version = remoteName(url) + "/" + rev
+	}
+	if shallowFetch && (branch && !offline || !g.HasCommit(dir, version)) {
+		if err := fetchRev(ctx, log, dir, url, rev); err != nil {
+			return err
+		}
+		if branch, err = g.IsBranch(dir, url, rev); err != nil {
+			return err
+		} else if branch {
+			version = remoteName(url) + "/" + rev
+		}
+	}
+	_, err = combinedOutput(git(dir, "checkout", "-f", "--detach", version))
+	if err != nil && offline && strings.Contains(err.Error(), "promisor remote") {
+		return offlineError("a file of '%s'", rev) // from a partial clone
+	}
+	if err == nil || rev != "master" {
+		return err
+	}
+	log.Debug(err)
+	log.Warn("Failed to checkout 'master' branch: checking out the latest commit git can find")
+	out, err := outputString(git(dir, "log", "--all", "--pretty=oneline", "--abbrev-commit", "-1"))
+	if err != nil {
+		return fmt.Errorf("could not find the latest commit: %s", err)
+	}
+	fields := strings.Fields(out)
+	if len(fields) == 0 {
+		return fmt.Errorf("no commits in '%s'", dir)
+	}
+	_, err = combinedOutput(git(dir, "checkout", "-f", "--detach", fields[0]))
+	return err
+}
+
+func (gitVCS) Current(dir string) (string, string, error) {
+	out, err := outputString(git(dir, "log", "-1", "--format=%H %cI"))
+	if err != nil {
+		return "", "", err
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("unexpected `git log` output: %s", out)
+	}
+	return fields[0], fields[1], nil
+}
+
+func (gitVCS) Describe(dir string) (string, error) {
+	return outputString(git(dir, "describe", "--tags", "--always"))
+}
+
+// Tags are the tags of the remotes too, when only the commits checked out
+// are fetched (and the network can be used).
+func (gitVCS) Tags(ctx context.Context, log *logrus.Entry, dir string) ([]string, error) {
+	tags, err := outputLines(git(dir, "tag", "-l"))
+	if err != nil || !shallowFetch || offline {
+		return tags, err
+	}
+	remotes, err := outputLines(git(dir, "remote"))
+	if err != nil {
+		return nil, err
+	}
+	for _, remote := range remotes {
+		var refs []string
+		err := retry(ctx, log, "list the tags of '"+remote+"'", func(ctx context.Context) (err error) {
+			refs, err = outputLines(gitContext(ctx, dir, "ls-remote", "--tags", "--refs", remote))
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not list the tags of '%s': %s", remote, err)
+		}
+		for _, l := range refs {
+			if fields := strings.Fields(l); len(fields) == 2 {
+				if tag := strings.TrimPrefix(fields[1], "refs/tags/"); !contains(tags, tag) {
+					tags = append(tags, tag)
+				}
+			}
+		}
+	}
+	return tags, nil
+}
+
+func (gitVCS) TagCommit(dir, tag string) (string, bool) {
+	commit, err := outputString(git(dir, "rev-parse", "-q", "--verify", "refs/tags/"+tag+"^{commit}"))
+	return commit, err == nil
+}
+
+// HasCommit does not fetch commit from the remotes of partial clones, as
+// `git cat-file -e` would.
+func (gitVCS) HasCommit(dir, commit string) bool {
+	return runCommand(git(dir, "rev-list", "-n1", "--no-walk", "--missing=allow-any", commit+"^{commit}", "--")) == nil
+}
+
+func (gitVCS) Root(dir string) (string, error) {
+	return outputString(git(dir, "rev-parse", "--show-toplevel"))
+}
+
+func (gitVCS) RemoteURL(dir, url string) string {
+	u, _ := outputString(git(dir, "config", "--get", "remote."+remoteName(url)+".url"))
+	return u
+}
+
+// syncSparseCheckout makes the checkout of dir sparse, with the top level
+// files only, if it has to be and is not yet, and full if it must not be.
+func syncSparseCheckout(dir string) error {
+	sparse, _ := outputString(git(dir, "config", "--bool", "core.sparseCheckout"))
+	switch {
+	case sparseCheckout && sparse != "true":
+		_, err := combinedOutput(git(dir, "sparse-checkout", "set", "--cone"))
+		return err
+	case !sparseCheckout && sparse == "true":
+		_, err := combinedOutput(git(dir, "sparse-checkout", "disable"))
+		return err
+	}
+	return nil
+}
+
+// sparseDirs are the dirs the sparse checkouts of this run need, by repo
+// dir: another run sharing the cache can narrow them without checking out
+// another commit, so restoreSparseCheckout adds them again.
+var sparseDirs = struct {
+	sync.Mutex
+	m map[string][]string
+}{m: map[string][]string{}}
+
+// restoreSparseCheckout makes the checkout of dir sparse or full as this run
+// wants it, with the dirs it added to it.
+func restoreSparseCheckout(dir string) error {
+	if err := syncSparseCheckout(dir); err != nil {
+		return err
+	}
+	sparseDirs.Lock()
+	dirs := append([]string{}, sparseDirs.m[dir]...)
+	sparseDirs.Unlock()
+	_, err := addSparseDirs(dir, dirs)
+	return err
+}
+
+// addSparseDirs adds the dirs (relative to the root of the repo in dir) the
+// sparse checkout of dir lacks to it. It returns whether there were any.
+func addSparseDirs(dir string, dirs []string) (bool, error) {
+	sparseDirs.Lock()
+	for _, d := range dirs {
+		if !contains(sparseDirs.m[dir], d) {
+			sparseDirs.m[dir] = append(sparseDirs.m[dir], d)
+		}
+	}
+	sparseDirs.Unlock()
+	if sparse, _ := outputString(git(dir, "config", "--bool", "core.sparseCheckout")); sparse != "true" {
+		return false, nil
+	}
+	current, err := outputLines(git(dir, "sparse-checkout", "list"))
+	if err != nil {
+		return false, err
+	}
+	var missing []string
+	for _, d := range dirs {
+		covered := false
+		for _, c := range current {
+			covered = covered || d == c || strings.HasPrefix(d, c+"/")
+		}
+		if !covered && !contains(missing, d) {
+			missing = append(missing, d)
+		}
+	}
+	if len(missing) == 0 {
+		return false, nil
+	}
+	_, err = combinedOutput(git(dir, append([]string{"sparse-checkout", "add"}, missing...)...))
+	return true, err
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// hgVCS pulls from the repo of the import on every fetch: unlike git, hg
+// needs no remotes for that.
+type hgVCS struct{}
+
+func hg(dir string, args ...string) *exec.Cmd {
+	return hgContext(context.Background(), dir, args...)
+}
+
+// hgContext runs hg without the config of the system and of the user, so
+// that no hook or extension of theirs runs on the repos of dependencies.
+func hgContext(ctx context.Context, dir string, args ...string) *exec.Cmd {
+	cmd := commandContext(ctx, dir, "hg", append([]string{"--noninteractive"}, args...)...)
+	cmd.Env = append(os.Environ(), "HGRCPATH=", "HGPLAIN=1")
+	return cmd
+}
+
+// hgRev maps the default branch of the other VCSs to the one of hg.
+func hgRev(rev string) string {
+	if rev == "master" {
+		return "default"
+	}
+	return rev
+}
+
+func (hgVCS) Name() string    { return "hg" }
+func (hgVCS) MetaDir() string { return ".hg" }
+
+func (hgVCS) Clone(ctx context.Context, log *logrus.Entry, dir, repo, url string) error {
+	if _, err := os.Stat(filepath.Join(dir, ".hg")); err == nil {
+		return nil
+	}
+	if url == "" {
+		return fmt.Errorf("no repo to clone '%s' from", dir)
+	}
+	if err := checkRepoURL(url); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+	return retry(ctx, log, "clone '"+url+"'", func(ctx context.Context) error {
+		os.RemoveAll(dir)
+		_, err := combinedOutput(hgContext(ctx, filepath.Dir(dir), "clone", "-U", "--", url, dir))
+		return err
+	})
+}
+
+func (hgVCS) Fetch(ctx context.Context, log *logrus.Entry, dir, url string) error {
+	log.Infof("Pulling latest commits from '%s'", pullSource(url))
+	args := []string{"pull"}
+	if url != "" {
+		if err := checkRepoURL(url); err != nil {
+			return err
+		}
+		args = append(args, "--", url)
+	}
+	err := retry(ctx, log, "pull from '"+pullSource(url)+"'", func(ctx context.Context) error {
+		_, err := combinedOutput(hgContext(ctx, dir, args...))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not pull: %s", err)
+	}
+	return nil
+}
+
+func (hgVCS) IsBranch(dir, url, rev string) (bool, error) {
+	if rev == "master" {
+		return true, nil
+	}
+	branches, err := outputLines(hg(dir, "branches", "-q"))
+	if err != nil {
+		return false, err
+	}
+	return contains(branches, rev), nil
+}
+
+func (hgVCS) Checkout(ctx context.Context, log *logrus.Entry, dir, url, rev string) error {
+	_, err := combinedOutput(hg(dir, "update", "-C", "-r", hgRev(rev)))
+	return err
+}
+
+func (hgVCS) Current(dir string) (string, string, error) {
+	out, err := outputString(hg(dir, "log", "-r", ".", "--template", "{node} {date|hgdate}"))
+	if err != nil {
+		return "", "", err
+	}
+	var node string
+	var secs, offset int64
+	if _, err := fmt.Sscanf(out, "%s %d %d", &node, &secs, &offset); err != nil {
+		return "", "", fmt.Errorf("unexpected `hg log` output: %s", out)
+	}
+	// hgdate offsets are in seconds west of UTC
+	date := time.Unix(secs, 0).In(time.FixedZone("", int(-offset)))
+	return node, date.Format(time.RFC3339), nil
+}
+
+func (hgVCS) Describe(dir string) (string, error) {
+	out, err := outputString(hg(dir, "log", "-r", ".", "--template", "{latesttag} {latesttagdistance} {node|short}"))
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 3 {
+		return "", fmt.Errorf("unexpected `hg log` output: %s", out)
+	}
+	switch {
+	case fields[0] == "null":
+		return fields[2], nil
+	case fields[1] == "0":
+		return fields[0], nil
+	}
+	return fmt.Sprintf("%s-%s-m%s", fields[0], fields[1], fields[2]), nil
+}
+
+func (hgVCS) Tags(ctx context.Context, log *logrus.Entry, dir string) ([]string, error) {
+	return hgTags(dir)
+}
+
+func hgTags(dir string) ([]string, error) {
+	tags, err := outputLines(hg(dir, "tags", "-q"))
+	if err != nil {
+		return nil, err
+	}
+	var r []string
+	for _, t := range tags {
+		if t != "tip" {
+			r = append(r, t)
+		}
+	}
+	return r, nil
+}
+
+func (h hgVCS) TagCommit(dir, tag string) (string, bool) {
+	if tags, err := hgTags(dir); err != nil || !contains(tags, tag) {
+		return "", false
+	}
+	node, err := outputString(hg(dir, "log", "-r", tag, "--template", "{node}"))
+	return node, err == nil
+}
+
+func (hgVCS) HasCommit(dir, commit string) bool {
+	return runCommand(hg(dir, "log", "-r", commit, "--template", "{node}")) == nil
+}
+
+func (hgVCS) Root(dir string) (string, error) {
+	return outputString(hg(dir, "root"))
+}
+
+func (hgVCS) RemoteURL(dir, url string) string {
+	if url != "" {
+		return url
+	}
+	u, _ := outputString(hg(dir, "paths", "default"))
+	return u
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// svnVCS works on a checkout of the trunk (or whatever url points to):
+// there is nothing to fetch, every update asks the server. Tags are the
+// dirs of ^/tags, switched to by name.
+type svnVCS struct{}
+
+func svn(dir string, args ...string) *exec.Cmd {
+	return svnContext(context.Background(), dir, args...)
+}
+
+func svnContext(ctx context.Context, dir string, args ...string) *exec.Cmd {
+	return commandContext(ctx, dir, "svn", append([]string{"--non-interactive"}, args...)...)
+}
+
+func (svnVCS) Name() string    { return "svn" }
+func (svnVCS) MetaDir() string { return ".svn" }
+
+func (svnVCS) Clone(ctx context.Context, log *logrus.Entry, dir, repo, url string) error {
+	if _, err := os.Stat(filepath.Join(dir, ".svn")); err == nil {
+		return nil
+	}
+	if url == "" {
+		return fmt.Errorf("no repo to check out '%s' from", dir)
+	}
+	if err := checkRepoURL(url); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+	return retry(ctx, log, "check out '"+url+"'", func(ctx context.Context) error {
+		os.RemoveAll(dir)
+		_, err := combinedOutput(svnContext(ctx, filepath.Dir(dir), "checkout", "-q", "--", url, dir))
+		return err
+	})
+}
+
+func (svnVCS) Fetch(ctx context.Context, log *logrus.Entry, dir, url string) error {
+	return nil
+}
+
+func (svnVCS) IsBranch(dir, url, rev string) (bool, error) {
+	return rev == "master", nil
+}
+
+func (s svnVCS) Checkout(ctx context.Context, log *logrus.Entry, dir, url, rev string) error {
+	// unlike the other VCSs, svn only updates the dir it runs in
+	if root, err := s.Root(dir); err == nil {
+		dir = root
+	}
+	if offline {
+		return s.checkedOut(dir, rev)
+	}
+	args := []string{"update", "-q", "-r", rev}
+	switch tags, _ := s.Tags(ctx, log, dir); {
+	case rev == "master":
+		args = []string{"update", "-q", "-r", "HEAD"}
+	case contains(tags, rev):
+		args = []string{"switch", "-q", "^/tags/" + rev}
+	}
+	return retry(ctx, log, "update to '"+rev+"'", func(ctx context.Context) error {
+		_, err := combinedOutput(svnContext(ctx, dir, args...))
+		return err
+	})
+}
+
+// checkedOut tells, without the server, whether the working copy in dir is
+// at rev already: the tag it is switched to, the trunk (or whatever the
+// checkout is of) for master, or the revision it is at.
+func (s svnVCS) checkedOut(dir, rev string) error {
+	info, err := s.info(dir)
+	if err != nil {
+		return offlineError("revision '%s'", rev)
+	}
+	tag, onTag := svnTag(info)
+	switch {
+	case onTag && rev == tag, !onTag && rev == "master":
+		return nil
+	case rev == info["Last Changed Rev"] || rev == info["Revision"]:
+		return nil
+	}
+	return offlineError("revision '%s'", rev)
+}
+
+// svnTag returns the tag the working copy of info is switched to, if any.
+func svnTag(info map[string]string) (string, bool) {
+	rel := info["Relative URL"]
+	if !strings.HasPrefix(rel, "^/tags/") {
+		return "", false
+	}
+	return strings.SplitN(strings.TrimPrefix(rel, "^/tags/"), "/", 2)[0], true
+}
+
+// info returns the fields of `svn info` in dir.
+func (svnVCS) info(dir string, args ...string) (map[string]string, error) {
+	out, err := output(svn(dir, append([]string{"info"}, args...)...))
+	if err != nil {
+		return nil, err
+	}
+	r := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		if kv := strings.SplitN(scanner.Text(), ": ", 2); len(kv) == 2 {
+			r[kv[0]] = strings.TrimSpace(kv[1])
+		}
+	}
+	return r, nil
+}
+
+func (s svnVCS) Current(dir string) (string, string, error) {
+	if root, err := s.Root(dir); err == nil {
+		dir = root
+	}
+	info, err := s.info(dir)
+	if err != nil {
+		return "", "", err
+	}
+	rev := info["Last Changed Rev"]
+	// e.g. 2016-05-12 16:03:34 +0200 (Thu, 12 May 2016)
+	date, err := time.Parse("2006-01-02 15:04:05 -0700", strings.SplitN(info["Last Changed Date"], " (", 2)[0])
+	if rev == "" || err != nil {
+		return "", "", fmt.Errorf("unexpected `svn info` output in '%s'", dir)
+	}
+	return rev, date.Format(time.RFC3339), nil
+}
+
+func (s svnVCS) Describe(dir string) (string, error) {
+	if root, err := s.Root(dir); err == nil {
+		dir = root
+	}
+	info, err := s.info(dir)
+	if err != nil {
+		return "", err
+	}
+	if tag, ok := svnTag(info); ok {
+		return tag, nil
+	}
+	return info["Last Changed Rev"], nil
+}
+
+func (svnVCS) Tags(ctx context.Context, log *logrus.Entry, dir string) ([]string, error) {
+	if offline {
+		return nil, offlineError("the tag list of '%s'", dir)
+	}
+	var lines []string
+	err := retry(ctx, log, "list the tags of '"+dir+"'", func(ctx context.Context) (err error) {
+		lines, err = outputLines(svnContext(ctx, dir, "ls", "^/tags"))
+		if err != nil && strings.Contains(err.Error(), "E200009") {
+			return permanent(err) // no tags dir
+		}
+		return err
+	})
+	if err != nil && strings.Contains(err.Error(), "E200009") {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	for _, l := range lines {
+		tags = append(tags, strings.TrimSuffix(l, "/"))
+	}
+	return tags, nil
+}
+
+func (s svnVCS) TagCommit(dir, tag string) (string, bool) {
+	info, err := s.info(dir, "^/tags/"+tag)
+	if err != nil || info["Last Changed Rev"] == "" {
+		return "", false
+	}
+	return info["Last Changed Rev"], true
+}
+
+func (s svnVCS) HasCommit(dir, commit string) bool {
+	// svn keeps no history locally: whatever the server knows will do
+	_, err := s.info(dir, "-r", commit)
+	return err == nil
+}
+
+func (s svnVCS) Root(dir string) (string, error) {
+	info, err := s.info(dir)
+	if err != nil {
+		return "", err
+	}
+	return info["Working Copy Root Path"], nil
+}
+
+func (s svnVCS) RemoteURL(dir, url string) string {
+	if url != "" {
+		return url
+	}
+	info, err := s.info(dir)
+	if err != nil {
+		return ""
+	}
+	return info["URL"]
+}
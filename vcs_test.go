@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mountkin/trash/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVCSByName(t *testing.T) {
+	assert := require.New(t)
+	for _, name := range conf.VCSs {
+		v, err := vcsByName(name)
+		assert.NoError(err)
+		assert.Equal(name, v.Name())
+	}
+	_, err := vcsByName("cvs")
+	assert.Error(err)
+}
+
+func TestOutputLines(t *testing.T) {
+	assert := require.New(t)
+	lines, err := outputLines(command("", "printf", "a\\n\\n b \\n"))
+	assert.NoError(err)
+	assert.Equal([]string{"a", "b"}, lines)
+
+	// a failure is one, with what the command printed
+	dir, err := ioutil.TempDir("", "trash-vcs")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	_, err = outputLines(git(dir, "ls-remote", filepath.Join(dir, "missing")))
+	assert.Error(err)
+	assert.Contains(err.Error(), "does not appear to be a git repository")
+	_, err = outputLines(command("", "sh", "-c", "echo partial; echo oops >&2; exit 3"))
+	assert.EqualError(err, "`sh -c echo partial; echo oops >&2; exit 3` failed: exit status 3\noops")
+	_, err = outputLines(command("", "/nonexistent/command"))
+	assert.Error(err)
+}
+
+func TestCommandTimeout(t *testing.T) {
+	assert := require.New(t)
+	defer func(timeout time.Duration) { commandTimeout = timeout }(commandTimeout)
+	commandTimeout = 100 * time.Millisecond
+
+	// the clock starts with the command, not when it is made
+	cmd := command("", "true")
+	time.Sleep(2 * commandTimeout)
+	assert.NoError(runCommand(cmd))
+
+	_, err := combinedOutput(command("", "sleep", "5"))
+	assert.EqualError(err, "`sleep 5` failed: timed out after 100ms (see --command-timeout)")
+	lines, err := outputLines(command("", "sh", "-c", "echo partial; exec sleep 5"))
+	assert.Error(err)
+	assert.Empty(lines)
+}
+
+func TestDetectVCS(t *testing.T) {
+	assert := require.New(t)
+	dir, err := ioutil.TempDir("", "trash-vcs")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	for _, d := range []string{"example.com/a/.hg", "example.com/a/sub/pkg", "example.com/b/.bzr", "example.com/c"} {
+		assert.NoError(os.MkdirAll(filepath.Join(src, d), 0755))
+	}
+	assert.NoError(os.MkdirAll(filepath.Join(dir, ".git"), 0755)) // above src: not in the cache
+
+	v, root, ok := detectVCS(filepath.Join(src, "example.com/a/sub/pkg"), src)
+	assert.True(ok)
+	assert.Equal("hg", v.Name())
+	assert.Equal(filepath.Join(src, "example.com/a"), root)
+
+	v, _, ok = detectVCS(filepath.Join(src, "example.com/b"), src)
+	assert.True(ok)
+	assert.Equal("bzr", v.Name())
+
+	_, _, ok = detectVCS(filepath.Join(src, "example.com/c"), src)
+	assert.False(ok)
+
+	_, _, err = repoOf(dir, conf.Import{Package: "example.com/c"})
+	assert.Error(err)
+	v, root, err = repoOf(dir, conf.Import{Package: "example.com/a/sub/pkg/notyet"})
+	assert.NoError(err)
+	assert.Equal("hg", v.Name())
+	assert.Equal(filepath.Join(src, "example.com/a"), root)
+	v, _, err = repoOf(dir, conf.Import{Package: "example.com/a/sub", VCS: "svn"})
+	assert.NoError(err)
+	assert.Equal("svn", v.Name())
+}
+
+func TestGitVCS(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "trash-vcs")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream")
+	assert.NoError(os.MkdirAll(upstream, 0755))
+	commit := func(msg string) {
+		assert.NoError(ioutil.WriteFile(filepath.Join(upstream, "f.go"), []byte("package f // "+msg+"\n"), 0644))
+		for _, args := range [][]string{{"add", "-A"}, {"-c", "user.name=t", "-c", "user.email=t@example.com", "commit", "-q", "-m", msg}} {
+			_, err := combinedOutput(git(upstream, args...))
+			assert.NoError(err)
+		}
+	}
+	_, err = combinedOutput(git(upstream, "init", "-q"))
+	assert.NoError(err)
+	commit("one")
+	_, err = combinedOutput(git(upstream, "tag", "v1.0.0"))
+	assert.NoError(err)
+	commit("two")
+	_, err = combinedOutput(git(upstream, "branch", "-q", "release"))
+	assert.NoError(err)
+
+	v := gitVCS{}
+	repoDir := filepath.Join(dir, "src", "example.com", "f")
+	assert.NoError(v.Clone(ctx, stdLog, repoDir, upstream, upstream))
+	assert.NoError(v.Clone(ctx, stdLog, repoDir, upstream, upstream)) // the remote is there already
+	assert.NoError(v.Fetch(ctx, stdLog, repoDir, upstream))
+
+	tags, err := v.Tags(ctx, stdLog, repoDir)
+	assert.NoError(err)
+	assert.Equal([]string{"v1.0.0"}, tags)
+
+	tagged, ok := v.TagCommit(repoDir, "v1.0.0")
+	assert.True(ok)
+	assert.True(v.HasCommit(repoDir, tagged))
+	_, ok = v.TagCommit(repoDir, "v2.0.0")
+	assert.False(ok)
+
+	branch, err := v.IsBranch(repoDir, upstream, "release")
+	assert.NoError(err)
+	assert.True(branch)
+	branch, err = v.IsBranch(repoDir, upstream, "v1.0.0")
+	assert.NoError(err)
+	assert.False(branch)
+
+	assert.NoError(v.Checkout(ctx, stdLog, repoDir, upstream, "v1.0.0"))
+	current, date, err := v.Current(repoDir)
+	assert.NoError(err)
+	assert.Equal(tagged, current)
+	assert.NotEmpty(date)
+	described, err := v.Describe(repoDir)
+	assert.NoError(err)
+	assert.Equal("v1.0.0", described)
+
+	assert.NoError(v.Checkout(ctx, stdLog, repoDir, upstream, "release"))
+	described, err = v.Describe(repoDir)
+	assert.NoError(err)
+	assert.Regexp(`^v1\.0\.0-1-g[0-9a-f]+$`, described)
+
+	root, err := v.Root(repoDir)
+	assert.NoError(err)
+	assert.Equal(repoDir, root)
+	assert.Equal(upstream, v.RemoteURL(repoDir, upstream))
+	assert.Empty(v.RemoteURL(repoDir, ""))
+}
+
+// TestOtherVCSs runs the backends whose tools are installed through a
+// clone of a one commit repo.
+func TestOtherVCSs(t *testing.T) {
+	setups := map[string][][]string{
+		"hg":  {{"hg", "init", "upstream"}, {"sh", "-c", "echo one > upstream/f"}, {"hg", "-R", "upstream", "commit", "-q", "-A", "-u", "t", "-m", "one"}, {"hg", "-R", "upstream", "tag", "-u", "t", "v1.0.0"}},
+		"bzr": {{"bzr", "init", "-q", "upstream"}, {"sh", "-c", "echo one > upstream/f"}, {"bzr", "add", "-q", "upstream/f"}, {"bzr", "commit", "-q", "-m", "one", "upstream"}, {"bzr", "tag", "-q", "-d", "upstream", "v1.0.0"}},
+	}
+	for name, setup := range setups {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Logf("%s is not installed, skipping it", name)
+			continue
+		}
+		assert := require.New(t)
+		ctx := context.Background()
+		dir, err := ioutil.TempDir("", "trash-vcs")
+		assert.NoError(err)
+		defer os.RemoveAll(dir)
+		for _, args := range setup {
+			cmd := exec.Command(args[0], args[1:]...)
+			cmd.Dir = dir
+			cmd.Env = append(os.Environ(), "BZR_EMAIL=t <t@example.com>")
+			_, err := combinedOutput(cmd)
+			assert.NoError(err)
+		}
+
+		v, err := vcsByName(name)
+		assert.NoError(err)
+		upstream := filepath.Join(dir, "upstream")
+		repoDir := filepath.Join(dir, "src", "example.com", "f")
+		assert.NoError(v.Clone(ctx, stdLog, repoDir, upstream, upstream), name)
+		assert.NoError(v.Fetch(ctx, stdLog, repoDir, upstream), name)
+		tags, err := v.Tags(ctx, stdLog, repoDir)
+		assert.NoError(err, name)
+		assert.Contains(tags, "v1.0.0", name)
+		assert.NoError(v.Checkout(ctx, stdLog, repoDir, upstream, "v1.0.0"), name)
+		current, _, err := v.Current(repoDir)
+		assert.NoError(err, name)
+		assert.True(v.HasCommit(repoDir, current), name)
+		found, _, ok := detectVCS(repoDir, filepath.Join(dir, "src"))
+		assert.True(ok, name)
+		assert.Equal(name, found.Name())
+	}
+}
+
+func TestVCSRefuseURLs(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "trash-vcs")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// checked before any VCS runs: none needs to be installed
+	for _, name := range []string{"git", "hg", "svn", "bzr"} {
+		v, err := vcsByName(name)
+		assert.NoError(err)
+		for _, url := range []string{"--config=hooks.pre-clone=touch%20/tmp/pwned", "ssh://-oProxyCommand=touch%20/tmp/pwned/f", "ext::sh -c touch% /tmp/pwned"} {
+			assert.Error(v.Clone(ctx, stdLog, filepath.Join(dir, name), url, url), "%s %s", name, url)
+		}
+	}
+}
+
+func TestGitVCSPartialOffline(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "trash-vcs")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	defer func() { partialClone, offline = false, false }()
+
+	upstream := filepath.Join(dir, "upstream")
+	commits := makeUpstream(t, upstream)
+	_, err = combinedOutput(git(upstream, "config", "uploadpack.allowFilter", "true"))
+	assert.NoError(err)
+	partialClone = true
+	url := "file://" + upstream
+	v := gitVCS{}
+	repoDir := filepath.Join(dir, "src", "example.com", "f")
+	assert.NoError(v.Clone(ctx, stdLog, repoDir, url, url))
+	missing := func() int {
+		lines, err := outputLines(git(repoDir, "rev-list", "--objects", "--missing=print", "--all"))
+		assert.NoError(err)
+		n := 0
+		for _, l := range lines {
+			if strings.HasPrefix(l, "?") {
+				n++
+			}
+		}
+		return n
+	}
+	assert.Equal(3, missing())
+
+	// the files of the commits are not fetched either
+	offline = true
+	assert.True(v.HasCommit(repoDir, commits[1]))
+	err = v.Checkout(ctx, stdLog, repoDir, url, "v1.0.0")
+	assert.Error(err)
+	assert.Contains(err.Error(), "--offline")
+	assert.Equal(3, missing())
+
+	offline = false
+	assert.NoError(v.Checkout(ctx, stdLog, repoDir, url, "v1.0.0"))
+	assert.Equal(2, missing())
+	offline = true
+	assert.NoError(v.Checkout(ctx, stdLog, repoDir, url, "v1.0.0"))
+}
+
+func TestGitVCSShallow(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "trash-vcs")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	defer func() { partialClone, shallowFetch = false, false }()
+
+	upstream := filepath.Join(dir, "upstream")
+	assert.NoError(os.MkdirAll(upstream, 0755))
+	run := func(args ...string) string {
+		out, err := combinedOutput(git(upstream, append([]string{"-c", "user.name=t", "-c", "user.email=t@example.com"}, args...)...))
+		assert.NoError(err, "%v", args)
+		return string(out)
+	}
+	commit := func(msg string) {
+		assert.NoError(ioutil.WriteFile(filepath.Join(upstream, "f.go"), []byte("package f // "+msg+"\n"), 0644))
+		run("add", "-A")
+		run("commit", "-q", "-m", msg)
+	}
+	run("init", "-q")
+	run("config", "uploadpack.allowFilter", "true")
+	commit("one")
+	run("tag", "v1.0.0")
+	commit("two")
+	run("tag", "v1.1.0")
+	commit("three")
+	one, err := outputString(git(upstream, "rev-parse", "v1.0.0^{commit}"))
+	assert.NoError(err)
+	two, err := outputString(git(upstream, "rev-parse", "v1.1.0^{commit}"))
+	assert.NoError(err)
+
+	partialClone, shallowFetch = true, true
+	url := "file://" + upstream
+	v := gitVCS{}
+	repoDir := filepath.Join(dir, "src", "example.com", "f")
+	assert.NoError(v.Clone(ctx, stdLog, repoDir, url, url))
+	assert.False(v.HasCommit(repoDir, one))
+	promisor, err := outputString(git(repoDir, "config", "remote."+remoteName(url)+".partialclonefilter"))
+	assert.NoError(err)
+	assert.Equal("blob:none", promisor)
+
+	// the tags of the remote are known without fetching them
+	tags, err := v.Tags(ctx, stdLog, repoDir)
+	assert.NoError(err)
+	assert.Equal([]string{"v1.0.0", "v1.1.0"}, tags)
+
+	assert.NoError(v.Checkout(ctx, stdLog, repoDir, url, "v1.0.0"))
+	current, _, err := v.Current(repoDir)
+	assert.NoError(err)
+	assert.Equal(one, current)
+	assert.False(v.HasCommit(repoDir, two))
+	_, err = os.Stat(filepath.Join(repoDir, ".git", "shallow"))
+	assert.NoError(err)
+	tagged, ok := v.TagCommit(repoDir, "v1.0.0")
+	assert.True(ok)
+	assert.Equal(one, tagged)
+
+	assert.NoError(v.Checkout(ctx, stdLog, repoDir, url, "master"))
+	b, err := ioutil.ReadFile(filepath.Join(repoDir, "f.go"))
+	assert.NoError(err)
+	assert.Equal("package f // three\n", string(b))
+
+	// abbreviated commits cannot be fetched alone: everything is
+	assert.NoError(v.Checkout(ctx, stdLog, repoDir, url, two[:7]))
+	current, _, err = v.Current(repoDir)
+	assert.NoError(err)
+	assert.Equal(two, current)
+	_, err = os.Stat(filepath.Join(repoDir, ".git", "shallow"))
+	assert.True(os.IsNotExist(err))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mountkin/trash/conf"
+	"github.com/urfave/cli"
+)
+
+// verifyCommand rebuilds the vendor dir in a scratch dir and compares the result
+// with the manifest and the actual vendor dir. Nothing in the project is
+// modified. Any drift makes trash exit with a non-zero status.
+func verifyCommand(c *cli.Context) error {
+	targetDir := c.GlobalString("target")
+	keep := c.GlobalBool("keep")
+
+	dir, confFile, trashDir, trashConf, err := setup(c)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	lockFile := conf.LockFile(confFile)
+	lock, err := conf.ParseLock(lockFile)
+	if err != nil {
+		return err
+	}
+
+	scratchDir, err := ioutil.TempDir("", "trash-verify")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(scratchDir)
+
+	newLock, roots, err := populate(ctx, keep, trashDir, dir, targetDir, scratchDir, trashConf, lock, nil)
+	if err != nil {
+		return err
+	}
+
+	var drift []string
+	for _, li := range newLock.Imports {
+		if old, ok := lock.Get(li.Package); !ok || old.Commit != li.Commit {
+			drift = append(drift, fmt.Sprintf("%s: '%s' resolves to %s", lockFile, li.Package, li.Commit))
+		}
+	}
+
+	expected, err := hashVendor(scratchDir, roots)
+	if err != nil {
+		return err
+	}
+	expected.addSigners(newLock)
+	recorded, err := readManifest(manifestFile(confFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err != nil {
+		drift = append(drift, fmt.Sprintf("%s does not exist", manifestFile(confFile)))
+	}
+	for _, d := range expected.diff(recorded) {
+		drift = append(drift, manifestFile(confFile)+": "+d)
+	}
+
+	vendorDir := path.Join(dir, targetDir)
+	actual, err := hashVendor(vendorDir, append(roots, recorded.roots()...))
+	if err != nil {
+		return err
+	}
+	actual.addSigners(newLock)
+	for _, d := range expected.diff(actual) {
+		drift = append(drift, targetDir+": "+d)
+	}
+	unmanaged, err := unmanagedFiles(vendorDir, append(roots, recorded.roots()...))
+	if err != nil {
+		return err
+	}
+	for _, f := range unmanaged {
+		drift = append(drift, fmt.Sprintf("%s: '%s' does not belong to any vendored package", targetDir, f))
+	}
+
+	if len(drift) == 0 {
+		logrus.Infof("'%s' is up to date", targetDir)
+		return nil
+	}
+	for _, d := range drift {
+		logrus.Error(d)
+	}
+	return cli.NewExitError(fmt.Sprintf("'%s' has drifted: %d problem(s) found", targetDir, len(drift)), 1)
+}